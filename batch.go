@@ -0,0 +1,262 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// batch.go reads, writes and deletes many values at once. The batch
+// operations of Filestore take the locks of every key up front, in sorted
+// order, and then spread the reads, writes and cryptography of the values
+// over up to batchWorkers goroutines. Each key succeeds or fails on its own,
+// so a batch is not atomic; use a transaction for that.
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// batchWorkers is the number of values a batch operation works on at once.
+const batchWorkers = 8
+
+// runBatch calls fn with every index below n, on up to batchWorkers
+// goroutines, and returns once all calls have returned.
+func runBatch(n int, fn func(i int)) {
+	if n == 1 {
+		fn(0)
+		return
+	}
+	workers := batchWorkers
+	if n < workers {
+		workers = n
+	}
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// uniqueKeys returns the keys sorted, without duplicates.
+func uniqueKeys(keys []string) []string {
+	unique := make([]string, 0, len(keys))
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			unique = append(unique, key)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// batchErrors returns the error for every key, or nil if there are no keys.
+func batchErrors(keys []string, err error) map[string]error {
+	if len(keys) == 0 {
+		return nil
+	}
+	errs := make(map[string]error, len(keys))
+	for _, key := range keys {
+		errs[key] = err
+	}
+	return errs
+}
+
+// GetMulti implements [KeyValue.GetMulti]
+func (f *Filestore) GetMulti(keys []string) (map[string][]byte,
+	map[string]error) {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	keys = uniqueKeys(keys)
+	if err := f.checkOpen(); err != nil {
+		return nil, batchErrors(keys, err)
+	}
+
+	names, encryptedKeys := f.batchNames(keys)
+	unlock := f.takeReadLocks(encryptedKeys)
+	values := make([][]byte, len(keys))
+	results := make([]error, len(keys))
+	runBatch(len(keys), func(i int) {
+		values[i], _, results[i] = f.loadValue(names[i])
+	})
+	unlock()
+
+	found := make(map[string][]byte, len(keys))
+	var errs map[string]error
+	for i, key := range keys {
+		if results[i] != nil {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[key] = results[i]
+		} else {
+			found[key] = values[i]
+		}
+	}
+	return found, errs
+}
+
+// SetMulti implements [KeyValue.SetMulti]. The keys are added to the index
+// with a single write of it.
+func (f *Filestore) SetMulti(values map[string][]byte) map[string]error {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if err := f.checkOpen(); err != nil {
+		return batchErrors(keys, err)
+	}
+
+	errs := make(map[string]error)
+	valid := keys[:0]
+	for _, key := range keys {
+		if err := f.keys.checkKey(key); err != nil {
+			errs[key] = err
+		} else {
+			valid = append(valid, key)
+		}
+	}
+	keys = valid
+
+	names, encryptedKeys := f.batchNames(keys)
+	unlock := f.takeTransactionLocks(encryptedKeys)
+	indexAdded, err := f.indexAdd(keys...)
+	if err != nil {
+		unlock()
+		for _, key := range keys {
+			errs[key] = err
+		}
+		return errs
+	}
+	added := make([]bool, len(keys))
+	sizes := make([]int, len(keys))
+	results := make([]error, len(keys))
+	runBatch(len(keys), func(i int) {
+		jww.TRACE.Printf("%s,SET,%s,%s,%s", kvDebugHeader, keys[i],
+			encryptedKeys[i], values[keys[i]])
+		added[i], sizes[i], results[i] = f.writeValue(names[i],
+			values[keys[i]])
+	})
+	// Keys that had no value are not left in the index if their writes failed
+	settled := make([]string, 0, len(indexAdded))
+	unwritten := make([]string, 0, len(indexAdded))
+	for _, key := range indexAdded {
+		if results[sort.SearchStrings(keys, key)] != nil {
+			unwritten = append(unwritten, key)
+		} else {
+			settled = append(settled, key)
+		}
+	}
+	if err = f.indexRemove(unwritten...); err != nil {
+		jww.WARN.Printf("Could not remove %q from the index: %+v",
+			unwritten, err)
+	}
+	f.indexSettle(settled...)
+	unlock()
+
+	written := make([]string, 0, len(keys))
+	size := 0
+	for i, key := range keys {
+		if results[i] != nil {
+			errs[key] = results[i]
+			continue
+		}
+		written = append(written, key)
+		if added[i] {
+			size = sizes[i]
+		}
+	}
+	err = f.saveManifest()
+	if err == nil && size > 0 {
+		err = f.reconcileDecoys(size)
+	}
+	if err != nil {
+		for _, key := range written {
+			errs[key] = err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// DeleteMulti implements [KeyValue.DeleteMulti]. The keys are removed from
+// the index with a single write of it.
+func (f *Filestore) DeleteMulti(keys []string) map[string]error {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	keys = uniqueKeys(keys)
+	if err := f.checkOpen(); err != nil {
+		return batchErrors(keys, err)
+	}
+
+	names, encryptedKeys := f.batchNames(keys)
+	unlock := f.takeTransactionLocks(encryptedKeys)
+	reconcile := make([]bool, len(keys))
+	sizes := make([]int, len(keys))
+	results := make([]error, len(keys))
+	runBatch(len(keys), func(i int) {
+		jww.TRACE.Printf("%s,DELETE,%s,%s", kvDebugHeader, keys[i],
+			encryptedKeys[i])
+		reconcile[i], sizes[i], results[i] = f.removeValue(names[i])
+	})
+
+	errs := make(map[string]error)
+	removed := make([]string, 0, len(keys))
+	size, reconciled := 0, false
+	for i, key := range keys {
+		if results[i] != nil {
+			errs[key] = results[i]
+			continue
+		}
+		removed = append(removed, key)
+		if reconcile[i] {
+			size, reconciled = sizes[i], true
+		}
+	}
+	err := f.indexRemove(removed...)
+	unlock()
+	if err == nil {
+		err = f.saveManifest()
+	}
+	if err == nil && reconciled {
+		err = f.reconcileDecoys(size)
+	}
+	if err != nil {
+		for _, key := range removed {
+			errs[key] = err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// batchNames returns the filenames and encrypted keys of the keys.
+func (f *Filestore) batchNames(keys []string) ([]string, []string) {
+	names := make([]string, len(keys))
+	encryptedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = f.keys.name(key)
+		encryptedKeys[i] = f.getPath(names[i])
+	}
+	return names, encryptedKeys
+}
@@ -0,0 +1,154 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// testBatch sets, gets and deletes many keys of the KeyValue at once.
+func testBatch(t *testing.T, kv KeyValue) {
+	values := make(map[string][]byte)
+	keys := make([]string, 0, 3*batchWorkers)
+	for i := 0; i < 3*batchWorkers; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		values[key] = []byte(key)
+		keys = append(keys, key)
+	}
+	if errs := kv.SetMulti(values); errs != nil {
+		t.Fatalf("Failed to set values: %+v", errs)
+	}
+
+	found, errs := kv.GetMulti(append(keys, "missing", keys[0]))
+	if len(found) != len(keys) || len(errs) != 1 {
+		t.Errorf("Got %d values and %d errors", len(found), len(errs))
+	}
+	for key, data := range found {
+		if string(data) != key {
+			t.Errorf("Bad value for %s: %q", key, data)
+		}
+	}
+	if !errors.Is(errs["missing"], ErrNotFound) {
+		t.Errorf("Unexpected error for a missing key: %+v", errs["missing"])
+	}
+	checkKeys(t, kv, keys...)
+
+	// Transactions read their keys in parallel as well
+	err := kv.Transaction(func(files map[string]Operable, _ Extender) error {
+		for key, file := range files {
+			if data, ok := file.Get(); !ok || string(data) != key {
+				t.Errorf("Bad value for %s in a transaction: %q, %t", key,
+					data, ok)
+			}
+		}
+		return nil
+	}, keys...)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if errs = kv.DeleteMulti(append(keys[1:], "missing")); errs != nil {
+		t.Fatalf("Failed to delete values: %+v", errs)
+	}
+	checkKeys(t, kv, keys[0])
+	found, errs = kv.GetMulti(keys[:2])
+	if len(found) != 1 || len(errs) != 1 || !Exists(errs[keys[0]]) {
+		t.Errorf("Unexpected results after deleting: %q, %+v", found, errs)
+	}
+}
+
+// TestFilestore_Batch runs batches on a store with an index.
+func TestFilestore_Batch(t *testing.T) {
+	opts := testOptions()
+	opts.Index = true
+	f := newTestStore(t, nil, opts, nil)
+	testBatch(t, f)
+
+	errs := f.Prefix("ns").SetMulti(map[string][]byte{"a": []byte("1")})
+	if errs != nil {
+		t.Fatalf("%+v", errs)
+	}
+	found, errs := f.Prefix("ns").GetMulti([]string{"a", "b"})
+	if string(found["a"]) != "1" || len(errs) != 1 || Exists(errs["b"]) {
+		t.Errorf("Unexpected results in a namespace: %q, %+v", found, errs)
+	}
+
+	f.Close()
+	if _, errs = f.GetMulti([]string{"a"}); !errors.Is(errs["a"], ErrClosed) {
+		t.Errorf("Unexpected errors for a closed store: %+v", errs)
+	}
+}
+
+// TestFilestore_Batch_Decoys runs batches on a store with decoys, which must
+// keep the decoys in step with the values.
+func TestFilestore_Batch_Decoys(t *testing.T) {
+	opts := testOptions()
+	opts.Decoys = DecoyPolicy{Step: 4}
+	f, err := NewGenericFilestoreWithOptions(
+		portable.UseKeyValue(newMemoryKV()), "dir", "password", rand.Reader,
+		opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	values := map[string][]byte{"a": []byte("1"), "b": []byte("2"),
+		"c": []byte("3")}
+	if errs := f.SetMulti(values); errs != nil {
+		t.Fatalf("%+v", errs)
+	}
+	if shortfall := f.decoys.shortfall(); shortfall != 0 {
+		t.Errorf("Decoys are short by %d", shortfall)
+	}
+	if errs := f.DeleteMulti([]string{"a", "b"}); errs != nil {
+		t.Fatalf("%+v", errs)
+	}
+	found, errs := f.GetMulti([]string{"a", "b", "c"})
+	if len(found) != 1 || string(found["c"]) != "3" || len(errs) != 2 {
+		t.Errorf("Unexpected results: %q, %+v", found, errs)
+	}
+}
+
+// TestFilestore_SetMulti_Errors checks that keys that fail are reported
+// without stopping the others.
+func TestFilestore_SetMulti_Errors(t *testing.T) {
+	opts := testOptions()
+	opts.EncryptedNames = true
+	f, err := NewGenericFilestoreWithOptions(
+		portable.UseKeyValue(newMemoryKV()), "dir", "password", rand.Reader,
+		opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	long := strings.Repeat("k", maxNameSize)
+	errs := f.SetMulti(map[string][]byte{"a": []byte("1"), long: []byte("2")})
+	if len(errs) != 1 || !errors.Is(errs[long], ErrKeyTooLong) {
+		t.Errorf("Unexpected errors: %+v", errs)
+	}
+	checkValues(t, f, map[string]string{"a": "1"})
+}
+
+// TestRunBatch checks that every index is run once.
+func TestRunBatch(t *testing.T) {
+	for _, n := range []int{0, 1, batchWorkers, 10 * batchWorkers} {
+		counts := make([]int32, n)
+		runBatch(n, func(i int) {
+			atomic.AddInt32(&counts[i], 1)
+		})
+		for i, count := range counts {
+			if count != 1 {
+				t.Errorf("Index %d of %d ran %d times", i, n, count)
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// ciphersuite.go defines the AEAD constructions a store can be encrypted
+// with. The suite is chosen when the store is created and its name is recorded
+// in the header, so a store is always reopened with the suite it was created
+// with. Headers without a suite use XChaCha20-Poly1305, which every store used
+// before suites were introduced.
+//
+// The suite encrypts the values, the check value and the master key in each
+// key slot. Every suite takes a 256 bit key and a random nonce is generated for
+// every message.
+//
+// None of the suites are key committing: a ciphertext can be crafted to
+// decrypt under several keys, and so under several passwords. Stores created
+// with Options.Committing wrap their suite with committingSuite, which
+// prepends a commitment to the key and nonce to every ciphertext and checks it
+// before the ciphertext is decrypted.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuite is an AEAD construction that a store can be encrypted with.
+// Suites other than the ones provided by this package must be registered with
+// [RegisterCipherSuite] before a store is created or opened with them.
+type CipherSuite interface {
+	// Name identifies the suite in the store header.
+	Name() string
+	// NewAEAD returns the AEAD keyed with the 256 bit key.
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+var (
+	// XChaCha20Poly1305 is the default suite. Its 192 bit nonces can be
+	// generated at random for any number of values.
+	XChaCha20Poly1305 CipherSuite = xchacha20Poly1305Suite{}
+	// AES256GCM is AES-256 in GCM mode, for deployments that require FIPS
+	// approved algorithms. Its 96 bit random nonces limit each store to
+	// about 2^32 writes.
+	AES256GCM CipherSuite = aes256GCMSuite{}
+	// AES256GCMSIV is AES-256-GCM-SIV as specified in RFC 8452. Reusing a
+	// nonce only reveals whether two values are equal. It authenticates
+	// with a portable constant time multiplication that runs at around
+	// 10 MB/s, so it is much slower than the other suites.
+	AES256GCMSIV CipherSuite = aes256GCMSIVSuite{}
+)
+
+var (
+	// cipherSuites holds every suite by name.
+	cipherSuites = map[string]CipherSuite{
+		XChaCha20Poly1305.Name(): XChaCha20Poly1305,
+		AES256GCM.Name():         AES256GCM,
+		AES256GCMSIV.Name():      AES256GCMSIV,
+	}
+	cipherSuitesMux sync.RWMutex
+)
+
+// RegisterCipherSuite makes the suite available to stores under its name, which
+// is recorded in the header of the stores created with it. The suite must be
+// registered under the same name in every program that opens those stores. It
+// returns an error if the name is empty or already taken.
+func RegisterCipherSuite(suite CipherSuite) error {
+	if suite == nil || suite.Name() == "" {
+		return errors.New("cipher suite must have a name")
+	}
+	cipherSuitesMux.Lock()
+	defer cipherSuitesMux.Unlock()
+	if _, ok := cipherSuites[suite.Name()]; ok {
+		return errors.Errorf("cipher suite %q is already registered",
+			suite.Name())
+	}
+	cipherSuites[suite.Name()] = suite
+	return nil
+}
+
+// lookupCipherSuite returns the suite recorded in a header under the name.
+// The empty name is XChaCha20-Poly1305.
+func lookupCipherSuite(name string) (CipherSuite, error) {
+	if name == "" {
+		return XChaCha20Poly1305, nil
+	}
+	cipherSuitesMux.RLock()
+	suite, ok := cipherSuites[name]
+	cipherSuitesMux.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unsupported cipher suite %q", name)
+	}
+	return suite, nil
+}
+
+const (
+	// commitmentSize is the size of the key commitment of each ciphertext
+	// in committing stores.
+	commitmentSize = sha256.Size
+	// commitmentLabel separates the hash of the key used for commitments.
+	commitmentLabel = "ekv key commitment"
+	// errCommitment is returned when a ciphertext was not committed to the
+	// key it is being decrypted with.
+	errCommitment = "ciphertext is not committed to the key"
+)
+
+// newAEAD returns the AEAD of the suite keyed with the key.
+func newAEAD(suite CipherSuite, key []byte) (cipher.AEAD, error) {
+	aead, err := suite.NewAEAD(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not init %s", suite.Name())
+	}
+	return aead, nil
+}
+
+type xchacha20Poly1305Suite struct{}
+
+// Name implements [CipherSuite.Name].
+func (xchacha20Poly1305Suite) Name() string {
+	return "xchacha20poly1305"
+}
+
+// NewAEAD implements [CipherSuite.NewAEAD].
+func (xchacha20Poly1305Suite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key)
+}
+
+type aes256GCMSuite struct{}
+
+// Name implements [CipherSuite.Name].
+func (aes256GCMSuite) Name() string {
+	return "aes256gcm"
+}
+
+// NewAEAD implements [CipherSuite.NewAEAD].
+func (aes256GCMSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, errors.Errorf("invalid AES-256 key size %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type aes256GCMSIVSuite struct{}
+
+// Name implements [CipherSuite.Name].
+func (aes256GCMSIVSuite) Name() string {
+	return "aes256gcmsiv"
+}
+
+// NewAEAD implements [CipherSuite.NewAEAD].
+func (aes256GCMSIVSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, errors.Errorf("invalid AES-256 key size %d", len(key))
+	}
+	return newGCMSIV(key)
+}
+
+// committingSuite makes the AEADs of a suite key committing.
+type committingSuite struct {
+	CipherSuite
+}
+
+// NewAEAD implements [CipherSuite.NewAEAD].
+func (s committingSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	aead, err := s.CipherSuite.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte(commitmentLabel))
+	h.Write(key)
+	return &committingAEAD{AEAD: aead, keyHash: h.Sum(nil)}, nil
+}
+
+// committingAEAD prepends SHA-256(keyHash || nonce) to every ciphertext, where
+// keyHash is SHA-256(commitmentLabel || key). Finding two keys that accept the
+// same ciphertext then requires a SHA-256 collision.
+type committingAEAD struct {
+	cipher.AEAD
+	keyHash []byte
+}
+
+// Overhead implements [cipher.AEAD.Overhead].
+func (c *committingAEAD) Overhead() int {
+	return commitmentSize + c.AEAD.Overhead()
+}
+
+// Seal implements [cipher.AEAD.Seal].
+func (c *committingAEAD) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	dst = append(dst, c.commitment(nonce)...)
+	return c.AEAD.Seal(dst, nonce, plaintext, ad)
+}
+
+// Open implements [cipher.AEAD.Open]. The commitment is checked before the
+// ciphertext is decrypted.
+func (c *committingAEAD) Open(dst, nonce, ciphertext,
+	ad []byte) ([]byte, error) {
+	if len(ciphertext) < commitmentSize || subtle.ConstantTimeCompare(
+		ciphertext[:commitmentSize], c.commitment(nonce)) != 1 {
+		return nil, errors.New(errCommitment)
+	}
+	return c.AEAD.Open(dst, nonce, ciphertext[commitmentSize:], ad)
+}
+
+// commitment returns the commitment to the key and nonce.
+func (c *committingAEAD) commitment(nonce []byte) []byte {
+	h := sha256.New()
+	h.Write(c.keyHash)
+	h.Write(nonce)
+	return h.Sum(nil)
+}
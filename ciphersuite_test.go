@@ -0,0 +1,257 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// TestCipherSuite_Vectors checks each suite against a published test vector.
+func TestCipherSuite_Vectors(t *testing.T) {
+	tests := []struct {
+		suite                                 CipherSuite
+		key, nonce, plaintext, ad, ciphertext string
+	}{
+		// draft-irtf-cfrg-xchacha-03, appendix A.3.1
+		{
+			XChaCha20Poly1305,
+			"808182838485868788898a8b8c8d8e8f" +
+				"909192939495969798999a9b9c9d9e9f",
+			"404142434445464748494a4b4c4d4e4f5051525354555657",
+			"4c616469657320616e642047656e746c656d656e206f662074686520636c61" +
+				"7373206f66202739393a204966204920636f756c64206f6666657220796f" +
+				"75206f6e6c79206f6e652074697020666f7220746865206675747572652c" +
+				"2073756e73637265656e20776f756c642062652069742e",
+			"50515253c0c1c2c3c4c5c6c7",
+			"bd6d179d3e83d43b9576579493c0e939572a1700252bfaccbed2902c21396cbb" +
+				"731c7f1b0b4aa6440bf3a82f4eda7e39ae64c6708c54c216cb96b72e1213b4" +
+				"522f8c9ba40db5d945b11b69b982c1bb9e3f3fac2bc369488f76b2383565d3" +
+				"fff921f9664c97637da9768812f615c68b13b52e" +
+				"c0875924c1c7987947deafd8780acf49",
+		},
+		// The Galois/Counter Mode of Operation (GCM), test case 14
+		{
+			AES256GCM,
+			"00000000000000000000000000000000" +
+				"00000000000000000000000000000000",
+			"000000000000000000000000",
+			"00000000000000000000000000000000",
+			"",
+			"cea7403d4d606b6e074ec5d3baf39d18" +
+				"d0d1c8a799996bf0265b98b5d48ab919",
+		},
+		// RFC 8452, appendix C.2
+		{
+			AES256GCMSIV,
+			"01000000000000000000000000000000" +
+				"00000000000000000000000000000000",
+			"030000000000000000000000",
+			"0200000000000000",
+			"01",
+			"1de22967237a813291213f267e3b452f02d01ae33e4ec854",
+		},
+	}
+
+	for _, tt := range tests {
+		aead, err := tt.suite.NewAEAD(mustHex(t, tt.key))
+		if err != nil {
+			t.Fatalf("%s: %+v", tt.suite.Name(), err)
+		}
+		nonce, plaintext := mustHex(t, tt.nonce), mustHex(t, tt.plaintext)
+		ad, expected := mustHex(t, tt.ad), mustHex(t, tt.ciphertext)
+
+		ciphertext := aead.Seal(nil, nonce, plaintext, ad)
+		if !bytes.Equal(ciphertext, expected) {
+			t.Errorf("%s: sealed %x, expected %x", tt.suite.Name(),
+				ciphertext, expected)
+		}
+		opened, err := aead.Open(nil, nonce, expected, ad)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("%s: opened %x, expected %x: %v", tt.suite.Name(),
+				opened, plaintext, err)
+		}
+	}
+}
+
+// TestFilestore_CipherSuites creates a store with each suite and checks that
+// it can be reopened without knowing which one it uses.
+func TestFilestore_CipherSuites(t *testing.T) {
+	for _, suite := range []CipherSuite{XChaCha20Poly1305, AES256GCM,
+		AES256GCMSIV} {
+		kv := newMemoryKV()
+		storage := portable.UseKeyValue(kv)
+		opts := testOptions()
+		opts.Cipher = suite
+		f, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+			rand.Reader, opts)
+		if err != nil {
+			t.Fatalf("%s: %+v", suite.Name(), err)
+		}
+		if err = f.SetBytes("a", []byte("1")); err != nil {
+			t.Fatalf("%s: %+v", suite.Name(), err)
+		}
+		err = f.AddKeySlot("recovery", "code", testKDFParams)
+		if err != nil {
+			t.Fatalf("%s: %+v", suite.Name(), err)
+		}
+
+		for _, secret := range []string{"password", "code"} {
+			f, err = openTestStore(storage, "dir", secret)
+			if err != nil {
+				t.Fatalf("%s: %+v", suite.Name(), err)
+			}
+			if f.header.cipherSuite() != suite {
+				t.Errorf("%s: store reopened with %s", suite.Name(),
+					f.header.cipherSuite().Name())
+			}
+			checkValues(t, f, map[string]string{"a": "1"})
+		}
+	}
+}
+
+// unknownSuite is a suite that is not registered.
+type unknownSuite struct {
+	CipherSuite
+}
+
+// Name implements [CipherSuite.Name].
+func (unknownSuite) Name() string {
+	return "unknown"
+}
+
+// TestFilestore_UnknownCipherSuite checks that stores cannot be created or
+// opened with suites that are not registered.
+func TestFilestore_UnknownCipherSuite(t *testing.T) {
+	opts := testOptions()
+	opts.Cipher = unknownSuite{XChaCha20Poly1305}
+	storage := portable.UseKeyValue(newMemoryKV())
+	_, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+		rand.Reader, opts)
+	if err == nil {
+		t.Errorf("Created a store with an unknown cipher suite")
+	}
+
+	h, _, err := newHeader([]byte("password"), testOptions(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Cipher = "unknown"
+	if err = h.validate(); err == nil {
+		t.Errorf("Validated a header with an unknown cipher suite")
+	}
+}
+
+// TestRegisterCipherSuite registers a suite, checks that a store created with
+// it is reopened with it, and that names cannot be registered twice.
+func TestRegisterCipherSuite(t *testing.T) {
+	suite := unknownSuite{AES256GCM}
+	if err := RegisterCipherSuite(suite); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	t.Cleanup(func() {
+		cipherSuitesMux.Lock()
+		delete(cipherSuites, suite.Name())
+		cipherSuitesMux.Unlock()
+	})
+
+	opts := testOptions()
+	opts.Cipher = suite
+	storage := portable.UseKeyValue(newMemoryKV())
+	f := newTestStore(t, storage, opts, map[string]string{"a": "1"})
+	f, err := openTestStore(storage, "dir", testPassword)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.header.cipherSuite() != suite {
+		t.Errorf("Store reopened with %s", f.header.cipherSuite().Name())
+	}
+	checkValues(t, f, map[string]string{"a": "1"})
+
+	for _, s := range []CipherSuite{suite, AES256GCM, unknownSuite{
+		XChaCha20Poly1305}, nil} {
+		if err = RegisterCipherSuite(s); err == nil {
+			t.Errorf("Registering %v did not fail", s)
+		}
+	}
+}
+
+// TestCommittingSuite checks that committing ciphertexts are rejected under
+// any other key before they are decrypted.
+func TestCommittingSuite(t *testing.T) {
+	key1, key2 := make([]byte, keySize), make([]byte, keySize)
+	key2[0] = 1
+	for _, suite := range []CipherSuite{XChaCha20Poly1305, AES256GCM,
+		AES256GCMSIV} {
+		committing := committingSuite{suite}
+		ciphertext := mustEncrypt(t, committing, []byte("value"), key1)
+
+		plaintext, err := decrypt(committing, ciphertext, key1)
+		if err != nil || string(plaintext) != "value" {
+			t.Errorf("%s: decrypted %q: %+v", suite.Name(), plaintext, err)
+		}
+		_, err = decrypt(committing, ciphertext, key2)
+		if err == nil || !strings.Contains(err.Error(), errCommitment) {
+			t.Errorf("%s: unexpected error for another key: %v",
+				suite.Name(), err)
+		}
+
+		// The commitment follows the nonce
+		nonceSize := mustAEAD(t, suite, key1).NonceSize()
+		ciphertext[nonceSize] ^= 1
+		_, err = decrypt(committing, ciphertext, key1)
+		if err == nil || !strings.Contains(err.Error(), errCommitment) {
+			t.Errorf("%s: unexpected error for a modified commitment: %v",
+				suite.Name(), err)
+		}
+
+		// Ciphertexts without a commitment are rejected
+		plain := mustEncrypt(t, suite, []byte("value"), key1)
+		if _, err = decrypt(committing, plain, key1); err == nil {
+			t.Errorf("%s: decrypted a ciphertext without a commitment",
+				suite.Name())
+		}
+	}
+}
+
+// TestFilestore_Committing checks that a committing store can be reopened
+// without knowing that it is committing.
+func TestFilestore_Committing(t *testing.T) {
+	storage := portable.UseKeyValue(newMemoryKV())
+	opts := testOptions()
+	opts.Cipher = AES256GCM
+	opts.Committing = true
+	f, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+		rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !f.header.Committing || f.header.Cipher != AES256GCM.Name() {
+		t.Errorf("Header does not record the commitment: %+v", f.header)
+	}
+	if _, ok := f.keys.content.(*committingAEAD); !ok {
+		t.Errorf("Values are not committing")
+	}
+	checkValues(t, f, map[string]string{"a": "1"})
+
+	if _, err = openTestStore(storage, "dir", "bad"); err == nil {
+		t.Errorf("Opened with a bad password")
+	}
+}
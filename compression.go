@@ -0,0 +1,117 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// compression.go compresses values before they are padded and encrypted.
+// Compression is chosen when a store is created and recorded in its header.
+//
+// In a store with compression, every value starts with a byte telling whether
+// the rest is compressed, which is only the case when that makes it smaller.
+// Values shorter than compressionThreshold are never compressed. As the flag
+// is encrypted along with the value, it does not reveal anything; but the
+// compressed length depends on the contents of the value, so compression
+// should not be used where an attacker can mix chosen data with secrets in
+// the same value and observe the size of its files.
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Compression selects how values are compressed before they are encrypted.
+type Compression uint8
+
+const (
+	// NoCompression stores values as they are.
+	NoCompression Compression = iota
+	// FlateCompression compresses values with DEFLATE (RFC 1951).
+	FlateCompression
+)
+
+const (
+	// compressionThreshold is the length below which values are never
+	// compressed.
+	compressionThreshold = 64
+
+	// Flags at the start of the values of stores with compression
+	uncompressedFlag = 0x00
+	flateFlag        = 0x01
+)
+
+// validate returns an error if the compression cannot be used.
+func (c Compression) validate() error {
+	switch c {
+	case NoCompression, FlateCompression:
+		return nil
+	default:
+		return errors.Errorf("unknown compression: %d", c)
+	}
+}
+
+// compress returns the value prefixed with its flag for stores with
+// compression, compressing it if that makes it smaller.
+func compress(h *storeHeader, data []byte) []byte {
+	if h == nil || h.Compression == NoCompression {
+		return data
+	}
+
+	if len(data) >= compressionThreshold {
+		buf := bytes.NewBuffer(make([]byte, 0, len(data)))
+		buf.WriteByte(flateFlag)
+		w, err := flate.NewWriter(buf, flate.DefaultCompression)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		if err == nil && buf.Len() < len(data)+1 {
+			return buf.Bytes()
+		}
+	}
+
+	flagged := make([]byte, 1+len(data))
+	flagged[0] = uncompressedFlag
+	copy(flagged[1:], data)
+	return flagged
+}
+
+// decompress returns the value of a store with compression without its flag,
+// decompressing it if needed. Values are not decompressed beyond the largest
+// record size.
+func decompress(h *storeHeader, data []byte) ([]byte, error) {
+	if h == nil || h.Compression == NoCompression {
+		return data, nil
+	}
+	if len(data) == 0 {
+		return nil, errors.New("missing compression flag")
+	}
+
+	switch data[0] {
+	case uncompressedFlag:
+		return data[1:], nil
+	case flateFlag:
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		defer r.Close()
+		limited := io.LimitReader(r, int64(maxRecordSize)+1)
+		plaintext, err := io.ReadAll(limited)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decompress value")
+		}
+		if uint64(len(plaintext)) > maxRecordSize {
+			return nil, errors.Wrap(ErrValueTooLarge,
+				"decompressed value exceeds the limit")
+		}
+		return plaintext, nil
+	default:
+		return nil, errors.Errorf("unknown compression flag %d", data[0])
+	}
+}
@@ -0,0 +1,153 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// TestCompress checks that values are only compressed when it makes them
+// smaller and that every value round trips.
+func TestCompress(t *testing.T) {
+	h := &storeHeader{Compression: FlateCompression}
+	random := make([]byte, 1024)
+	_, _ = rand.Read(random)
+
+	tests := []struct {
+		data []byte
+		flag byte
+	}{
+		{nil, uncompressedFlag},
+		{[]byte("short"), uncompressedFlag},
+		{bytes.Repeat([]byte("a"), compressionThreshold-1), uncompressedFlag},
+		{bytes.Repeat([]byte("a"), 1024), flateFlag},
+		{random, uncompressedFlag},
+	}
+	for i, tt := range tests {
+		compressed := compress(h, tt.data)
+		if compressed[0] != tt.flag {
+			t.Errorf("Test %d: unexpected flag %d", i, compressed[0])
+		}
+		data, err := decompress(h, compressed)
+		if err != nil || !bytes.Equal(data, tt.data) {
+			t.Errorf("Test %d: decompressed %q: %+v", i, data, err)
+		}
+	}
+
+	if _, err := decompress(h, []byte{0x7f}); err == nil {
+		t.Errorf("Decompressed a value with an unknown flag")
+	}
+	if data := compress(nil, []byte("value")); string(data) != "value" {
+		t.Errorf("Value of a store without compression was changed")
+	}
+}
+
+// TestDecompress_Limit checks that values are not decompressed beyond the
+// largest record size.
+func TestDecompress_Limit(t *testing.T) {
+	defer func(limit uint64) { maxRecordSize = limit }(maxRecordSize)
+	maxRecordSize = 1024
+
+	var buf bytes.Buffer
+	buf.WriteByte(flateFlag)
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	_, _ = w.Write(make([]byte, 4096))
+	_ = w.Close()
+
+	h := &storeHeader{Compression: FlateCompression}
+	if _, err := decompress(h, buf.Bytes()); !errors.Is(err,
+		ErrValueTooLarge) {
+		t.Errorf("Unexpected error for an oversized value: %v", err)
+	}
+}
+
+// TestFilestore_Compression checks that compression is transparent to every
+// way of reading and writing values and that it shrinks their files.
+func TestFilestore_Compression(t *testing.T) {
+	type record struct {
+		Name  string   `json:"name"`
+		Items []string `json:"items"`
+	}
+	value := record{Name: "test", Items: strings.Split(strings.Repeat(
+		"item,", 200), ",")}
+
+	sizes := make(map[Compression]int)
+	for _, c := range []Compression{NoCompression, FlateCompression} {
+		kv := newMemoryKV()
+		storage := portable.UseKeyValue(kv)
+		opts := testOptions()
+		opts.Compression = c
+		f, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+			rand.Reader, opts)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if err = f.SetInterface("a", value); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		contents, err := kv.Get(f.getKey("a") + ".1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[c] = len(contents)
+
+		err = f.Transaction(func(files map[string]Operable, _ Extender) error {
+			data, ok := files["a"].Get()
+			if !ok {
+				return errors.New("a does not exist")
+			}
+			files["b"].Set(data)
+			return nil
+		}, "a", "b")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+
+		f, err = openTestStore(storage, "dir", "password")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if f.header.Compression != c {
+			t.Errorf("Store reopened with compression %d", f.header.Compression)
+		}
+		for _, k := range []string{"a", "b"} {
+			read := record{}
+			if err = f.GetInterface(k, &read); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			if read.Name != value.Name || len(read.Items) != len(value.Items) {
+				t.Errorf("Unexpected value for %s: %+v", k, read)
+			}
+		}
+	}
+
+	if sizes[FlateCompression] >= sizes[NoCompression]/2 {
+		t.Errorf("Compressed file is %d bytes, uncompressed %d",
+			sizes[FlateCompression], sizes[NoCompression])
+	}
+}
+
+// TestFilestore_UnknownCompression checks that stores cannot be created with
+// an unknown compression.
+func TestFilestore_UnknownCompression(t *testing.T) {
+	opts := testOptions()
+	opts.Compression = FlateCompression + 1
+	_, err := NewGenericFilestoreWithOptions(
+		portable.UseKeyValue(newMemoryKV()), "dir", "password", rand.Reader,
+		opts)
+	if err == nil {
+		t.Errorf("Created a store with an unknown compression")
+	}
+}
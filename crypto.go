@@ -9,54 +9,413 @@ package ekv
 
 import (
 	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"sync"
+
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 	"io"
 )
 
+const (
+	// keySize is the size of the store key in bytes.
+	keySize = chacha20poly1305.KeySize
+	// saltSize is the size of the random salt fed into the KDF.
+	saltSize = 16
+	// boundValueTag is the first byte of values bound to their filename and
+	// store, and the format version included in their associated data.
+	// Values written before binding start directly with a random nonce.
+	boundValueTag = 0x01
+	// versionedValueTag is the first byte of the values of stores with a
+	// manifest, which are bound like other values and start with their
+	// version once decrypted.
+	versionedValueTag = 0x02
+	// versionSize is the size of the version of a versioned value.
+	versionSize = 8
+	// errUnboundValue is returned when a store with a header reads a value
+	// that is not bound.
+	errUnboundValue = "value is not bound to its filename and store"
+
+	// nameKeyInfo and contentKeyInfo separate the subkeys derived from the
+	// master key.
+	nameKeyInfo    = "ekv filename key"
+	contentKeyInfo = "ekv content key"
+)
+
+// KDFParams are the Argon2id cost parameters used to derive the store key from
+// the password. They are recorded in the store header so that a store is
+// always reopened with the parameters it was created with.
+type KDFParams struct {
+	// Time is the number of passes over the memory.
+	Time uint32 `json:"time"`
+	// Memory is the size of the memory in KiB.
+	Memory uint32 `json:"memory"`
+	// Threads is the number of lanes used to fill the memory.
+	Threads uint8 `json:"threads"`
+}
+
+// defaultKDFParams follows the second recommended option of RFC 9106.
+var defaultKDFParams = KDFParams{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// DefaultKDFParams returns the Argon2id parameters used for new stores when
+// none are provided.
+func DefaultKDFParams() KDFParams {
+	return defaultKDFParams
+}
+
+// validate returns an error if the parameters cannot be used with Argon2id.
+func (p KDFParams) validate() error {
+	if p.Time < 1 {
+		return errors.Errorf("invalid KDF time cost: %d", p.Time)
+	}
+	if p.Threads < 1 {
+		return errors.Errorf("invalid KDF thread count: %d", p.Threads)
+	}
+	if p.Memory < 8*uint32(p.Threads) {
+		return errors.Errorf("invalid KDF memory cost: %d KiB for %d "+
+			"threads", p.Memory, p.Threads)
+	}
+	return nil
+}
+
+// deriveKey stretches the password into a store key using Argon2id.
+func deriveKey(password, salt []byte, params KDFParams) []byte {
+	return argon2.IDKey(password, salt, params.Time, params.Memory,
+		params.Threads, keySize)
+}
+
+// legacyKey returns the key used by version:1 stores, which is an unsalted
+// hash of the password.
+func legacyKey(password []byte) []byte {
+	pwHash := blake2b.Sum256(password)
+	return pwHash[:]
+}
+
+// zero overwrites the key material in b.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// keySchedule holds the keys used for the filenames and values of a store.
+// It is derived once when the store is opened and is safe for concurrent use.
+//
+// Stores with a header derive separate subkeys from the master key with
+// HKDF-SHA256 and name each value with a keyed blake2b MAC of the salt and the
+// key name, or with an encryption of the key name for stores with encrypted
+// filenames (see names.go). Version:1 stores use the master key for both with
+// hashStringWithKey.
+type keySchedule struct {
+	// keys holds nameKey followed by contentKey
+	keys       *lockedBuffer
+	nameKey    []byte
+	nameSalt   []byte // nil for the legacy schedule
+	contentKey []byte
+	// content is the AEAD keyed with contentKey
+	content cipher.AEAD
+	// names is the AES-GCM-SIV AEAD keyed with nameKey, which is nil
+	// unless filenames are encrypted
+	names cipher.AEAD
+	// macs holds keyed blake2b MACs ready to be reset and reused
+	macs sync.Pool
+}
+
+// newKeySchedule returns the keys for the store with the header and master
+// key. The header is nil for version:1 stores.
+func newKeySchedule(h *storeHeader, masterKey []byte) (*keySchedule, error) {
+	keys := newLockedBuffer(2 * keySize)
+	k := &keySchedule{
+		keys:       keys,
+		nameKey:    keys.bytes()[:keySize],
+		contentKey: keys.bytes()[keySize:],
+	}
+	var err error
+	if h == nil {
+		copy(k.nameKey, masterKey)
+		copy(k.contentKey, masterKey)
+	} else if h.EncryptedNames {
+		k.nameSalt = h.NameSalt
+		err = deriveSubkey(k.nameKey, masterKey, nameCipherInfo)
+		if err == nil {
+			err = deriveSubkey(k.contentKey, masterKey, contentKeyInfo)
+		}
+		if err == nil {
+			k.names, err = newAEAD(AES256GCMSIV, k.nameKey)
+		}
+	} else {
+		k.nameSalt = h.NameSalt
+		err = deriveSubkey(k.nameKey, masterKey, nameKeyInfo)
+		if err == nil {
+			err = deriveSubkey(k.contentKey, masterKey, contentKeyInfo)
+		}
+		// The MACs of the name key are made on demand by name, which
+		// cannot fail once one was made here
+		if err == nil {
+			_, err = blake2b.New256(k.nameKey)
+			err = errors.Wrap(err, "could not init blake2b MAC")
+		}
+	}
+	if err == nil {
+		k.content, err = newAEAD(h.cipherSuite(), k.contentKey)
+	}
+	if err != nil {
+		k.wipe()
+		return nil, err
+	}
+	return k, nil
+}
+
+// deriveSubkey expands the master key into the subkey for the purpose given
+// by info.
+func deriveSubkey(subkey, masterKey []byte, info string) error {
+	r := hkdf.New(sha256.New, masterKey, nil, []byte(info))
+	if _, err := io.ReadFull(r, subkey); err != nil {
+		return errors.Wrap(err, "could not derive subkey")
+	}
+	return nil
+}
+
+// name returns the filename of the key.
+func (k *keySchedule) name(key string) string {
+	if k.nameSalt == nil {
+		return encodeKey(hashStringWithKey(key, k.nameKey))
+	} else if k.names != nil {
+		return k.encryptName(key)
+	}
+
+	mac, ok := k.macs.Get().(hash.Hash)
+	if !ok {
+		// newKeySchedule checked that the name key makes a MAC
+		mac, _ = blake2b.New256(k.nameKey)
+	}
+	mac.Write(k.nameSalt)
+	mac.Write([]byte(key))
+	name := encodeKey(mac.Sum(nil))
+	mac.Reset()
+	k.macs.Put(mac)
+	return name
+}
+
+// wipe zeroes and releases the keys. The AEAD and MACs keep their own copies
+// of the keys, which cannot be zeroed, so they are dropped for the garbage
+// collector.
+func (k *keySchedule) wipe() {
+	k.keys.destroy()
+	k.nameKey = nil
+	k.contentKey = nil
+	k.content = nil
+	k.names = nil
+	k.macs = sync.Pool{}
+}
+
 // Used for keyed hashes for, e.g., the "key" in the KV store
-func hashStringWithPassword(data, password string) []byte {
+func hashStringWithKey(data string, key []byte) []byte {
 	dHash := blake2b.Sum256([]byte(data))
-	pHash := blake2b.Sum256([]byte(password))
-	s := append(pHash[:], dHash[:]...)
+	s := make([]byte, 0, len(key)+len(dHash))
+	s = append(append(s, key...), dHash[:]...)
 	h := blake2b.Sum256(s)
+	zero(s)
 	return h[:]
 }
 
-func initChaCha20Poly1305(password string) cipher.AEAD {
-	pwHash := blake2b.Sum256([]byte(password))
-	chaCipher, err := chacha20poly1305.NewX(pwHash[:])
+func encrypt(suite CipherSuite, data, key []byte,
+	csprng io.Reader) ([]byte, error) {
+	return encryptWithAD(suite, data, key, nil, csprng)
+}
+
+func decrypt(suite CipherSuite, data, key []byte) ([]byte, error) {
+	return decryptWithAD(suite, data, key, nil)
+}
+
+// encryptWithAD encrypts the data with the suite under the key,
+// authenticating the associated data along with it.
+func encryptWithAD(suite CipherSuite, data, key, ad []byte,
+	csprng io.Reader) ([]byte, error) {
+	aead, err := newAEAD(suite, key)
 	if err != nil {
-		panic(fmt.Sprintf("Could not init XChaCha20Poly1305 mode: %s",
-			err.Error()))
+		return nil, err
 	}
-	return chaCipher
+	return sealAEAD(aead, nil, data, ad, csprng)
 }
 
-func encrypt(data []byte, password string, csprng io.Reader) []byte {
-	chaCipher := initChaCha20Poly1305(password)
-	nonce := make([]byte, chaCipher.NonceSize())
+// decryptWithAD decrypts data produced by encryptWithAD with the same suite,
+// key and associated data.
+func decryptWithAD(suite CipherSuite, data, key, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return nil, err
+	}
+	return openAEAD(aead, data, ad)
+}
+
+// sealAEAD encrypts the data with the AEAD under a random nonce and returns
+// the prefix followed by the nonce and the ciphertext.
+func sealAEAD(aead cipher.AEAD, prefix, data, ad []byte,
+	csprng io.Reader) ([]byte, error) {
+	headerLen := len(prefix) + aead.NonceSize()
+	out := make([]byte, headerLen,
+		headerLen+len(data)+aead.Overhead())
+	copy(out, prefix)
+	nonce := out[len(prefix):]
 	if _, err := io.ReadFull(csprng, nonce); err != nil {
-		panic(fmt.Sprintf("Could not generate nonce: %s", err.Error()))
+		return nil, errors.Wrap(err, "could not generate nonce")
 	}
-	ciphertext := chaCipher.Seal(nonce, nonce, data, nil)
-	return ciphertext
+	return aead.Seal(out, nonce, data, ad), nil
 }
 
-func decrypt(data []byte, password string) ([]byte, error) {
-	chaCipher := initChaCha20Poly1305(password)
-	nonceLen := chaCipher.NonceSize()
+// openAEAD decrypts data produced by sealAEAD with the same AEAD and associated
+// data.
+func openAEAD(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	nonceLen := aead.NonceSize()
 	if (len(data) - nonceLen) <= 0 {
 		errMsg := fmt.Sprintf("Read %d bytes, too short to decrypt",
 			len(data))
 		return nil, errors.New(errMsg)
 	}
 	nonce, ciphertext := data[:nonceLen], data[nonceLen:]
-	plaintext, err := chaCipher.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
 	if err != nil {
 		return nil, errors.Wrap(err, "Cannot decrypt with password!")
 	}
 	return plaintext, nil
 }
+
+// valueAD returns the associated data binding a value with the format tag to
+// its filename and to the store.
+func valueAD(h *storeHeader, tag byte, name string) []byte {
+	ad := make([]byte, 0, 1+len(h.StoreID)+len(name))
+	ad = append(ad, tag)
+	ad = append(ad, h.StoreID...)
+	return append(ad, name...)
+}
+
+// valueTag returns the format tag of the values written to the store.
+func valueTag(h *storeHeader) byte {
+	if h != nil && h.Manifest {
+		return versionedValueTag
+	}
+	return boundValueTag
+}
+
+// sealValue encrypts the value stored under the filename with the content
+// AEAD. Values are bound to their filename and the store ID, except in
+// version:1 stores, so that they fail to decrypt if moved to another filename
+// or store. They are compressed and then padded first if the store has
+// compression and a padding policy.
+func sealValue(h *storeHeader, content cipher.AEAD, name string, data []byte,
+	csprng io.Reader) ([]byte, error) {
+	return sealVersionedValue(h, content, name, 0, data, csprng)
+}
+
+// sealVersionedValue encrypts the value like sealValue. In stores with a
+// manifest, the version is encrypted along with the value; otherwise it is
+// ignored.
+func sealVersionedValue(h *storeHeader, content cipher.AEAD, name string,
+	version uint64, data []byte, csprng io.Reader) ([]byte, error) {
+	data = compress(h, data)
+	if h != nil && h.Padding != nil {
+		data = h.Padding.pad(data)
+	}
+	// The record could not be written anyway, and the AEAD panics on
+	// plaintexts beyond its own, larger, limit
+	if uint64(len(data)) > maxRecordSize {
+		return nil, errors.Wrapf(ErrValueTooLarge, errRecordTooLarge,
+			len(data), maxRecordSize)
+	}
+	if h == nil {
+		return sealAEAD(content, nil, data, nil, csprng)
+	}
+	if !h.Manifest {
+		return sealAEAD(content, []byte{boundValueTag}, data,
+			valueAD(h, boundValueTag, name), csprng)
+	}
+
+	plaintext := make([]byte, versionSize+len(data))
+	binary.BigEndian.PutUint64(plaintext, version)
+	copy(plaintext[versionSize:], data)
+	return sealAEAD(content, []byte{versionedValueTag}, plaintext,
+		valueAD(h, versionedValueTag, name), csprng)
+}
+
+// openValue decrypts a value read from the filename, removes its padding and
+// decompresses it. Values without associated data are only accepted in
+// version:1 stores.
+func openValue(h *storeHeader, content cipher.AEAD, name string,
+	data []byte) ([]byte, error) {
+	plaintext, _, err := openVersionedValue(h, content, name, data)
+	return plaintext, err
+}
+
+// openVersionedValue decrypts a value like openValue and returns its version,
+// which is always zero in stores without a manifest. Values that cannot be
+// opened are reported as ErrCorrupt.
+func openVersionedValue(h *storeHeader, content cipher.AEAD, name string,
+	data []byte) ([]byte, uint64, error) {
+	plaintext, version, err := decryptVersionedValue(h, content, name, data)
+	if err != nil {
+		return nil, 0, corrupt(err)
+	}
+	return plaintext, version, nil
+}
+
+// decryptVersionedValue implements openVersionedValue.
+func decryptVersionedValue(h *storeHeader, content cipher.AEAD, name string,
+	data []byte) ([]byte, uint64, error) {
+	if h != nil && h.Manifest {
+		if len(data) == 0 || data[0] != versionedValueTag {
+			return nil, 0, errors.New(errUnboundValue)
+		}
+		plaintext, err := openAEAD(content, data[1:],
+			valueAD(h, versionedValueTag, name))
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(plaintext) < versionSize {
+			return nil, 0, errors.New("versioned value is too short")
+		}
+		version := binary.BigEndian.Uint64(plaintext)
+		plaintext = plaintext[versionSize:]
+		if h.Padding != nil {
+			if plaintext, err = unpad(plaintext); err != nil {
+				return nil, 0, err
+			}
+		}
+		plaintext, err = decompress(h, plaintext)
+		return plaintext, version, err
+	}
+
+	plaintext, err := openBoundValue(h, content, name, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	plaintext, err = decompress(h, plaintext)
+	return plaintext, 0, err
+}
+
+// openBoundValue decrypts a value of a store without a manifest.
+func openBoundValue(h *storeHeader, content cipher.AEAD, name string,
+	data []byte) ([]byte, error) {
+	if h == nil {
+		return openAEAD(content, data, nil)
+	}
+	if len(data) == 0 || data[0] != boundValueTag {
+		return nil, errors.New(errUnboundValue)
+	}
+	plaintext, err := openAEAD(content, data[1:],
+		valueAD(h, boundValueTag, name))
+	if err == nil && h.Padding != nil {
+		return unpad(plaintext)
+	}
+	return plaintext, err
+}
@@ -8,16 +8,54 @@
 package ekv
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"crypto/rand"
 	"testing"
+
+	"github.com/pkg/errors"
 )
 
+// mustEncrypt encrypts the data under the key with the suite and fails the
+// test if it cannot.
+func mustEncrypt(t testing.TB, suite CipherSuite, data, key []byte) []byte {
+	t.Helper()
+	ciphertext, err := encrypt(suite, data, key, rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return ciphertext
+}
+
+// mustAEAD returns the AEAD of the suite under the key and fails the test if
+// it cannot.
+func mustAEAD(t testing.TB, suite CipherSuite, key []byte) cipher.AEAD {
+	t.Helper()
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return aead
+}
+
+// mustKeySchedule returns the keys for the header and master key and fails
+// the test if they cannot be derived.
+func mustKeySchedule(t testing.TB, h *storeHeader,
+	masterKey []byte) *keySchedule {
+	t.Helper()
+	k, err := newKeySchedule(h, masterKey)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return k
+}
+
 // TestCrypto smoke tests the crypto helper functions
 func TestCrypto(t *testing.T) {
 	plaintext := []byte("Hello, World!")
-	password := "test_password"
-	ciphertext := encrypt(plaintext, password, rand.Reader)
-	decrypted, err := decrypt(ciphertext, password)
+	key := legacyKey([]byte("test_password"))
+	ciphertext := mustEncrypt(t, XChaCha20Poly1305, plaintext, key)
+	decrypted, err := decrypt(XChaCha20Poly1305, ciphertext, key)
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -35,7 +73,8 @@ func TestShortData(t *testing.T) {
 	// Anything under 24 should cause an error.
 	ciphertext := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 		0, 0, 0, 0, 0, 0, 0, 0}
-	_, err := decrypt(ciphertext, "dummypassword")
+	key := legacyKey([]byte("dummypassword"))
+	_, err := decrypt(XChaCha20Poly1305, ciphertext, key)
 	if err == nil {
 		t.Errorf("Expected error on short decryption")
 	}
@@ -46,7 +85,7 @@ func TestShortData(t *testing.T) {
 
 	// Empty string shouldn't panic should cause an error.
 	ciphertext = []byte{}
-	_, err = decrypt(ciphertext, "dummypassword")
+	_, err = decrypt(XChaCha20Poly1305, ciphertext, key)
 	if err == nil {
 		t.Errorf("Expected error on short decryption")
 	}
@@ -55,3 +94,141 @@ func TestShortData(t *testing.T) {
 		t.Errorf("Unexpected error: %+v", err)
 	}
 }
+
+// TestDeriveKey checks that Argon2id key derivation depends on the password
+// and the salt and is deterministic otherwise.
+func TestDeriveKey(t *testing.T) {
+	params := DefaultKDFParams()
+	salt1 := make([]byte, saltSize)
+	salt2 := make([]byte, saltSize)
+	salt2[0] = 1
+
+	key := deriveKey([]byte("password"), salt1, params)
+	if len(key) != keySize {
+		t.Errorf("Unexpected key size: %d", len(key))
+	}
+	if !bytes.Equal(key, deriveKey([]byte("password"), salt1, params)) {
+		t.Errorf("Key derivation is not deterministic")
+	}
+	if bytes.Equal(key, deriveKey([]byte("password"), salt2, params)) {
+		t.Errorf("Key does not depend on the salt")
+	}
+	if bytes.Equal(key, deriveKey([]byte("Password"), salt1, params)) {
+		t.Errorf("Key does not depend on the password")
+	}
+	if bytes.Equal(key, legacyKey([]byte("password"))) {
+		t.Errorf("Derived key matches the legacy key")
+	}
+}
+
+// TestKDFParams_validate checks that unusable Argon2id parameters are
+// rejected.
+func TestKDFParams_validate(t *testing.T) {
+	if err := DefaultKDFParams().validate(); err != nil {
+		t.Errorf("Default parameters are invalid: %+v", err)
+	}
+
+	bad := []KDFParams{
+		{Time: 0, Memory: 64, Threads: 1},
+		{Time: 1, Memory: 64, Threads: 0},
+		{Time: 1, Memory: 31, Threads: 4},
+	}
+	for i, params := range bad {
+		if params.validate() == nil {
+			t.Errorf("Invalid parameters %d accepted: %+v", i, params)
+		}
+	}
+}
+
+// TestSealValue checks that values are bound to their filename and store and
+// that unbound values are only accepted by version:1 stores.
+func TestSealValue(t *testing.T) {
+	key := legacyKey([]byte("test_password"))
+	aead := mustAEAD(t, XChaCha20Poly1305, key)
+	h := &storeHeader{StoreID: make([]byte, storeIDSize)}
+	other := &storeHeader{StoreID: bytes.Repeat([]byte{1}, storeIDSize)}
+
+	sealed, err := sealValue(h, aead, "name", []byte("value"), rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if sealed[0] != boundValueTag {
+		t.Errorf("Value is not tagged as bound: %x", sealed[0])
+	}
+	plaintext, err := openValue(h, aead, "name", sealed)
+	if err != nil || !bytes.Equal(plaintext, []byte("value")) {
+		t.Errorf("Could not open bound value: %q, %+v", plaintext, err)
+	}
+	if _, err = openValue(h, aead, "other", sealed); err == nil {
+		t.Errorf("Value opened under another filename")
+	}
+	if _, err = openValue(other, aead, "name", sealed); err == nil {
+		t.Errorf("Value opened in another store")
+	}
+
+	unbound := mustEncrypt(t, XChaCha20Poly1305, []byte("value"), key)
+	if _, err = openValue(h, aead, "name", unbound); err == nil {
+		t.Errorf("Store accepted an unbound value")
+	}
+
+	legacy, err := sealValue(nil, aead, "name", []byte("value"), rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	plaintext, err = openValue(nil, aead, "name", unbound)
+	if err != nil || !bytes.Equal(plaintext, []byte("value")) {
+		t.Errorf("Could not open unbound value: %q, %+v", plaintext, err)
+	}
+	plaintext, err = openValue(nil, aead, "name", legacy)
+	if err != nil || !bytes.Equal(plaintext, []byte("value")) {
+		t.Errorf("Could not open version:1 value: %q, %+v", plaintext, err)
+	}
+}
+
+// TestSealValue_TooLarge checks that values beyond the largest record are
+// refused before they reach the AEAD.
+func TestSealValue_TooLarge(t *testing.T) {
+	defer func(limit uint64) { maxRecordSize = limit }(maxRecordSize)
+	maxRecordSize = 1024
+
+	aead := mustAEAD(t, AES256GCMSIV, make([]byte, keySize))
+	_, err := sealValue(nil, aead, "name", make([]byte, 2048), rand.Reader)
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Unexpected error for an oversized value: %+v", err)
+	}
+}
+
+// TestKeySchedule checks that stores with a name salt use separate subkeys and
+// that the salt changes every filename.
+func TestKeySchedule(t *testing.T) {
+	masterKey := legacyKey([]byte("test_password"))
+
+	legacy := mustKeySchedule(t, nil, masterKey)
+	if legacy.name("key") != encodeKey(hashStringWithKey("key", masterKey)) ||
+		!bytes.Equal(legacy.contentKey, masterKey) {
+		t.Errorf("Legacy schedule does not use the master key")
+	}
+
+	h1 := &storeHeader{NameSalt: make([]byte, saltSize)}
+	h2 := &storeHeader{NameSalt: bytes.Repeat([]byte{1}, saltSize)}
+	k1 := mustKeySchedule(t, h1, masterKey)
+	k2 := mustKeySchedule(t, h2, masterKey)
+	if bytes.Equal(k1.nameKey, k1.contentKey) ||
+		bytes.Equal(k1.contentKey, masterKey) {
+		t.Errorf("Subkeys are not separated")
+	}
+	if k1.name("key") == k2.name("key") {
+		t.Errorf("Name salt does not change the filename")
+	}
+	if k1.name("key") == k1.name("other") {
+		t.Errorf("Different keys have the same filename")
+	}
+
+	k1.wipe()
+	if k1.keys.bytes() != nil || k1.contentKey != nil || k1.content != nil {
+		t.Errorf("Keys were not wiped")
+	}
+	if bytes.Equal(masterKey, make([]byte, keySize)) {
+		t.Errorf("Wiping the keys wiped the master key")
+	}
+}
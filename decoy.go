@@ -0,0 +1,385 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// decoy.go hides the number of keys in a store behind decoy files. Decoys
+// have random names and random contents sealed like real values, so they
+// cannot be told apart from them without the store key. A new decoy is
+// written once, like a new value, and its length is drawn at random around
+// the length of the value that caused it to be added and then padded, so the
+// decoys of a store spread over its padding size classes.
+//
+// Stores created with a decoy policy keep the number of values plus decoys at
+// a multiple of the policy's step. When a new key is written, a decoy is
+// removed to make room for it, or step-1 decoys are added once there are none
+// left. When a key is deleted, its files are overwritten with random data and
+// it becomes a decoy, and step decoys are removed once there are that many.
+// The file count therefore only ever moves in whole steps.
+//
+// The names of the decoys are kept in the .ekv.decoys file, which is
+// encrypted and padded to a fixed size. The number of real values is counted
+// from the directory when the store is opened.
+//
+// Decoy files are only ever created or removed by reconcileDecoys, which
+// takes the lock of each decoy's name like any other write. It never holds
+// the decoy set's mutex while waiting on such a lock, and it is serialized by
+// its own mutex, so it can be called by any operation once it has released
+// its own key locks.
+//
+// Decoys are only available to stores created with the current key schedule,
+// so they never need to be carried over by a rekey.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+const (
+	decoyFilename = ekvFilename + ".decoys"
+	// maxDecoyStep bounds the step of a decoy policy.
+	maxDecoyStep = 4096
+)
+
+// DecoyPolicy controls the decoy files added to a store to hide the number of
+// keys it holds.
+type DecoyPolicy struct {
+	// Step is the granularity of the number of values shown by the store.
+	// Zero disables decoys.
+	Step uint32 `json:"step"`
+}
+
+// validate returns an error if the policy cannot be used.
+func (p DecoyPolicy) validate() error {
+	if p.Step > maxDecoyStep {
+		return errors.Errorf("invalid decoy step: %d", p.Step)
+	}
+	return nil
+}
+
+// decoySet tracks the decoy files of a store.
+type decoySet struct {
+	step int
+
+	// mux guards real and names
+	mux sync.RWMutex
+	// real is the number of values that are not decoys
+	real int
+	// names holds the filenames of the decoys
+	names map[string]struct{}
+
+	// reconcileMux serializes reconcileDecoys
+	reconcileMux sync.Mutex
+}
+
+// decoyRecord is the contents of the .ekv.decoys file.
+type decoyRecord struct {
+	Decoys []string `json:"decoys"`
+}
+
+// contains returns true if the name is a decoy.
+func (d *decoySet) contains(name string) bool {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	_, ok := d.names[name]
+	return ok
+}
+
+// claim removes the name from the decoys so that a new value can be written
+// to it and counts the new value. It returns true if the name was a decoy.
+// The caller must hold the write lock of the name.
+func (d *decoySet) claim(name string) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.real++
+	_, ok := d.names[name]
+	delete(d.names, name)
+	return ok
+}
+
+// release undoes a claim after the value could not be written.
+func (d *decoySet) release(name string, wasDecoy bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.real--
+	if wasDecoy {
+		d.names[name] = struct{}{}
+	}
+}
+
+// retire turns the name of a deleted value into a decoy. The caller must hold
+// the write lock of the name and have overwritten its files.
+func (d *decoySet) retire(name string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	d.real--
+	d.names[name] = struct{}{}
+}
+
+// shortfall returns how many decoys must be added, or removed if negative, to
+// bring the number of files to the next multiple of the step.
+func (d *decoySet) shortfall() int {
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	target := (d.real + d.step - 1) / d.step * d.step
+	return target - d.real - len(d.names)
+}
+
+// pick returns up to n decoy names.
+func (d *decoySet) pick(n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	d.mux.RLock()
+	defer d.mux.RUnlock()
+	names := make([]string, 0, n)
+	for name := range d.names {
+		if len(names) == n {
+			break
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// recordSize returns the block size the decoy list is padded to, which fits
+// every list kept once the set is reconciled.
+func (d *decoySet) recordSize() uint32 {
+	nameSize := len(encodeKey(make([]byte, keySize)))
+	return uint32(len(`{"decoys":[]}`) + (d.step+1)*(nameSize+3))
+}
+
+// isDecoy returns true if the name is a decoy of the store.
+func (f *Filestore) isDecoy(name string) bool {
+	return f.decoys != nil && f.decoys.contains(name)
+}
+
+// claimDecoy prepares the name for a value about to be written to it and
+// returns a function that undoes this if the write fails. It reports whether
+// the write adds a value. The caller must hold the write lock of the name.
+func (f *Filestore) claimDecoy(name string) (added bool, undo func()) {
+	undo = func() {}
+	if f.decoys == nil {
+		return false, undo
+	}
+	if !f.isDecoy(name) && f.hasValue(name) {
+		return false, undo
+	}
+	wasDecoy := f.decoys.claim(name)
+	return true, func() { f.decoys.release(name, wasDecoy) }
+}
+
+// hasValue returns true if either file of the name exists.
+func (f *Filestore) hasValue(name string) bool {
+	path1, path2 := getPaths(f.getPath(name))
+	for _, path := range []string{path1, path2} {
+		if _, err := f.storage.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// retireValue overwrites both copies of the value with random data of the
+// same size and turns its name into a decoy. The caller must hold the write
+// lock of the name, which must hold a value.
+func (f *Filestore) retireValue(name string, size int) error {
+	if err := f.overwriteDecoy(f.getPath(name), size); err != nil {
+		return err
+	}
+	f.decoys.retire(name)
+	return nil
+}
+
+// overwriteDecoy writes random contents that look like a value of the given
+// ciphertext size to both files of the path, which held a value. It looks
+// like two updates of the value.
+func (f *Filestore) overwriteDecoy(path string, size int) error {
+	for i := 0; i < 2; i++ {
+		contents := make([]byte, size)
+		if _, err := io.ReadFull(f.csprng, contents); err != nil {
+			return errors.Wrap(err, "could not generate decoy")
+		}
+		contents[0] = valueTag(f.header)
+		if err := write(path, contents, f.storage); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// sealDecoy returns the contents of a new decoy of the name: a random value
+// sealed like any other, whose length is drawn uniformly below twice the
+// length given before it is padded.
+func (f *Filestore) sealDecoy(name string, length int) ([]byte, error) {
+	var n [8]byte
+	if _, err := io.ReadFull(f.csprng, n[:]); err != nil {
+		return nil, errors.Wrap(err, "could not generate decoy size")
+	}
+	data := make([]byte, binary.LittleEndian.Uint64(n[:])%uint64(2*length+1))
+	if _, err := io.ReadFull(f.csprng, data); err != nil {
+		return nil, errors.Wrap(err, "could not generate decoy")
+	}
+	return sealValue(f.header, f.keys.content, name, data, f.csprng)
+}
+
+// reconcileDecoys adds or removes decoys until the number of files is at a
+// multiple of the step and saves the decoy list. The size of the ciphertext
+// that was just written is the hint for the sizes of new decoys, each of
+// which is drawn on its own. Callers must not hold any key locks.
+func (f *Filestore) reconcileDecoys(size int) error {
+	if f.decoys == nil {
+		return nil
+	}
+	d := f.decoys
+	d.reconcileMux.Lock()
+	defer d.reconcileMux.Unlock()
+
+	n := d.shortfall()
+	length := 0
+	if n > 0 && size > 0 {
+		// The length of the value that was just written, without the
+		// overhead of an empty value
+		empty, err := sealValue(f.header, f.keys.content, "", nil, f.csprng)
+		if err != nil {
+			return err
+		}
+		length = max(size-len(empty), 0)
+	}
+	for i := 0; i < n && size > 0; i++ {
+		id := make([]byte, keySize)
+		if _, err := io.ReadFull(f.csprng, id); err != nil {
+			return errors.Wrap(err, "could not generate decoy name")
+		}
+		name := encodeKey(id)
+		contents, err := f.sealDecoy(name, length)
+		if err != nil {
+			return err
+		}
+		unlock := f.takeWriteLock(f.getPath(name))
+		err = write(f.getPath(name), contents, f.storage)
+		if err == nil {
+			d.mux.Lock()
+			d.names[name] = struct{}{}
+			d.mux.Unlock()
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range d.pick(-n) {
+		path := f.getPath(name)
+		unlock := f.takeWriteLock(path)
+		// The name may have been claimed by a new value in the meantime
+		d.mux.Lock()
+		_, ok := d.names[name]
+		delete(d.names, name)
+		d.mux.Unlock()
+		var err error
+		if ok {
+			err = deleteFiles(path, f.csprng, f.storage)
+		}
+		unlock()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return f.saveDecoys()
+}
+
+// saveDecoys writes the decoy list, padded to a fixed size. The caller must
+// hold reconcileMux.
+func (f *Filestore) saveDecoys() error {
+	d := f.decoys
+	d.mux.RLock()
+	record := decoyRecord{Decoys: make([]string, 0, len(d.names))}
+	for name := range d.names {
+		record.Decoys = append(record.Decoys, name)
+	}
+	d.mux.RUnlock()
+
+	contents, err := json.Marshal(record)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	padding := Padding{Scheme: BlockPadding, BlockSize: d.recordSize()}
+	contents, err = sealValue(f.header, f.keys.content, decoyFilename,
+		padding.pad(contents), f.csprng)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(
+		write(f.getPath(decoyFilename), contents, f.storage))
+}
+
+// loadDecoys reads the decoy list of a store with a decoy policy and counts
+// the values in its directory.
+func (f *Filestore) loadDecoys() error {
+	if f.header == nil || f.header.Decoys == nil {
+		return nil
+	}
+	d := &decoySet{
+		step:  int(f.header.Decoys.Step),
+		names: make(map[string]struct{}),
+	}
+
+	contents, err := read(f.getPath(decoyFilename), f.storage)
+	if err != nil && Exists(err) {
+		return errors.WithStack(err)
+	} else if err == nil {
+		padded, err := openValue(f.header, f.keys.content, decoyFilename,
+			contents)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		unpadded, err := unpad(padded)
+		if err != nil {
+			return err
+		}
+		record := decoyRecord{}
+		if err = json.Unmarshal(unpadded, &record); err != nil {
+			return errors.Wrap(err, "invalid decoy list")
+		}
+		for _, name := range record.Decoys {
+			d.names[name] = struct{}{}
+		}
+	}
+
+	names, err := portable.ReadDir(f.storage, f.basedir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stems := make(map[string]struct{})
+	for _, name := range names {
+		stem, ok := splitPath(name)
+		if !ok || isInternal(stem) {
+			continue
+		}
+		if _, ok = d.names[stem]; !ok {
+			stems[stem] = struct{}{}
+		}
+	}
+	d.real = len(stems)
+
+	f.decoys = d
+	return nil
+}
+
+// notFound returns the error reported for a name that holds no value.
+func notFound(path string) error {
+	return errors.WithStack(
+		&os.PathError{Op: "open", Path: path, Err: os.ErrNotExist})
+}
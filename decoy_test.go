@@ -0,0 +1,141 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"crypto/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// TestFilestore_Decoys checks that the number of values in the directory
+// only moves in whole steps as keys are added and removed.
+func TestFilestore_Decoys(t *testing.T) {
+	const step = 4
+	kv := newMemoryKV()
+	storage := portable.UseKeyValue(kv)
+	opts := testOptions()
+	opts.Decoys = DecoyPolicy{Step: step}
+	f, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+		rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	values := make(map[string]string)
+	checkStems := func(real int) {
+		t.Helper()
+		stems := countStems(t, kv)
+		if stems%step != 0 || stems < real || stems-real >= step {
+			t.Errorf("%d files shown for %d values", stems, real)
+		}
+		checkValues(t, f, values)
+	}
+
+	for i := 0; i < 6; i++ {
+		k := strconv.Itoa(i)
+		values[k] = k
+		if err = f.SetBytes(k, []byte(k)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		checkStems(len(values))
+	}
+
+	// Overwriting a value does not change anything
+	if err = f.SetBytes("0", []byte("0")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkStems(len(values))
+
+	for _, k := range []string{"1", "2", "3"} {
+		delete(values, k)
+		if err = f.Delete(k); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err = f.GetBytes(k); Exists(err) {
+			t.Errorf("Deleted key %s was found: %v", k, err)
+		}
+		checkStems(len(values))
+	}
+
+	// Decoys are kept when the store is reopened with other options
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.decoys == nil || f.decoys.real != len(values) {
+		t.Fatalf("Decoys were not loaded: %+v", f.decoys)
+	}
+	checkStems(len(values))
+
+	err = f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["0"].Delete()
+		files["7"].Set([]byte("7"))
+		files["8"].Set([]byte("8"))
+		return nil
+	}, "0", "7", "8")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	delete(values, "0")
+	values["7"], values["8"] = "7", "8"
+	checkStems(len(values))
+}
+
+// TestFilestore_Decoys_Footprint checks that new decoys leave the same
+// files on disk as a new value: a single file with the same record header,
+// padded to a size class of the store, and that their sizes are drawn
+// independently.
+func TestFilestore_Decoys_Footprint(t *testing.T) {
+	const block = 16
+	kv := newMemoryKV()
+	opts := testOptions()
+	opts.Decoys = DecoyPolicy{Step: 8}
+	opts.Padding = Padding{Scheme: BlockPadding, BlockSize: block}
+	f := newTestStore(t, portable.UseKeyValue(kv), opts,
+		map[string]string{"a": strings.Repeat("value", 40)})
+
+	files := snapshotValues(t, kv)
+	if stems := countStems(t, kv); stems != 8 || len(files) != 8 {
+		t.Fatalf("Expected 8 values in 8 files, found %d in %d", stems,
+			len(files))
+	}
+	value := files[f.getKey("a")+".1"]
+	sizes := make(map[int]struct{})
+	for name, contents := range files {
+		if !strings.HasSuffix(name, ".1") {
+			t.Errorf("File %s is not the first copy", name)
+		}
+		if contents[0] != value[0] {
+			t.Errorf("File %s starts with %x, expected %x", name,
+				contents[0], value[0])
+		}
+		if (len(contents)-len(value))%block != 0 {
+			t.Errorf("File %s has size %d, which is not padded like %d",
+				name, len(contents), len(value))
+		}
+		sizes[len(contents)] = struct{}{}
+	}
+	if len(sizes) < 2 {
+		t.Errorf("Every decoy has the size of the value: %v", sizes)
+	}
+}
+
+// countStems returns the number of values, real or decoy, in the store.
+func countStems(t *testing.T, kv *memoryKV) int {
+	t.Helper()
+	stems := make(map[string]struct{})
+	for name := range snapshotValues(t, kv) {
+		stem, _ := splitPath(name)
+		stems[stem] = struct{}{}
+	}
+	return len(stems)
+}
@@ -0,0 +1,50 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// errors.go holds the errors returned by Filestore and Memstore for the most
+// common failures, which can be told apart with errors.Is. Errors for more
+// specific failures are kept with the code returning them, such as
+// ErrRollback, ErrNewerFormat, ErrValueTooLarge, ErrKeyTooLong and
+// ErrIndexLost.
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+var (
+	// ErrNotFound is returned when a key does not exist. It is
+	// portable.ErrNotFound, which is also fs.ErrNotExist.
+	ErrNotFound = portable.ErrNotFound
+
+	// ErrWrongPassword is returned when a store cannot be opened with the
+	// password or private key it was given.
+	ErrWrongPassword = errors.New(errBadSecret)
+
+	// ErrCorrupt is returned when a file of the store is damaged, whether
+	// both copies of it fail their checksum or its value fails to decrypt.
+	ErrCorrupt = errors.New("file is corrupt")
+
+	// ErrClosed is returned by every operation on a store that was closed.
+	ErrClosed = errors.New("store is closed")
+
+	// ErrReadOnly is returned when the storage of a store cannot be
+	// written to. It is portable.ErrReadOnly.
+	ErrReadOnly = portable.ErrReadOnly
+)
+
+// corrupt returns ErrCorrupt with the error as its cause.
+func corrupt(err error) error {
+	if err == nil || errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	return errors.WithStack(fmt.Errorf("%w: %w", ErrCorrupt, err))
+}
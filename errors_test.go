@@ -0,0 +1,274 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// readOnlyKV reports missing keys with an error that wraps
+// portable.ErrNotFound, and refuses writes once it is read-only.
+type readOnlyKV struct {
+	*memoryKV
+	readOnly bool
+}
+
+func (l *readOnlyKV) Get(key string) ([]byte, error) {
+	data, err := l.memoryKV.Get(key)
+	if err != nil {
+		return nil, errors.Wrapf(portable.ErrNotFound, "key %s", key)
+	}
+	return data, nil
+}
+
+// messageKV reports missing keys with an error that only says so in its
+// message.
+type messageKV struct {
+	*memoryKV
+}
+
+func (m messageKV) Get(key string) ([]byte, error) {
+	data, err := m.memoryKV.Get(key)
+	if err != nil {
+		return nil, errors.Errorf("key %s not found", key)
+	}
+	return data, nil
+}
+
+func (l *readOnlyKV) Set(key string, value []byte) error {
+	if l.readOnly {
+		return errors.Wrap(portable.ErrReadOnly, key)
+	}
+	return l.memoryKV.Set(key, value)
+}
+
+// TestErrors_NotFound checks that missing keys are reported as ErrNotFound by
+// every store.
+func TestErrors_NotFound(t *testing.T) {
+	f, err := openTestStore(portable.UseKeyValue(&readOnlyKV{memoryKV: newMemoryKV()}), "dir",
+		"password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, kv := range []KeyValue{f, MakeMemstore()} {
+		_, err = kv.GetBytes("missing")
+		if !errors.Is(err, ErrNotFound) || Exists(err) {
+			t.Errorf("Unexpected error for a missing key: %+v", err)
+		}
+	}
+	if Exists(nil) != true || Exists(errors.New("other")) != true {
+		t.Errorf("Errors that are not ErrNotFound reported as missing keys")
+	}
+
+	// Errors that only say so in their message are still recognised
+	storage := portable.UseKeyValue(messageKV{newMemoryKV()})
+	if _, err = storage.Open("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Missing key reported by its message not recognised: %+v",
+			err)
+	}
+}
+
+// TestErrors_WrongPassword opens a store with the wrong password.
+func TestErrors_WrongPassword(t *testing.T) {
+	kv := newMemoryKV()
+	if _, err := openTestStore(portable.UseKeyValue(kv), "dir", "password"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	_, err := openTestStore(portable.UseKeyValue(kv), "dir", "wrong")
+	if !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("Unexpected error for a wrong password: %+v", err)
+	}
+}
+
+// TestErrors_Corrupt damages the files of values and checks that reading
+// them returns ErrCorrupt.
+func TestErrors_Corrupt(t *testing.T) {
+	kv := newMemoryKV()
+	f, err := openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		for i := 0; i < 2; i++ {
+			if err = f.SetBytes(key, []byte(key)); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+
+	// Both copies fail their checksum
+	for _, suffix := range []string{".1", ".2"} {
+		data := kv.data[f.getKey("a")+suffix]
+		data[len(data)/2] ^= 1
+	}
+	if _, err = f.GetBytes("a"); !errors.Is(err, ErrCorrupt) || !Exists(err) {
+		t.Errorf("Unexpected error for a damaged file: %+v", err)
+	}
+
+	// Both copies hold the value of another key
+	for _, suffix := range []string{".1", ".2"} {
+		kv.data[f.getKey("b")+suffix] = kv.data[f.getKey("c")+suffix]
+	}
+	if _, err = f.GetBytes("b"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Unexpected error for a swapped value: %+v", err)
+	}
+	checkValues(t, f, map[string]string{"c": "c"})
+}
+
+// TestErrors_Closed checks that a closed store returns ErrClosed.
+func TestErrors_Closed(t *testing.T) {
+	f, err := openTestStore(portable.UseKeyValue(newMemoryKV()), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.Close()
+	if _, err = f.GetBytes("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Unexpected error for a read: %+v", err)
+	}
+	if err = f.SetBytes("a", []byte("a")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Unexpected error for a write: %+v", err)
+	}
+	err = f.Transaction(func(map[string]Operable, Extender) error {
+		t.Errorf("Transaction ran on a closed store")
+		return nil
+	}, "a")
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Unexpected error for a transaction: %+v", err)
+	}
+}
+
+// TestErrors_ReadOnly checks that writes refused by the storage are reported
+// as ErrReadOnly.
+func TestErrors_ReadOnly(t *testing.T) {
+	kv := &readOnlyKV{memoryKV: newMemoryKV()}
+	f, err := openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	kv.readOnly = true
+	if err = f.SetBytes("a", []byte("a")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Unexpected error for a read-only store: %+v", err)
+	}
+}
+
+// testTransactionMisuse uses operables and an extender after they were closed
+// and checks that it fails the transaction with ErrClosed instead of
+// panicking.
+func testTransactionMisuse(t *testing.T, kv KeyValue) {
+	if err := kv.SetBytes("a", []byte("old")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	err := kv.Transaction(func(files map[string]Operable, _ Extender) error {
+		if err := files["a"].Flush(); err != nil {
+			return err
+		}
+		if err := files["a"].Flush(); !errors.Is(err, ErrClosed) {
+			t.Errorf("Unexpected error for a second flush: %+v", err)
+		}
+		files["a"].Set([]byte("new"))
+		files["b"].Set([]byte("new"))
+		return nil
+	}, "a", "b")
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Unexpected error for a closed operable: %+v", err)
+	}
+	if data, err := kv.GetBytes("a"); err != nil || string(data) != "old" {
+		t.Errorf("Write to a closed operable landed: %q, %+v", data, err)
+	}
+	if ok, err := kv.Has("b"); err != nil || ok {
+		t.Errorf("Write of a failed transaction landed: %t, %+v", ok, err)
+	}
+
+	// Operables and extenders outlive their transaction
+	var file Operable
+	var ext Extender
+	err = kv.Transaction(func(files map[string]Operable, e Extender) error {
+		file, ext = files["a"], e
+		return nil
+	}, "a")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	file.Set([]byte("new"))
+	if data, ok := file.Get(); ok || data != nil {
+		t.Errorf("Read a closed operable: %q", data)
+	}
+	if _, err = ext.Extend([]string{"b"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Unexpected error for a closed extender: %+v", err)
+	}
+	if data, err := kv.GetBytes("a"); err != nil || string(data) != "old" {
+		t.Errorf("Write to a closed operable landed: %q, %+v", data, err)
+	}
+}
+
+// TestErrors_TransactionMisuse checks that every store reports the use of
+// closed operables as ErrClosed.
+func TestErrors_TransactionMisuse(t *testing.T) {
+	f, err := openTestStore(portable.UseKeyValue(newMemoryKV()), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testTransactionMisuse(t, f)
+	testTransactionMisuse(t, MakeMemstore())
+}
+
+// errReader is a source of randomness that always fails.
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("injected randomness failure")
+}
+
+// TestErrors_Randomness checks that a failing source of randomness is
+// returned as an error by writes and leaves the values as they were.
+func TestErrors_Randomness(t *testing.T) {
+	key := make([]byte, keySize)
+	if _, err := encrypt(XChaCha20Poly1305, []byte("a"), key,
+		errReader{}); err == nil {
+		t.Errorf("Encrypted without randomness")
+	}
+	_, err := NewGenericFilestoreWithOptions(
+		portable.UseKeyValue(newMemoryKV()), "new", "password", errReader{},
+		testOptions())
+	if err == nil {
+		t.Errorf("Store created without randomness")
+	}
+
+	f, err := openTestStore(portable.UseKeyValue(newMemoryKV()), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("a", []byte("old")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f.SetNonceGenerator(errReader{})
+	if err = f.SetBytes("a", []byte("new")); err == nil {
+		t.Errorf("Value written without randomness")
+	}
+	err = f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Set([]byte("new"))
+		files["b"].Set([]byte("new"))
+		return nil
+	}, "a", "b")
+	if err == nil {
+		t.Errorf("Transaction committed without randomness")
+	}
+
+	f.SetNonceGenerator(rand.Reader)
+	checkValues(t, f, map[string]string{"a": "old"})
+	if ok, err := f.Has("b"); err != nil || ok {
+		t.Errorf("Write of a failed transaction landed: %t, %+v", ok, err)
+	}
+	if err = f.SetBytes("b", []byte("new")); err != nil {
+		t.Errorf("%+v", err)
+	}
+}
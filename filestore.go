@@ -8,11 +8,10 @@
 package ekv
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/json"
 	"io"
-	"os"
+	"sort"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -27,14 +26,77 @@ const (
 // Filestore implements an ekv by reading and writing to files in a
 // directory.
 type Filestore struct {
-	basedir  string
-	password string
+	basedir string
+	key     *lockedBuffer // master key
+	keys    *keySchedule  // keys derived from the master key
+	header  *storeHeader  // nil for version:1 stores
 	sync.RWMutex
 	keyLocks map[string]*sync.RWMutex
+	// keyMux is held for reading by every operation that uses the key and
+	// held for writing while the store is being rekeyed
+	keyMux sync.RWMutex
+	// txMux is held for reading by every transaction and taken for writing
+	// before keyMux, so that the key is not changed while the operation of a
+	// transaction runs without keyMux
+	txMux    sync.RWMutex
+	decoys   *decoySet // nil for stores without decoys
+	manifest *manifest // nil for stores without a manifest
+	index    *keyIndex // nil for stores without a key index
+	journals *journalSlots
 	csprng   io.Reader
 	storage  portable.Storage
 }
 
+// Options holds the settings used when a Filestore is first created. They have
+// no effect when opening an existing store, which always uses the settings
+// recorded in its header.
+type Options struct {
+	// KDF are the Argon2id parameters used to derive the store key from the
+	// password.
+	KDF KDFParams
+	// Padding is how values are padded to hide their exact length. No
+	// padding is used by default.
+	Padding Padding
+	// Decoys is how many decoy files are kept to hide the number of keys.
+	// No decoys are used by default.
+	Decoys DecoyPolicy
+	// Cipher is the cipher suite used to encrypt the store. Stores use
+	// XChaCha20Poly1305 when it is nil.
+	Cipher CipherSuite
+	// Committing prepends a commitment to the key to every ciphertext, so
+	// that no ciphertext can be decrypted under more than one key.
+	Committing bool
+	// Manifest keeps an authenticated manifest of the version of every
+	// value, so that values or stores rolled back to an older state are
+	// reported with ErrRollback.
+	Manifest bool
+	// Compression is how values are compressed before they are encrypted.
+	// No compression is used by default.
+	Compression Compression
+	// Index keeps an encrypted index of the keys of the store, so that they
+	// can be listed with [Filestore.Keys]. It cannot be used along with
+	// decoys.
+	Index bool
+	// EncryptedNames names every value with a deterministic encryption of
+	// its key instead of a MAC, so that the keys can be listed from the
+	// filenames without an index. The filenames reveal the length of the
+	// keys, rounded up to 16 bytes, and keys too long to fit in a filename
+	// are refused with ErrKeyTooLong. It cannot be used along with decoys.
+	EncryptedNames bool
+	// Metadata is recorded in the protected header of the store, such as
+	// the name of the application and the version of its schema. See
+	// [Filestore.Metadata].
+	Metadata map[string]string
+}
+
+// DefaultOptions returns the Options used by the constructors that do not
+// take any.
+func DefaultOptions() Options {
+	return Options{
+		KDF: DefaultKDFParams(),
+	}
+}
+
 // NewFilestore returns an initialized filestore object or an error
 // if it can't read and write to the directory/.ekv.1/2 file. Note that
 // this file is not used other than to verify read/write capabilities on the
@@ -74,63 +136,177 @@ func NewGenericFilestore(storage portable.Storage, basedir, password string) (*F
 // backed by a generic Storage interface with a custom RNG for Nonce generation.
 func NewGenericFilestoreWithNonceGenerator(storage portable.Storage, basedir, password string,
 	csprng io.Reader) (*Filestore, error) {
+	return NewGenericFilestoreWithOptions(storage, basedir, password, csprng,
+		DefaultOptions())
+}
+
+// NewGenericFilestoreWithOptions returns an initialized filestore backed by a
+// generic Storage interface with a custom RNG. The options are only used if
+// the store does not exist yet.
+//
+// The password may be the secret of any of the store's key slots. Existing
+// version:1 stores, which derive their key from an unsalted hash of the
+// password, are opened as they are and can be moved to a master key in a key
+// slot with [Filestore.UpgradeKDF].
+func NewGenericFilestoreWithOptions(storage portable.Storage, basedir, password string,
+	csprng io.Reader, opts Options) (*Filestore, error) {
+	secret := []byte(password)
+	defer zero(secret)
+	return NewGenericFilestoreWithSecret(storage, basedir, secret, csprng,
+		opts)
+}
+
+// NewGenericFilestoreWithSecret is [NewGenericFilestoreWithOptions] with the
+// password given as a byte slice, so that it never has to be held in an
+// immutable string. The store does not keep or modify the password, which the
+// caller may zero as soon as this returns.
+func NewGenericFilestoreWithSecret(storage portable.Storage, basedir string,
+	password []byte, csprng io.Reader, opts Options) (*Filestore, error) {
+	return openFilestore(storage, basedir, credential{password: password},
+		csprng, opts)
+}
+
+// NewFilestoreWithIdentity opens an existing filestore backed by a generic
+// Storage interface using the X25519 private key of one of its recipients
+// instead of a password. See [Filestore.AddRecipient]. The store does not keep
+// or modify the private key, which the caller may zero as soon as this
+// returns.
+func NewFilestoreWithIdentity(storage portable.Storage, basedir string,
+	privateKey []byte) (*Filestore, error) {
+	return openFilestore(storage, basedir, credential{privateKey: privateKey},
+		rand.Reader, DefaultOptions())
+}
+
+// openFilestore opens the store in basedir with the credential, creating it
+// with the options if it does not exist.
+func openFilestore(storage portable.Storage, basedir string, cred credential,
+	csprng io.Reader, opts Options) (*Filestore, error) {
 	// Create the directory if it doesn't exist, otherwise do nothing.
 	err := storage.MkdirAll(basedir, 0700)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	// Get the path to the "ekv" file
-	ekvPath := basedir + string(os.PathSeparator) + ".ekv"
-	expectedContents := []byte("version:1")
+	fs := &Filestore{
+		basedir:  basedir,
+		keyLocks: make(map[string]*sync.RWMutex),
+		journals: newJournalSlots(),
+		csprng:   csprng,
+		storage:  storage,
+	}
 
-	// Try to read the .ekv.1/2 file, if it exists then we check
-	// it's contents
-	ekvCiphertext, err := read(ekvPath, storage)
-	if !os.IsNotExist(err) {
-		if err != nil {
-			return nil, errors.WithStack(err)
-		} else if ekvCiphertext != nil {
-			ekvContents, err := decrypt(ekvCiphertext, password)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
+	// Look for the journal of a password change that was interrupted
+	journal, err := fs.readJournal()
+	if err != nil {
+		return nil, err
+	}
 
-			if !bytes.Equal(ekvContents, expectedContents) {
-				return nil, errors.Errorf("Bad decryption: "+
-					"%s != %s", ekvContents,
-					expectedContents)
-			}
-		}
+	// Try to read the .ekv.1/2 file, if it exists then we unlock it with
+	// the password, otherwise a new header is made
+	ekvPath := fs.getPath(ekvFilename)
+	header, rawKey, err := loadHeader(ekvPath, cred, opts, csprng, storage)
+	var key *lockedBuffer
+	if err == nil {
+		key = lockBytes(rawKey)
+	}
+	if journal != nil {
+		header, key, err = fs.resumeRekey(journal, cred, header, key, err)
+	}
+	if err != nil {
+		key.destroy()
+		fs.destroyKeys()
+		return nil, err
+	}
+
+	if err = header.openProtected(key.bytes()); err != nil {
+		key.destroy()
+		return nil, err
 	}
 
 	// Now try to write the .ekv file which also reads and verifies what
 	// we write
-	err = write(ekvPath, encrypt(expectedContents, password, csprng), storage)
+	err = writeHeader(ekvPath, header, key.bytes(), csprng, storage)
 	if err != nil {
+		key.destroy()
 		return nil, errors.WithStack(err)
 	}
 
-	fs := &Filestore{
-		basedir:  basedir,
-		password: password,
-		keyLocks: make(map[string]*sync.RWMutex),
-		csprng:   csprng,
-		storage:  storage,
+	// A resumed rekey may already have derived the keys
+	if fs.keys != nil {
+		fs.keys.wipe()
+	}
+	fs.header = header
+	fs.key = key
+	if fs.keys, err = newKeySchedule(header, key.bytes()); err != nil {
+		fs.destroyKeys()
+		return nil, err
+	}
+	if err = fs.loadManifest(); err != nil {
+		fs.destroyKeys()
+		return nil, err
+	}
+	if err = fs.loadIndex(); err != nil {
+		fs.destroyKeys()
+		return nil, err
+	}
+	if err = fs.loadDecoys(); err != nil {
+		fs.destroyKeys()
+		return nil, err
+	}
+	if err = fs.replayTransactions(); err != nil {
+		fs.destroyKeys()
+		return nil, err
 	}
 	return fs, nil
 }
 
+// destroyKeys zeroes and releases the master key and the keys derived from it.
+func (f *Filestore) destroyKeys() {
+	f.key.destroy()
+	f.key = nil
+	if f.keys != nil {
+		f.keys.wipe()
+		f.keys = nil
+	}
+}
+
+// lockKeys takes keyMux for writing, once the transactions that are running
+// are done.
+func (f *Filestore) lockKeys() {
+	f.txMux.Lock()
+	f.keyMux.Lock()
+}
+
+// unlockKeys releases the locks taken by lockKeys.
+func (f *Filestore) unlockKeys() {
+	f.keyMux.Unlock()
+	f.txMux.Unlock()
+}
+
+// checkOpen returns ErrClosed if the store was closed. The caller must hold
+// keyMux.
+func (f *Filestore) checkOpen() error {
+	if f.keys == nil {
+		return errors.WithStack(ErrClosed)
+	}
+	return nil
+}
+
 // SetNonceGenerator sets the cryptographically secure pseudo-random
 // number generator (csprng) used during encryption to generate nonces.
 func (f *Filestore) SetNonceGenerator(csprng io.Reader) {
 	f.csprng = csprng
 }
 
-// Close is equivalent to nil'ing out the Filestore object. This function
-// is in place for the future when we add secure memory storage for keys.
+// Close zeroes and releases the keys held by the Filestore. Every operation
+// on it returns ErrClosed afterwards.
 func (f *Filestore) Close() {
-	f.password = ""
+	f.lockKeys()
+	defer f.unlockKeys()
+	f.destroyKeys()
+	f.decoys = nil
+	f.manifest = nil
+	f.index = nil
 	f.basedir = ""
 	f.keyLocks = nil
 	f.csprng = nil
@@ -152,11 +328,67 @@ func (f *Filestore) Get(key string, loadIntoThisObject Unmarshaler) error {
 
 // Delete the value for the given key per [KeyValue.Delete]
 func (f *Filestore) Delete(key string) error {
-	encryptedKey := f.getKey(key)
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+	return f.deleteValue(key, f.keys.name(key), true)
+}
+
+// deleteValue deletes the value under the filename, and then removes the key
+// from the index if the value is indexed. The caller must hold keyMux for
+// reading.
+func (f *Filestore) deleteValue(key, name string, indexed bool) error {
+	encryptedKey := f.getPath(name)
 	unlock := f.takeWriteLock(encryptedKey)
-	defer unlock()
 	jww.TRACE.Printf("%s,DELETE,%s,%s", kvDebugHeader, key, encryptedKey)
-	return deleteFiles(encryptedKey, f.csprng, f.storage)
+	reconcile, size, err := f.removeValue(name)
+	if err == nil && indexed {
+		err = f.indexRemove(key)
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+	if err = f.saveManifest(); err != nil {
+		return err
+	}
+	if reconcile {
+		return f.reconcileDecoys(size)
+	}
+	return nil
+}
+
+// removeValue deletes the value under the filename. In stores with decoys the
+// value becomes a decoy instead, and it reports that the decoys must be
+// reconciled for values of the returned size. The caller must hold the write
+// lock of the filename.
+func (f *Filestore) removeValue(name string) (bool, int, error) {
+	encryptedKey := f.getPath(name)
+	if f.decoys == nil {
+		err := deleteFiles(encryptedKey, f.csprng, f.storage)
+		if err == nil {
+			f.manifest.remove(name)
+		}
+		return false, 0, err
+	}
+
+	// The value becomes a decoy instead of being removed
+	if f.isDecoy(name) {
+		return false, 0, nil
+	}
+	encryptedContents, err := read(encryptedKey, f.storage)
+	if err == nil {
+		err = f.retireValue(name, len(encryptedContents))
+	} else if !Exists(err) {
+		err = nil
+	}
+	if err != nil {
+		return false, 0, errors.WithStack(err)
+	}
+	f.manifest.remove(name)
+	return true, len(encryptedContents), nil
 }
 
 // SetInterface uses json to encode and set data per [KeyValue.SetInterface]
@@ -179,37 +411,151 @@ func (f *Filestore) GetInterface(key string, v interface{}) error {
 
 // GetBytes implements [KeyValue.GetBytes]
 func (f *Filestore) GetBytes(key string) ([]byte, error) {
-	encryptedKey := f.getKey(key)
-	unlock := f.takeReadLock(encryptedKey)
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err := f.checkOpen(); err != nil {
+		return nil, err
+	}
+	return f.getValue(f.keys.name(key))
+}
+
+// getValue reads and decrypts the value under the filename. The caller must
+// hold keyMux for reading.
+func (f *Filestore) getValue(name string) ([]byte, error) {
+	unlock := f.takeReadLock(f.getPath(name))
+	defer unlock()
+	decryptedContents, _, err := f.loadValue(name)
+	return decryptedContents, err
+}
 
+// loadValue reads and decrypts the value under the filename and returns it
+// along with its ciphertext. Decoys are reported as not found. The caller
+// must hold the lock of the filename.
+func (f *Filestore) loadValue(name string) ([]byte, []byte, error) {
+	encryptedKey := f.getPath(name)
+	if f.isDecoy(name) {
+		return nil, nil, notFound(encryptedKey)
+	}
 	encryptedContents, err := read(encryptedKey, f.storage)
-	unlock()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
 
-	var decryptedContents []byte
+	decryptedContents, version, err := openVersionedValue(f.header,
+		f.keys.content, name, encryptedContents)
 	if err == nil {
-		decryptedContents, err = decrypt(encryptedContents, f.password)
+		err = f.manifest.check(name, version)
 	}
-	return decryptedContents, errors.WithStack(err)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return decryptedContents, encryptedContents, nil
+}
+
+// Has implements [KeyValue.Has]. It checks the checksums of the files of the
+// value without decrypting it, so a value whose ciphertext was replaced by
+// another with a valid checksum is only reported as corrupt by GetBytes.
+func (f *Filestore) Has(key string) (bool, error) {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err := f.checkOpen(); err != nil {
+		return false, err
+	}
+	name := f.keys.name(key)
+	encryptedKey := f.getPath(name)
+	unlock := f.takeReadLock(encryptedKey)
+	defer unlock()
+
+	if f.isDecoy(name) {
+		return false, nil
+	}
+	_, err := read(encryptedKey, f.storage)
+	if !Exists(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, f.manifest.checkDeleted(name)
 }
 
 // SetBytes implements [KeyValue.SetBytes]
 func (f *Filestore) SetBytes(key string, data []byte) error {
-	encryptedKey := f.getKey(key)
-	encryptedContents := encrypt(data, f.password, f.csprng)
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+	if err := f.keys.checkKey(key); err != nil {
+		return err
+	}
+	return f.setValue(key, f.keys.name(key), data, true)
+}
+
+// setValue adds the key to the index if the value is indexed, and then
+// encrypts and writes the value under the filename. The caller must hold
+// keyMux for reading.
+func (f *Filestore) setValue(key, name string, data []byte,
+	indexed bool) error {
+	encryptedKey := f.getPath(name)
 	jww.TRACE.Printf(
 		"%s,SET,%s,%s,%s", kvDebugHeader, key, encryptedKey, data)
 	unlock := f.takeWriteLock(encryptedKey)
-	defer unlock()
-
-	err := write(encryptedKey, encryptedContents, f.storage)
+	var indexAdded []string
+	if indexed {
+		var err error
+		if indexAdded, err = f.indexAdd(key); err != nil {
+			unlock()
+			return err
+		}
+	}
+	added, size, err := f.writeValue(name, data)
 	if err != nil {
-		return errors.WithStack(err)
+		// A key that had no value is not left in the index
+		if indexErr := f.indexRemove(indexAdded...); indexErr != nil {
+			jww.WARN.Printf("Could not remove %q from the index: %+v",
+				key, indexErr)
+		}
+		unlock()
+		return err
+	}
+	f.indexSettle(indexAdded...)
+	unlock()
+	if err = f.saveManifest(); err != nil {
+		return err
+	}
+	if added {
+		return f.reconcileDecoys(size)
 	}
 	return nil
 }
 
-// Transaction implements [KeyValue.Transaction]
+// writeValue encrypts and writes the value under the filename, and returns
+// whether it added a value along with the size of its ciphertext. The caller
+// must hold the write lock of the filename.
+func (f *Filestore) writeValue(name string, data []byte) (bool, int, error) {
+	version := f.manifest.next(name)
+	encryptedContents, err := sealVersionedValue(f.header, f.keys.content,
+		name, version, data, f.csprng)
+	if err != nil {
+		return false, 0, err
+	}
+	added, undo := f.claimDecoy(name)
+	err = write(f.getPath(name), encryptedContents, f.storage)
+	if err != nil {
+		undo()
+		return false, 0, errors.WithStack(err)
+	}
+	f.manifest.commit(name, version)
+	return added, len(encryptedContents), nil
+}
+
+// Transaction implements [KeyValue.Transaction]. The store key is only locked
+// while the values are read and the changes committed, so the operation may
+// use the rest of the store, and Close and rekeys wait for the transaction to
+// end.
 func (f *Filestore) Transaction(op TransactionOperation, keys ...string) error {
+	f.txMux.RLock()
+	defer f.txMux.RUnlock()
 
 	// setup and get the data
 	e := newExtendable(f)
@@ -224,16 +570,45 @@ func (f *Filestore) Transaction(op TransactionOperation, keys ...string) error {
 
 	// do the operations
 	err = op(operables, e)
+	if err == nil {
+		err = e.err
+	}
 	if err != nil {
 		return err
 	}
 
 	// flush operations
-	e.flush()
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err = f.checkOpen(); err != nil {
+		return err
+	}
+	err = e.flush()
+	e.close()
+	if err != nil {
+		return err
+	}
 
+	if err = f.saveManifest(); err != nil {
+		return err
+	}
+	if e.changed {
+		return e.f.reconcileDecoys(e.size)
+	}
 	return nil
 }
 
+// Prefix implements [KeyValue.Prefix]
+func (f *Filestore) Prefix(ns string) KeyValue {
+	return newPrefixKV(f, ns)
+}
+
+// DeletePrefix implements [KeyValue.DeletePrefix]. Like [Filestore.Keys], it
+// needs a store with an index or encrypted filenames.
+func (f *Filestore) DeletePrefix(ns string) error {
+	return deletePrefix(f, namespacePrefix(ns))
+}
+
 // Internal helper functions
 
 func (f *Filestore) takeWriteLock(encryptedKey string) (unlock func()) {
@@ -288,7 +663,10 @@ func (f *Filestore) takeReadLock(encryptedKey string) (unlock func()) {
 	return unlock
 }
 
+// takeTransactionLocks takes the write locks of the encrypted keys. They are
+// taken in sorted order, so that calls locking the same keys cannot deadlock.
 func (f *Filestore) takeTransactionLocks(encryptedKeys []string) (unlock func()) {
+	encryptedKeys = uniqueKeys(encryptedKeys)
 	locks := make([]*sync.RWMutex, 0, len(encryptedKeys))
 
 	f.Lock()
@@ -312,11 +690,46 @@ func (f *Filestore) takeTransactionLocks(encryptedKeys []string) (unlock func())
 	}
 }
 
+// takeReadLocks takes the read locks of the encrypted keys in sorted order.
+func (f *Filestore) takeReadLocks(encryptedKeys []string) (unlock func()) {
+	encryptedKeys = uniqueKeys(encryptedKeys)
+	locks := make([]*sync.RWMutex, 0, len(encryptedKeys))
+
+	f.Lock()
+
+	for _, ecrKey := range encryptedKeys {
+		lck, ok := f.keyLocks[ecrKey]
+		if !ok {
+			lck = &sync.RWMutex{}
+			f.keyLocks[ecrKey] = lck
+		}
+		lck.RLock()
+		locks = append(locks, lck)
+	}
+
+	f.Unlock()
+
+	return func() {
+		for _, lck := range locks {
+			lck.RUnlock()
+		}
+	}
+}
+
 type extendable struct {
 	closed    bool
 	unlock    func()
 	f         *Filestore
 	operables []map[string]Operable
+
+	// err is the first misuse of a closed operable, which fails the
+	// transaction
+	err error
+
+	// changed is set if the flush added or removed a value, and size is the
+	// size of the last such value
+	changed bool
+	size    int
 }
 
 func newExtendable(f *Filestore) *extendable {
@@ -329,20 +742,30 @@ func newExtendable(f *Filestore) *extendable {
 
 func (e *extendable) Extend(keys []string) (map[string]Operable, error) {
 	if e.closed {
-		jww.FATAL.Panicf("Cannot extend, transaction already closed")
+		return nil, errors.Wrap(ErrClosed, "cannot extend transaction")
+	}
+	e.f.keyMux.RLock()
+	defer e.f.keyMux.RUnlock()
+	if err := e.f.checkOpen(); err != nil {
+		return nil, err
 	}
 	operables := make(map[string]Operable, len(keys))
 	ecrKeys := make([]string, len(keys))
 
 	// make the ecrypted keys
 	for i, key := range keys {
-		ecrkey := e.f.getKey(key)
+		if err := e.f.keys.checkKey(key); err != nil {
+			return nil, err
+		}
+		name := e.f.keys.name(key)
+		ecrkey := e.f.getPath(name)
 		operables[key] = &operable{
 			key:    key,
 			closed: false,
-			ecrKey: ecrkey,
+			name:   name,
 			op:     readOp,
 			f:      e.f,
+			e:      e,
 		}
 		ecrKeys[i] = ecrkey
 	}
@@ -350,30 +773,29 @@ func (e *extendable) Extend(keys []string) (map[string]Operable, error) {
 	// get the locks
 	e.addUnlock(e.f.takeTransactionLocks(ecrKeys))
 
-	// read the keys
-	for _, oper := range operables {
-		operInternal := oper.(*operable)
-		encryptedContents, err := read(operInternal.ecrKey, e.f.storage)
-		// if an error is received which is not the file is not found, return it
-		hasfile := true
-		if err != nil {
-			if !Exists(err) {
-				hasfile = false
-			} else {
-				return nil, err
-			}
+	// read the keys in parallel
+	keys = uniqueKeys(keys)
+	errs := make([]error, len(keys))
+	runBatch(len(keys), func(i int) {
+		operInternal := operables[keys[i]].(*operable)
+		data, ciphertext, err := e.f.loadValue(operInternal.name)
+		// if an error is received which is not the file is not found,
+		// return it
+		if !Exists(err) {
+			return
+		} else if err != nil {
+			errs[i] = err
+			return
 		}
-
-		var decryptedContents []byte
-		if hasfile {
-			decryptedContents, err = decrypt(encryptedContents, e.f.password)
-			if err != nil {
-				return nil, err
-			}
+		operInternal.exists = true
+		operInternal.existed = true
+		operInternal.ciphertext = ciphertext
+		operInternal.data = data
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
 		}
-		operInternal.exists = hasfile
-		operInternal.existed = hasfile
-		operInternal.data = decryptedContents
 	}
 	e.operables = append(e.operables, operables)
 	return operables, nil
@@ -391,20 +813,46 @@ func (e *extendable) addUnlock(u func()) {
 	}
 }
 
-func (e *extendable) flush() {
+// flush commits the writes and deletes of every operable of the transaction
+// at once, closing the operables. If it fails, none of them are committed.
+func (e *extendable) flush() error {
+	j := &txJournal{}
 	for _, opMap := range e.operables {
 		for _, oper := range opMap {
-			if !oper.IsClosed() {
-				if err := oper.Flush(); err != nil {
-					jww.FATAL.Panicf("Failed on a flush of key %s in "+
-						"transaction: %+v", oper.Key(), err)
-				}
+			operInternal := oper.(*operable)
+			operInternal.closed = true
+			entry, ok, err := operInternal.entry()
+			if err != nil {
+				return err
+			}
+			if ok {
+				j.Entries = append(j.Entries, entry)
 			}
 		}
 	}
+	sort.Slice(j.Entries, func(a, b int) bool {
+		return j.Entries[a].Name < j.Entries[b].Name
+	})
+
+	var err error
+	e.changed, e.size, err = e.f.commitTransaction(j)
+	return errors.WithMessage(err, "failed on a flush of transaction")
+}
+
+// misuse records the use of a closed operable of the transaction, which then
+// fails with the error. Once the transaction ended, the misuse is only logged.
+func (e *extendable) misuse(err error) {
+	if e.closed {
+		jww.ERROR.Printf("%+v", err)
+	} else if e.err == nil {
+		e.err = err
+	}
 }
 
 func (e *extendable) close() {
+	if e.closed {
+		return
+	}
 	e.closed = true
 	e.unlock()
 }
@@ -413,15 +861,19 @@ type operable struct {
 	key    string
 	closed bool
 
-	ecrKey string
+	name string
 
 	data    []byte
 	exists  bool
 	existed bool
+	// ciphertext is the contents of the files of the value when it was read,
+	// which are written back if the transaction is rolled back
+	ciphertext []byte
 
 	op OperableOps
 
 	f *Filestore
+	e *extendable
 }
 
 func (op *operable) Key() string {
@@ -430,12 +882,23 @@ func (op *operable) Key() string {
 }
 
 func (op *operable) Exists() bool {
-	op.testClosed("Exists()")
+	if op.testClosed("Exists()") {
+		return false
+	}
 	return op.exists
 }
 
+func (op *operable) Has() (bool, error) {
+	if op.closed {
+		return false, errors.Wrapf(ErrClosed, "cannot check %s", op.key)
+	}
+	return op.exists, nil
+}
+
 func (op *operable) Delete() {
-	op.testClosed("Delete()")
+	if op.testClosed("Delete()") {
+		return
+	}
 
 	op.data = nil
 	op.exists = false
@@ -443,7 +906,9 @@ func (op *operable) Delete() {
 }
 
 func (op *operable) Set(data []byte) {
-	op.testClosed("Set()")
+	if op.testClosed("Set()") {
+		return
+	}
 
 	op.data = data
 	op.exists = true
@@ -451,39 +916,72 @@ func (op *operable) Set(data []byte) {
 }
 
 func (op *operable) Get() ([]byte, bool) {
-	op.testClosed("Get()")
+	if op.testClosed("Get()") {
+		return nil, false
+	}
 	return op.data, op.exists
 }
 
+// Flush closes the operable. Its write or delete is committed along with the
+// rest of the transaction once the operation returns, so that either all of
+// them land or none do.
 func (op *operable) Flush() error {
-	op.testClosed("Flush()")
-	defer func() {
-		op.closed = true
-	}()
+	if op.closed {
+		return errors.Wrapf(ErrClosed, "cannot flush %s", op.key)
+	}
+	op.closed = true
+	return nil
+}
+
+// entry returns the journal entry of the write or delete of the operable, or
+// false if it changes nothing. The caller must hold the write lock of the
+// key.
+func (op *operable) entry() (txEntry, bool, error) {
 	switch op.op {
-	case readOp:
-		return nil
 	case writeOp:
-		encryptedNewContents := encrypt(op.data, op.f.password, op.f.csprng)
-		return write(op.ecrKey, encryptedNewContents, op.f.storage)
+		version := op.f.manifest.next(op.name)
+		value, err := sealVersionedValue(op.f.header, op.f.keys.content,
+			op.name, version, op.data, op.f.csprng)
+		if err != nil {
+			return txEntry{}, false, err
+		}
+		return txEntry{
+			Key:     op.key,
+			Name:    op.name,
+			Value:   value,
+			Version: version,
+			Old:     op.ciphertext,
+			OldSum:  ciphertextSum(op.ciphertext),
+		}, true, nil
 	case deleteOp:
-		if op.existed {
-			return deleteFiles(op.ecrKey, op.f.csprng, op.f.storage)
+		if !op.existed {
+			return txEntry{}, false, nil
 		}
-		return nil
-
+		return txEntry{
+			Key:     op.key,
+			Name:    op.name,
+			Version: op.f.manifest.next(op.name),
+			Size:    len(op.ciphertext),
+			Old:     op.ciphertext,
+			OldSum:  ciphertextSum(op.ciphertext),
+		}, true, nil
 	}
-	return nil
+	return txEntry{}, false, nil
 }
 
 func (op *operable) IsClosed() bool {
 	return op.closed
 }
 
-func (op *operable) testClosed(action string) {
-	if op.closed {
-		jww.FATAL.Panicf("Cannot '%s' on '%s', already closed", action, op.key)
+// testClosed reports whether the operable is closed, in which case the action
+// is not taken and fails the transaction with ErrClosed.
+func (op *operable) testClosed(action string) bool {
+	if !op.closed {
+		return false
 	}
+	op.e.misuse(errors.Wrapf(ErrClosed, "cannot '%s' on '%s'", action,
+		op.key))
+	return true
 }
 
 type OperableOps uint8
@@ -495,7 +993,5 @@ const (
 )
 
 func (f *Filestore) getKey(key string) string {
-	encryptedKey := hashStringWithPassword(key, f.password)
-	encryptedKeyStr := encodeKey(encryptedKey)
-	return f.basedir + string(os.PathSeparator) + encryptedKeyStr
+	return f.getPath(f.keys.name(key))
 }
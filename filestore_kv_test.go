@@ -8,6 +8,8 @@
 package ekv
 
 import (
+	"bytes"
+	"crypto/rand"
 	"fmt"
 	"os"
 	"sync"
@@ -79,7 +81,10 @@ func TestFilestoreKV_Smoke(t *testing.T) {
 
 	f, err := NewKeyValueFilestore(kv, ".ekv_testdir_kv", "Hello, World!")
 	if err != nil {
-		t.Errorf("%+v", err)
+		t.Fatalf("%+v", err)
+	}
+	if kdf := f.header.Slots[0].KDF; kdf != DefaultKDFParams() {
+		t.Errorf("Store created with %+v instead of the defaults", kdf)
 	}
 
 	i := &MarshalableString{
@@ -123,7 +128,7 @@ func TestFilestoreKV_Smoke(t *testing.T) {
 func TestFilestoreKV_Broken(t *testing.T) {
 	kv := newMemoryKV()
 
-	f, err := NewKeyValueFilestore(kv, ".ekv_testdir_kv_broken", "Hello, World 22!")
+	f, err := openTestStore(portable.UseKeyValue(kv), ".ekv_testdir_kv_broken", "Hello, World 22!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -148,7 +153,7 @@ func TestFilestoreKV_Broken(t *testing.T) {
 func TestFilestoreKV_Multiset(t *testing.T) {
 	kv := newMemoryKV()
 
-	f, err := NewKeyValueFilestore(kv, ".ekv_testdir_kv_multiset", "Hello, World!")
+	f, err := openTestStore(portable.UseKeyValue(kv), ".ekv_testdir_kv_multiset", "Hello, World!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -193,7 +198,7 @@ func TestFilestoreKV_Multiset(t *testing.T) {
 func TestFilestoreKV_Reopen(t *testing.T) {
 	kv := newMemoryKV()
 
-	f, err := NewKeyValueFilestore(kv, ".ekv_testdir_kv_reopen", "Hello, World!")
+	f, err := openTestStore(portable.UseKeyValue(kv), ".ekv_testdir_kv_reopen", "Hello, World!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -215,7 +220,7 @@ func TestFilestoreKV_Reopen(t *testing.T) {
 
 	for x := 0; x < 20; x++ {
 		// Reopen with the same KV instance to verify persistence
-		f, err = NewKeyValueFilestore(kv, ".ekv_testdir_kv_reopen", "Hello, World!")
+		f, err = openTestStore(portable.UseKeyValue(kv), ".ekv_testdir_kv_reopen", "Hello, World!")
 		if err != nil {
 			t.Errorf("%+v", err)
 		}
@@ -261,12 +266,12 @@ func TestFilestoreKV_Reopen(t *testing.T) {
 func TestFilestoreKV_BadPass(t *testing.T) {
 	kv := newMemoryKV()
 
-	_, err := NewKeyValueFilestore(kv, ".ekv_testdir_kv_badpass", "Hello, World!")
+	_, err := openTestStore(portable.UseKeyValue(kv), ".ekv_testdir_kv_badpass", "Hello, World!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
 
-	_, err = NewKeyValueFilestore(kv, ".ekv_testdir_kv_badpass", "badpassword")
+	_, err = openTestStore(portable.UseKeyValue(kv), ".ekv_testdir_kv_badpass", "badpassword")
 	if err == nil {
 		t.Errorf("Opened with bad password!")
 	}
@@ -276,7 +281,7 @@ func TestFilestoreKV_BadPass(t *testing.T) {
 func TestFilestoreKV_Concurrent(t *testing.T) {
 	kv := newMemoryKV()
 
-	f, err := NewKeyValueFilestore(kv, ".ekv_testdir_kv_concurrent", "Hello, World!")
+	f, err := openTestStore(portable.UseKeyValue(kv), ".ekv_testdir_kv_concurrent", "Hello, World!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -345,7 +350,7 @@ func TestFilestoreKV_UseKeyValue(t *testing.T) {
 	kv := newMemoryKV()
 	storage := portable.UseKeyValue(kv)
 
-	f, err := NewGenericFilestore(storage, ".ekv_testdir_kv_generic", "TestPassword")
+	f, err := openTestStore(storage, ".ekv_testdir_kv_generic", "TestPassword")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -366,6 +371,42 @@ func TestFilestoreKV_UseKeyValue(t *testing.T) {
 	}
 }
 
+// listlessStorage hides the ReadDir of the storage it wraps, like Storage
+// implemented before DirReader existed.
+type listlessStorage struct {
+	portable.Storage
+}
+
+// TestFilestoreKV_NoReadDir opens stores on storage that cannot list its
+// files, which works unless a feature of the store needs to list them.
+func TestFilestoreKV_NoReadDir(t *testing.T) {
+	storage := listlessStorage{portable.UseKeyValue(newMemoryKV())}
+	f, err := openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	err = f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Set([]byte("1"))
+		files["b"].Set([]byte("2"))
+		return nil
+	}, "a", "b")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f, err = openTestStore(storage, "dir", "password"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"a": "1", "b": "2"})
+
+	opts := testOptions()
+	opts.Decoys = DecoyPolicy{Step: 4}
+	_, err = NewGenericFilestoreWithOptions(storage, "decoys", "password",
+		rand.Reader, opts)
+	if !errors.Is(err, portable.ErrNoReadDir) {
+		t.Errorf("Unexpected error for a store with decoys: %+v", err)
+	}
+}
+
 // TestMemoryKV_Interface verifies the memoryKV implementation works correctly
 func TestMemoryKV_Interface(t *testing.T) {
 	kv := newMemoryKV()
@@ -421,3 +462,253 @@ func TestMemoryKV_Interface(t *testing.T) {
 		t.Errorf("Expected 2 keys after delete, got %d", len(keys))
 	}
 }
+
+// TestFilestoreKV_SwappedValues checks that a value moved to the files of
+// another key fails to decrypt rather than being returned for that key.
+func TestFilestoreKV_SwappedValues(t *testing.T) {
+	kv := newMemoryKV()
+	f, err := openTestStore(portable.UseKeyValue(kv), ".ekv_testdir_kv_swap", "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.SetBytes("b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The checksums are not keyed, so the files can be rewritten freely
+	storage := portable.UseKeyValue(kv)
+	contents, err := read(f.getKey("a"), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = write(f.getKey("b"), contents, storage); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.GetBytes("b"); err == nil {
+		t.Errorf("Value of a was returned for b")
+	}
+	err = f.Transaction(func(map[string]Operable, Extender) error {
+		return nil
+	}, "b")
+	if err == nil {
+		t.Errorf("Value of a was read for b in a transaction")
+	}
+}
+
+// TestFilestoreKV_LargeValue stores a value over 16 MiB, whose size older
+// versions could not record.
+func TestFilestoreKV_LargeValue(t *testing.T) {
+	f, err := openTestStore(portable.UseKeyValue(newMemoryKV()), "dir", "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data := make([]byte, 17<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err = f.SetBytes("large", data); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	contents, err := f.GetBytes("large")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(contents, data) {
+		t.Errorf("Large value differs after reading it back")
+	}
+}
+
+// newBenchmarkFilestore returns a store with the options on in-memory storage
+// holding a 1 KiB value under "key".
+//
+// The benchmarks use the default XChaCha20-Poly1305 suite unless they say
+// otherwise. AES256GCMSIV computes POLYVAL with a bitwise constant time
+// multiplication, run once per 16 bytes and measured by BenchmarkGHASHMul. At
+// about 1.4µs per call, or 11 MB/s, on a 2.1 GHz Xeon, it makes writing a
+// 1 KiB value around eight times slower than with the other suites, as
+// BenchmarkFilestore_SetBytes_CipherSuites shows.
+func newBenchmarkFilestore(b *testing.B, opts Options) *Filestore {
+	f, err := NewGenericFilestoreWithOptions(
+		portable.UseKeyValue(newMemoryKV()), "bench", "Hello, World!",
+		rand.Reader, opts)
+	if err != nil {
+		b.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("key", make([]byte, 1024)); err != nil {
+		b.Fatal(err)
+	}
+	return f
+}
+
+// BenchmarkFilestore_GetBytes measures reading a 1 KiB value.
+func BenchmarkFilestore_GetBytes(b *testing.B) {
+	f := newBenchmarkFilestore(b, testOptions())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.GetBytes("key"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFilestore_SetBytes measures writing a 1 KiB value.
+func BenchmarkFilestore_SetBytes(b *testing.B) {
+	f := newBenchmarkFilestore(b, testOptions())
+	data := make([]byte, 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := f.SetBytes("key", data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFilestore_SetBytes_CipherSuites measures writing a 1 KiB value
+// with every cipher suite.
+func BenchmarkFilestore_SetBytes_CipherSuites(b *testing.B) {
+	for _, suite := range []CipherSuite{XChaCha20Poly1305, AES256GCM,
+		AES256GCMSIV} {
+		b.Run(suite.Name(), func(b *testing.B) {
+			opts := testOptions()
+			opts.Cipher = suite
+			f := newBenchmarkFilestore(b, opts)
+			data := make([]byte, 1024)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := f.SetBytes("key", data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkGHASHMul measures the multiplication that AES-GCM-SIV runs for
+// every 16 bytes it authenticates.
+func BenchmarkGHASHMul(b *testing.B) {
+	x := [2]uint64{0x0123456789abcdef, 0xfedcba9876543210}
+	y := [2]uint64{0x1f2e3d4c5b6a7988, 0x8897a6b5c4d3e2f1}
+	b.SetBytes(16)
+	for i := 0; i < b.N; i++ {
+		x = ghashMul(x, y)
+	}
+}
+
+// BenchmarkFilestore_GetBytesParallel measures concurrent reads of a 1 KiB
+// value.
+func BenchmarkFilestore_GetBytesParallel(b *testing.B) {
+	f := newBenchmarkFilestore(b, testOptions())
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := f.GetBytes("key"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkFilestore_Transaction measures a transaction reading and rewriting
+// a 1 KiB value.
+func BenchmarkFilestore_Transaction(b *testing.B) {
+	f := newBenchmarkFilestore(b, testOptions())
+	op := func(files map[string]Operable, _ Extender) error {
+		data, _ := files["key"].Get()
+		files["key"].Set(data)
+		return nil
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := f.Transaction(op, "key"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// testHas checks that the KeyValue reports which keys exist, directly and in
+// transactions.
+func testHas(t *testing.T, kv KeyValue) {
+	checkHas := func(key string, expected bool) {
+		t.Helper()
+		if ok, err := kv.Has(key); err != nil || ok != expected {
+			t.Errorf("Has(%q) returned %t, %+v", key, ok, err)
+		}
+	}
+	checkHas("a", false)
+	if err := kv.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkHas("a", true)
+	if ok, err := kv.Prefix("ns").Has("a"); err != nil || ok {
+		t.Errorf("Key found in a namespace: %t, %+v", ok, err)
+	}
+
+	var closed Operable
+	err := kv.Transaction(func(files map[string]Operable, _ Extender) error {
+		closed = files["a"]
+		if ok, err := files["a"].Has(); err != nil || !ok {
+			t.Errorf("Operable of a does not exist: %t, %+v", ok, err)
+		}
+		files["a"].Delete()
+		if ok, err := files["a"].Has(); err != nil || ok {
+			t.Errorf("Deleted operable of a exists: %t, %+v", ok, err)
+		}
+		return nil
+	}, "a")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkHas("a", false)
+	if _, err = closed.Has(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Unexpected error for a closed operable: %+v", err)
+	}
+}
+
+// TestFilestoreKV_Has checks which keys exist in a store, and that damaged
+// or rolled back values are reported rather than missing.
+func TestFilestoreKV_Has(t *testing.T) {
+	kv := newMemoryKV()
+	opts := testOptions()
+	opts.Manifest = true
+	f := newTestStore(t, portable.UseKeyValue(kv), opts, nil)
+	testHas(t, f)
+
+	for _, key := range []string{"b", "c"} {
+		for i := 0; i < 2; i++ {
+			if err := f.SetBytes(key, []byte(key)); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	for _, suffix := range []string{".1", ".2"} {
+		data := kv.data[f.getKey("b")+suffix]
+		data[len(data)/2] ^= 1
+	}
+	if ok, err := f.Has("b"); ok || !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Unexpected result for a damaged value: %t, %+v", ok, err)
+	}
+
+	old := make(map[string][]byte)
+	for _, suffix := range []string{".1", ".2"} {
+		old[suffix] = kv.data[f.getKey("c")+suffix]
+	}
+	if err := f.Delete("c"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for suffix, data := range old {
+		kv.data[f.getKey("c")+suffix] = data
+	}
+	if ok, err := f.Has("c"); !errors.Is(err, ErrRollback) {
+		t.Errorf("Unexpected result for a restored value: %t, %+v", ok, err)
+	}
+
+	f.Close()
+	if _, err := f.Has("c"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Unexpected error for a closed store: %+v", err)
+	}
+}
@@ -103,7 +103,7 @@ func TestFilestore_Broken(t *testing.T) {
 		}
 	}()
 
-	f, err := NewFilestore(".ekv_testdir_broken", "Hello, World 22!")
+	f, err := openTestStore(portable.UsePosix(), ".ekv_testdir_broken", "Hello, World 22!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -133,7 +133,7 @@ func TestFilestore_Multiset(t *testing.T) {
 		}
 	}()
 
-	f, err := NewFilestore(".ekv_testdir_multiset", "Hello, World!")
+	f, err := openTestStore(portable.UsePosix(), ".ekv_testdir_multiset", "Hello, World!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -182,7 +182,7 @@ func TestFilestore_Reopen(t *testing.T) {
 		}
 	}()
 
-	f, err := NewFilestore(".ekv_testdir_reopen", "Hello, World!")
+	f, err := openTestStore(portable.UsePosix(), ".ekv_testdir_reopen", "Hello, World!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
@@ -203,7 +203,7 @@ func TestFilestore_Reopen(t *testing.T) {
 	}
 
 	for x := 0; x < 20; x++ {
-		f, err = NewFilestore(".ekv_testdir_reopen", "Hello, World!")
+		f, err = openTestStore(portable.UsePosix(), ".ekv_testdir_reopen", "Hello, World!")
 		if err != nil {
 			t.Errorf("%+v", err)
 		}
@@ -253,12 +253,12 @@ func TestFilestore_BadPass(t *testing.T) {
 		}
 	}()
 
-	_, err := NewFilestore(".ekv_testdir_badpass", "Hello, World!")
+	_, err := openTestStore(portable.UsePosix(), ".ekv_testdir_badpass", "Hello, World!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
 
-	_, err = NewFilestore(".ekv_testdir_badpass", "badpassword")
+	_, err = openTestStore(portable.UsePosix(), ".ekv_testdir_badpass", "badpassword")
 	if err == nil {
 		t.Errorf("Opened with bad password!")
 	}
@@ -275,16 +275,11 @@ func TestFilestore_FDCount(t *testing.T) {
 		return
 	}
 
-	baseDir := ".ekv_testdir_fdcount"
+	baseDir := t.TempDir()
 
 	t.Logf("Starting File Descriptor Count: %d", startFDCount)
 
-	err = portable.UsePosix().RemoveAll(baseDir)
-	if err != nil {
-		t.Error(err)
-	}
-
-	f, err := NewFilestore(baseDir, "Hello, World!")
+	f, err := openTestStore(portable.UsePosix(), baseDir, "Hello, World!")
 	if err != nil {
 		t.Errorf("%+v", err)
 	}
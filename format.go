@@ -0,0 +1,296 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// format.go versions the data held by a store, separately from its header.
+//
+// The header version only covers what the .ekv file holds. The format of the
+// store covers everything else, such as the layout of the records in io.go, and moving
+// to a newer format can mean rewriting every file in the store. This is left
+// to [Filestore.Upgrade], which runs the registered migration from each format
+// to the next. A migration is committed by writing the header with the new
+// format, so each one must be safe to run again if it is interrupted before
+// that. Stores in any older format remain readable.
+//
+// The header also holds a protected copy of itself
+// encrypted under the store key. It records the header version, the format,
+// the cipher suite and the features the store uses, so that none of them can
+// be changed in the plaintext header without the store failing to open, along
+// with metadata chosen by the application. Stores using a feature that this
+// version does not know of are refused with ErrNewerFormat.
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+const (
+	// storeFormat is the format of the stores written by this version.
+	storeFormat = 2
+	// protectedAD is the associated data of the protected copy.
+	protectedAD = "ekv protected header"
+)
+
+// ErrNewerFormat is returned when a store or one of its files was written by
+// a newer version of ekv.
+var ErrNewerFormat = errors.New("store was written by a newer version of ekv")
+
+// Features recorded in the protected header.
+const (
+	featureCommitting = "committing"
+	featureCompressed = "compressed"
+	featureDecoys     = "decoys"
+	featureEncrypted  = "encryptedNames"
+	featureIndex      = "index"
+	featureManifest   = "manifest"
+	featurePadding    = "padding"
+)
+
+// knownFeatures holds every feature this version supports.
+var knownFeatures = map[string]struct{}{
+	featureCommitting: {},
+	featureCompressed: {},
+	featureDecoys:     {},
+	featureEncrypted:  {},
+	featureIndex:      {},
+	featureManifest:   {},
+	featurePadding:    {},
+}
+
+// protectedHeader is the contents of the protected copy of the header.
+type protectedHeader struct {
+	Version  int               `json:"version"`
+	Format   int               `json:"format"`
+	Cipher   string            `json:"cipher,omitempty"`
+	Features []string          `json:"features"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// migration moves the data of a store from one format to the next.
+type migration struct {
+	// description names the migration in errors
+	description string
+	// migrate runs the migration. The caller holds keyMux for writing.
+	migrate func(ctx context.Context, f *Filestore) error
+}
+
+// migrations holds the migration from each format to the next, indexed by
+// the format it moves from.
+var migrations = map[int]migration{
+	0: {"versioned records", migrateRecords},
+	1: {"64 bit record sizes", migrateRecords},
+}
+
+// features returns the sorted features used by the store.
+func (h *storeHeader) features() []string {
+	features := make([]string, 0, len(knownFeatures))
+	if h.Committing {
+		features = append(features, featureCommitting)
+	}
+	if h.Compression != NoCompression {
+		features = append(features, featureCompressed)
+	}
+	if h.Decoys != nil {
+		features = append(features, featureDecoys)
+	}
+	if h.EncryptedNames {
+		features = append(features, featureEncrypted)
+	}
+	if h.Index {
+		features = append(features, featureIndex)
+	}
+	if h.Manifest {
+		features = append(features, featureManifest)
+	}
+	if h.Padding != nil {
+		features = append(features, featurePadding)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// seal encrypts the check value and the protected copy of the header under
+// the key. It must be called after any of the fields in the protected copy
+// change.
+func (h *storeHeader) seal(key []byte, csprng io.Reader) error {
+	suite := h.cipherSuite()
+	check, err := encrypt(suite, []byte(marker(h.Version)), key, csprng)
+	if err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(protectedHeader{
+		Version:  h.Version,
+		Format:   h.Format,
+		Cipher:   h.Cipher,
+		Features: h.features(),
+		Metadata: h.metadata,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	protected, err := encryptWithAD(suite, contents, key,
+		[]byte(protectedAD), csprng)
+	if err != nil {
+		return err
+	}
+	h.Check, h.Protected = check, protected
+	return nil
+}
+
+// openProtected decrypts the protected copy of the header with the key,
+// checks it against the header and loads the metadata it holds.
+func (h *storeHeader) openProtected(key []byte) error {
+	if h == nil {
+		return nil
+	}
+	contents, err := decryptWithAD(h.cipherSuite(), h.Protected, key,
+		[]byte(protectedAD))
+	if err != nil {
+		return errors.WithMessage(err, "invalid protected header")
+	}
+	p := protectedHeader{}
+	if err = json.Unmarshal(contents, &p); err != nil {
+		return errors.Wrap(err, "invalid protected header")
+	}
+
+	for _, feature := range p.Features {
+		if _, ok := knownFeatures[feature]; !ok {
+			return errors.Wrapf(ErrNewerFormat, "store uses feature %q",
+				feature)
+		}
+	}
+	features := h.features()
+	match := p.Version == h.Version && p.Format == h.Format &&
+		p.Cipher == h.Cipher && len(p.Features) == len(features)
+	for i := 0; match && i < len(features); i++ {
+		match = p.Features[i] == features[i]
+	}
+	if !match {
+		return errors.New("header does not match its protected copy")
+	}
+
+	h.metadata = p.Metadata
+	return nil
+}
+
+// copyMetadata returns a copy of the metadata, or nil if it is empty.
+func copyMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		c[k] = v
+	}
+	return c
+}
+
+// Metadata returns a copy of the metadata recorded in the protected header of
+// the store, such as the name of the application and the version of its
+// schema. It is nil for stores without any.
+func (f *Filestore) Metadata() map[string]string {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if f.header == nil {
+		return nil
+	}
+	return copyMetadata(f.header.metadata)
+}
+
+// SetMetadata replaces the metadata recorded in the protected header of the
+// store. Version:1 stores have no header to record it in and must be upgraded
+// with [Filestore.UpgradeKDF] first.
+func (f *Filestore) SetMetadata(metadata map[string]string) error {
+	f.lockKeys()
+	defer f.unlockKeys()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+	if f.header == nil {
+		return errors.New(errNoKeySlots)
+	}
+
+	h := f.header.clone()
+	h.metadata = copyMetadata(metadata)
+	if err := h.seal(f.key.bytes(), f.csprng); err != nil {
+		return err
+	}
+	return f.saveHeader(h)
+}
+
+// Upgrade moves the store to the current format, running the migration from
+// each older format to the next in turn. Each migration is committed by
+// writing the header with its new format, so a store whose upgrade fails or is
+// cancelled through the context is left in the last format reached, and
+// remains usable and can be upgraded again. Stores already in the current
+// format are left alone.
+//
+// Every other operation on the store is blocked while it is being upgraded.
+func (f *Filestore) Upgrade(ctx context.Context) error {
+	f.lockKeys()
+	defer f.unlockKeys()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+	if f.header == nil {
+		return errors.New(errNoKeySlots)
+	}
+
+	for f.header.Format < storeFormat {
+		m, ok := migrations[f.header.Format]
+		if !ok {
+			return errors.Errorf("no migration from format %d",
+				f.header.Format)
+		}
+		if err := m.migrate(ctx, f); err != nil {
+			return errors.WithMessagef(err, "could not migrate to %s",
+				m.description)
+		}
+
+		h := f.header.clone()
+		h.Format++
+		if err := h.seal(f.key.bytes(), f.csprng); err != nil {
+			return err
+		}
+		if err := f.saveHeader(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRecords rewrites every file in the store that was not written in the
+// current record layout.
+func migrateRecords(ctx context.Context, f *Filestore) error {
+	names, err := portable.ReadDir(f.storage, f.basedir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stems := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if stem, ok := splitPath(name); ok {
+			stems[stem] = struct{}{}
+		}
+	}
+
+	for stem := range stems {
+		if err = ctx.Err(); err != nil {
+			return errors.WithStack(err)
+		}
+		if err = upgradeRecord(f.getPath(stem), f.storage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// TestFilestore_Metadata checks that the metadata is kept in the protected
+// header across reopening the store.
+func TestFilestore_Metadata(t *testing.T) {
+	storage := portable.UseKeyValue(newMemoryKV())
+	opts := testOptions()
+	opts.Metadata = map[string]string{"app": "test", "schema": "1"}
+	f, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+		rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	opts.Metadata["schema"] = "changed"
+	if f.Metadata()["schema"] != "1" {
+		t.Errorf("Metadata shares the map in the options")
+	}
+
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if md := f.Metadata(); len(md) != 2 || md["app"] != "test" ||
+		md["schema"] != "1" {
+		t.Errorf("Unexpected metadata: %v", md)
+	}
+
+	err = f.SetMetadata(map[string]string{"app": "test", "schema": "2"})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if md := f.Metadata(); md["schema"] != "2" {
+		t.Errorf("Unexpected metadata after setting it: %v", md)
+	}
+}
+
+// TestFilestore_ProtectedHeader checks that stores whose header differs from
+// its protected copy are refused.
+func TestFilestore_ProtectedHeader(t *testing.T) {
+	kv := newMemoryKV()
+	storage := portable.UseKeyValue(kv)
+	opts := testOptions()
+	opts.Manifest = true
+	f, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+		rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	key := append([]byte(nil), f.key.bytes()...)
+	original := f.header.clone()
+
+	noManifest := original.clone()
+	noManifest.Manifest = false
+	otherFormat := original.clone()
+	otherFormat.Format = 0
+	otherCipher := original.clone()
+	otherCipher.Cipher = AES256GCM.Name()
+
+	for i, h := range []*storeHeader{noManifest, otherFormat, otherCipher} {
+		err = writeHeader(f.getPath(ekvFilename), h, key, rand.Reader,
+			storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = openTestStore(storage, "dir", "password")
+		if err == nil {
+			t.Errorf("Opened store %d with a modified header", i)
+		}
+	}
+
+	// A feature from a newer version
+	contents, err := json.Marshal(protectedHeader{
+		Version:  original.Version,
+		Format:   original.Format,
+		Features: append(original.features(), "future"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := original.clone()
+	future.Protected, err = encryptWithAD(future.cipherSuite(), contents, key,
+		[]byte(protectedAD), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeHeader(f.getPath(ekvFilename), future, key, rand.Reader,
+		storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openTestStore(storage, "dir", "password")
+	if !errors.Is(err, ErrNewerFormat) {
+		t.Errorf("Unexpected error for an unknown feature: %v", err)
+	}
+
+	// A newer header version
+	future = original.clone()
+	future.Version++
+	err = writeHeader(f.getPath(ekvFilename), future, key, rand.Reader,
+		storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = openTestStore(storage, "dir", "password")
+	if !errors.Is(err, ErrNewerFormat) {
+		t.Errorf("Unexpected error for a newer version: %v", err)
+	}
+}
+
+// TestFilestore_Upgrade moves a store with unversioned records to the current
+// format.
+func TestFilestore_Upgrade(t *testing.T) {
+	kv := newMemoryKV()
+	storage := portable.UseKeyValue(kv)
+	f, err := openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	values := map[string]string{"a": "1", "b": "2", "c": "3"}
+	for k, v := range values {
+		if err = f.SetBytes(k, []byte(v)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	// Move the store back to format 0, whose records have no version and a
+	// 4 byte size
+	h := f.header.clone()
+	h.Format = 0
+	if err = h.seal(f.key.bytes(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.saveHeader(h); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := kv.Keys()
+	for _, k := range keys {
+		contents, _ := kv.Get(k)
+		if len(contents) == 0 {
+			continue
+		}
+		if err = kv.Set(k, legacyRecord(contents, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, values)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = f.Upgrade(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Unexpected error from a cancelled upgrade: %v", err)
+	}
+	if f.header.Format != 0 {
+		t.Errorf("Cancelled upgrade moved the store to format %d",
+			f.header.Format)
+	}
+
+	if err = f.Upgrade(context.Background()); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.header.Format != storeFormat {
+		t.Errorf("Store is at format %d after upgrading", f.header.Format)
+	}
+	checkValues(t, f, values)
+	keys, _ = kv.Keys()
+	for _, k := range keys {
+		contents, _ := kv.Get(k)
+		if len(contents) > 0 &&
+			contents[0]>>recordVersionShift != recordVersion {
+			t.Errorf("File %s was not upgraded: %x", k, contents[0])
+		}
+	}
+
+	if err = f.Upgrade(context.Background()); err != nil {
+		t.Errorf("Upgrading a current store failed: %+v", err)
+	}
+}
+
+// TestMigrations checks that there is a migration from every older format.
+func TestMigrations(t *testing.T) {
+	for format := 0; format < storeFormat; format++ {
+		if _, ok := migrations[format]; !ok {
+			t.Errorf("No migration from format %d", format)
+		}
+	}
+}
+
+// TestRead_NewerRecord checks that records with a newer layout are refused
+// rather than misread.
+func TestRead_NewerRecord(t *testing.T) {
+	kv := newMemoryKV()
+	storage := portable.UseKeyValue(kv)
+	if err := storage.MkdirAll("dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("dir/a", []byte("value"), storage); err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := kv.Get("dir/a.1")
+	contents[0] = (recordVersion+1)<<recordVersionShift |
+		contents[0]&modMonCntrMask
+	if err := kv.Set("dir/a.1", contents); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := read("dir/a", storage); !errors.Is(err, ErrNewerFormat) {
+		t.Errorf("Unexpected error for a newer record: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// gcmsiv.go implements AES-GCM-SIV as specified in RFC 8452. Neither the
+// standard library nor x/crypto provide it. A tag is computed over the
+// plaintext with POLYVAL and then used as the initial counter for AES-CTR, so
+// reusing a nonce only reveals whether two messages are equal.
+//
+// POLYVAL is computed through GHASH as described in appendix A of the RFC,
+// using a bitwise multiplication that runs in constant time but is much slower
+// than the hardware accelerated GCM of crypto/cipher.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gcmSIVNonceSize = 12
+	gcmSIVTagSize   = 16
+	// gcmSIVMaxSize is the largest plaintext, and associated data, allowed
+	// by RFC 8452.
+	gcmSIVMaxSize = 1 << 36
+)
+
+// gcmSIV is the AES-GCM-SIV AEAD keyed with an AES-128 or AES-256 key.
+type gcmSIV struct {
+	// kdf is AES keyed with the key, which derives the keys of each nonce
+	kdf     cipher.Block
+	keySize int
+}
+
+// newGCMSIV returns the AES-GCM-SIV AEAD for the key, which must be 16 or 32
+// bytes long.
+func newGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, errors.Errorf("invalid AES-GCM-SIV key size %d",
+			len(key))
+	}
+	kdf, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &gcmSIV{kdf: kdf, keySize: len(key)}, nil
+}
+
+// NonceSize implements [cipher.AEAD.NonceSize].
+func (g *gcmSIV) NonceSize() int {
+	return gcmSIVNonceSize
+}
+
+// Overhead implements [cipher.AEAD.Overhead].
+func (g *gcmSIV) Overhead() int {
+	return gcmSIVTagSize
+}
+
+// Seal implements [cipher.AEAD.Seal]. Like the AEADs of the standard library,
+// it panics if the nonce or sizes are invalid, so callers check them first.
+func (g *gcmSIV) Seal(dst, nonce, plaintext, ad []byte) []byte {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("ekv: incorrect nonce length given to AES-GCM-SIV")
+	}
+	if uint64(len(plaintext)) > gcmSIVMaxSize ||
+		uint64(len(ad)) > gcmSIVMaxSize {
+		panic("ekv: message too large for AES-GCM-SIV")
+	}
+
+	authKey, block := g.deriveKeys(nonce)
+	var tag [gcmSIVTagSize]byte
+	gcmSIVTag(&tag, authKey, block, nonce, plaintext, ad)
+
+	ret, out := sliceForAppend(dst, len(plaintext)+gcmSIVTagSize)
+	gcmSIVCTR(block, &tag, out[:len(plaintext)], plaintext)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+// Open implements [cipher.AEAD.Open].
+func (g *gcmSIV) Open(dst, nonce, ciphertext, ad []byte) ([]byte, error) {
+	if len(nonce) != gcmSIVNonceSize {
+		return nil, errors.Errorf("incorrect nonce length %d given to "+
+			"AES-GCM-SIV", len(nonce))
+	}
+	if len(ciphertext) < gcmSIVTagSize ||
+		uint64(len(ciphertext)) > gcmSIVMaxSize+gcmSIVTagSize ||
+		uint64(len(ad)) > gcmSIVMaxSize {
+		return nil, errors.New("message authentication failed")
+	}
+
+	var tag [gcmSIVTagSize]byte
+	copy(tag[:], ciphertext[len(ciphertext)-gcmSIVTagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-gcmSIVTagSize]
+
+	authKey, block := g.deriveKeys(nonce)
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	gcmSIVCTR(block, &tag, out, ciphertext)
+
+	var expected [gcmSIVTagSize]byte
+	gcmSIVTag(&expected, authKey, block, nonce, out, ad)
+	if subtle.ConstantTimeCompare(expected[:], tag[:]) != 1 {
+		zero(out)
+		return nil, errors.New("message authentication failed")
+	}
+	return ret, nil
+}
+
+// deriveKeys returns the POLYVAL key and the AES cipher keyed with the
+// message encryption key for the nonce.
+func (g *gcmSIV) deriveKeys(nonce []byte) ([]byte, cipher.Block) {
+	var in, out [aes.BlockSize]byte
+	copy(in[4:], nonce)
+	keys := make([]byte, 16+g.keySize)
+	for i := 0; i < len(keys)/8; i++ {
+		binary.LittleEndian.PutUint32(in[:4], uint32(i))
+		g.kdf.Encrypt(out[:], in[:])
+		copy(keys[8*i:], out[:8])
+	}
+	defer zero(keys)
+
+	// The message encryption key is as long as the key, which newGCMSIV
+	// checked
+	block, _ := aes.NewCipher(keys[16:])
+	return append([]byte(nil), keys[:16]...), block
+}
+
+// gcmSIVTag computes the tag of the plaintext and associated data.
+func gcmSIVTag(tag *[gcmSIVTagSize]byte, authKey []byte, block cipher.Block,
+	nonce, plaintext, ad []byte) {
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(ad))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+
+	p := newPolyval(authKey)
+	p.update(ad)
+	p.update(plaintext)
+	p.update(lengths[:])
+	s := p.sum()
+
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	block.Encrypt(tag[:], s[:])
+}
+
+// gcmSIVCTR encrypts or decrypts in into out with AES-CTR, starting from the
+// counter block derived from the tag.
+func gcmSIVCTR(block cipher.Block, tag *[gcmSIVTagSize]byte, out,
+	in []byte) {
+	counter := *tag
+	counter[15] |= 0x80
+	var keystream [aes.BlockSize]byte
+	for len(in) > 0 {
+		block.Encrypt(keystream[:], counter[:])
+		n := subtle.XORBytes(out, in, keystream[:])
+		out, in = out[n:], in[n:]
+		ctr := binary.LittleEndian.Uint32(counter[:4])
+		binary.LittleEndian.PutUint32(counter[:4], ctr+1)
+	}
+}
+
+// polyval computes POLYVAL by way of GHASH. Blocks are byte reversed into the
+// GHASH representation, where bit 0 is the most significant bit of the first
+// byte and holds the coefficient of x^0.
+type polyval struct {
+	h [2]uint64 // mulX_GHASH(ByteReverse(H))
+	s [2]uint64
+}
+
+// newPolyval returns POLYVAL keyed with the 16 byte key.
+func newPolyval(key []byte) *polyval {
+	p := &polyval{h: reversedBlock(key)}
+	p.h = ghashMulX(p.h)
+	return p
+}
+
+// update adds the data to the hash, padded with zeros to a whole block.
+func (p *polyval) update(data []byte) {
+	for len(data) > 0 {
+		var block [16]byte
+		n := copy(block[:], data)
+		data = data[n:]
+		x := reversedBlock(block[:])
+		p.s[0] ^= x[0]
+		p.s[1] ^= x[1]
+		p.s = ghashMul(p.s, p.h)
+	}
+}
+
+// sum returns POLYVAL of the data added so far.
+func (p *polyval) sum() [16]byte {
+	var out [16]byte
+	binary.BigEndian.PutUint64(out[:8], p.s[0])
+	binary.BigEndian.PutUint64(out[8:], p.s[1])
+	for i := 0; i < 8; i++ {
+		out[i], out[15-i] = out[15-i], out[i]
+	}
+	return out
+}
+
+// reversedBlock returns the byte reversed block as big endian words.
+func reversedBlock(b []byte) [2]uint64 {
+	return [2]uint64{
+		binary.LittleEndian.Uint64(b[8:16]),
+		binary.LittleEndian.Uint64(b[0:8]),
+	}
+}
+
+// ghashR is the reduction constant of the GHASH field.
+const ghashR = 0xe1 << 56
+
+// ghashMulX multiplies the element by x in the GHASH field.
+func ghashMulX(v [2]uint64) [2]uint64 {
+	mask := -(v[1] & 1)
+	v[1] = v[1]>>1 | v[0]<<63
+	v[0] = v[0]>>1 ^ ghashR&mask
+	return v
+}
+
+// ghashMul multiplies two elements of the GHASH field in constant time.
+func ghashMul(x, y [2]uint64) [2]uint64 {
+	var z [2]uint64
+	v := y
+	for i := 0; i < 128; i++ {
+		bit := x[i/64] >> (63 - uint(i%64)) & 1
+		mask := -bit
+		z[0] ^= v[0] & mask
+		z[1] ^= v[1] & mask
+		v = ghashMulX(v)
+	}
+	return z
+}
+
+// sliceForAppend extends in by n bytes, reallocating if needed, and returns
+// the extended slice along with the n new bytes.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,238 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// TestPolyval checks POLYVAL against the example in appendix A of RFC 8452.
+func TestPolyval(t *testing.T) {
+	h := mustHex(t, "25629347589242761d31f826ba4b757b")
+	p := newPolyval(h)
+	p.update(mustHex(t, "4f4f95668c83dfb6401762bb2d01a262"))
+	p.update(mustHex(t, "d1a24ddd2721d006bbe45f20d3c9f362"))
+	sum := p.sum()
+	expected := mustHex(t, "f7a3b47b846119fae5b7866cf5e5b77e")
+	if !bytes.Equal(sum[:], expected) {
+		t.Errorf("POLYVAL is %x, expected %x", sum, expected)
+	}
+}
+
+// TestGCMSIV checks AES-GCM-SIV against test vectors from appendix C of
+// RFC 8452, including the counter wrap tests of appendix C.3.
+func TestGCMSIV(t *testing.T) {
+	const (
+		key256 = "01000000000000000000000000000000" +
+			"00000000000000000000000000000000"
+		nonce = "030000000000000000000000"
+		zero  = "00000000000000000000000000000000"
+	)
+	tests := []struct {
+		key, nonce, plaintext, ad, result string
+	}{
+		// AEAD_AES_128_GCM_SIV
+		{
+			"01000000000000000000000000000000", nonce, "", "",
+			"dc20e2d83f25705bb49e439eca56de25",
+		},
+		// AEAD_AES_256_GCM_SIV
+		{key256, nonce, "", "", "07f5f4169bbf55a8400cd47ea6fd400f"},
+		{
+			key256, nonce, "0100000000000000", "",
+			"c2ef328e5c71c83b843122130f7364b761e0b97427e3df28",
+		},
+		{
+			key256, nonce, "010000000000000000000000", "",
+			"9aab2aeb3faa0a34aea8e2b18ca50da9ae6559e48fd10f6e5c9ca17e",
+		},
+		{
+			key256, nonce, "01000000000000000000000000000000", "",
+			"85a01b63025ba19b7fd3ddfc033b3e76" +
+				"c9eac6fa700942702e90862383c6c366",
+		},
+		{
+			key256, nonce, "01000000000000000000000000000000" +
+				"02000000000000000000000000000000", "",
+			"4a6a9db4c8c6549201b9edb53006cba8" +
+				"21ec9cf850948a7c86c68ac7539d027f" +
+				"e819e63abcd020b006a976397632eb5d",
+		},
+		{
+			key256, nonce, "01000000000000000000000000000000" +
+				"02000000000000000000000000000000" +
+				"03000000000000000000000000000000", "",
+			"c00d121893a9fa603f48ccc1ca3c57ce" +
+				"7499245ea0046db16c53c7c66fe717e3" +
+				"9cf6c748837b61f6ee3adcee17534ed5" +
+				"790bc96880a99ba804bd12c0e6a22cc4",
+		},
+		{
+			key256, nonce, "01000000000000000000000000000000" +
+				"02000000000000000000000000000000" +
+				"03000000000000000000000000000000" +
+				"04000000000000000000000000000000", "",
+			"c2d5160a1f8683834910acdafc41fbb1" +
+				"632d4a353e8b905ec9a5499ac34f96c7" +
+				"e1049eb080883891a4db8caaa1f99dd0" +
+				"04d80487540735234e3744512c6f90ce" +
+				"112864c269fc0d9d88c61fa47e39aa08",
+		},
+		{
+			key256, nonce, "0200000000000000", "01",
+			"1de22967237a813291213f267e3b452f02d01ae33e4ec854",
+		},
+		{
+			key256, nonce, "020000000000000000000000", "01",
+			"163d6f9cc1b346cd453a2e4cc1a4a19ae800941ccdc57cc8413c277f",
+		},
+		{
+			key256, nonce, "02000000000000000000000000000000", "01",
+			"c91545823cc24f17dbb0e9e807d5ec17" +
+				"b292d28ff61189e8e49f3875ef91aff7",
+		},
+		{
+			key256, nonce, "02000000000000000000000000000000" +
+				"03000000000000000000000000000000", "01",
+			"07dad364bfc2b9da89116d7bef6daaaf" +
+				"6f255510aa654f920ac81b94e8bad365" +
+				"aea1bad12702e1965604374aab96dbbc",
+		},
+		{
+			key256, nonce, "02000000000000000000000000000000" +
+				"03000000000000000000000000000000" +
+				"04000000000000000000000000000000", "01",
+			"c67a1f0f567a5198aa1fcc8e3f213143" +
+				"36f7f51ca8b1af61feac35a86416fa47" +
+				"fbca3b5f749cdf564527f2314f42fe25" +
+				"03332742b228c647173616cfd44c54eb",
+		},
+		{
+			key256, nonce, "02000000000000000000000000000000" +
+				"03000000000000000000000000000000" +
+				"04000000000000000000000000000000" +
+				"05000000000000000000000000000000", "01",
+			"67fd45e126bfb9a79930c43aad2d3696" +
+				"7d3f0e4d217c1e551f59727870beefc9" +
+				"8cb933a8fce9de887b1e40799988db1f" +
+				"c3f91880ed405b2dd298318858467c89" +
+				"5bde0285037c5de81e5b570a049b62a0",
+		},
+		{
+			key256, nonce, "02000000", "010000000000000000000000",
+			"22b3f4cd1835e517741dfddccfa07fa4661b74cf",
+		},
+		{
+			key256, nonce, "03000000000000000000000000000000" +
+				"04000000", "01000000000000000000000000000000" +
+				"0200",
+			"43dd0163cdb48f9fe3212bf61b201976" +
+				"067f342bb879ad976d8242acc188ab59" +
+				"cabfe307",
+		},
+		{
+			key256, nonce, "03000000000000000000000000000000" +
+				"0400", "01000000000000000000000000000000" +
+				"02000000",
+			"462401724b5ce6588d5a54aae5375513" +
+				"a075cfcdf5042112aa29685c912fc205" +
+				"6543",
+		},
+		{
+			"e66021d5eb8e4f4066d4adb9c33560e4" +
+				"f46e44bb3da0015c94f7088736864200",
+			"e0eaf5284d884a0e77d31646", "", "",
+			"169fbb2fbf389a995f6390af22228a62",
+		},
+		{
+			"6545fc880c94a95198874296d5cc1fd1" +
+				"61320b6920ce07787f86743b275d1ab3",
+			"2f6d1f0434d8848c1177441f", "195495860f04",
+			"6787f3ea22c127aaf195",
+			"a254dad4f3f96b62b84dc40c84636a5ec12020ec8c2c",
+		},
+		{
+			"d1894728b3fed1473c528b8426a58299" +
+				"5929a1499e9ad8780c8d63d0ab4149c0",
+			"9f572c614b4745914474e7c7", "c9882e5386fd9f92ec",
+			"489c8fde2be2cf97e74e932d4ed87d",
+			"0df9e308678244c44bc0fd3dc6628dfe55ebb0b9fb2295c8c2",
+		},
+		{
+			"a44102952ef94b02b805249bac80e6f6" +
+				"1455bfac8308a2d40d8c845117808235",
+			"5c9e940fea2f582950a70d5a", "1db2316fd568378da107b52b",
+			"0da55210cc1c1b0abde3b2f204d1e9f8b06bc47f",
+			"8dbeb9f7255bf5769dd56692404099c2587f64979f21826706d497d5",
+		},
+		{
+			"9745b3d1ae06556fb6aa7890bebc18fe" +
+				"6b3db4da3d57aa94842b9803a96e07fb",
+			"6de71860f762ebfbd08284e4", "21702de0de18baa9c9596291b08466",
+			"f37de21c7ff901cfe8a69615a93fdf7a98cad481796245709f",
+			"793576dfa5c0f88729a7ed3c2f1bffb3" +
+				"080d28f6ebb5d3648ce97bd5ba67fd",
+		},
+		// Counter wrap
+		{
+			zero + zero, "000000000000000000000000",
+			"00000000000000000000000000000000" +
+				"4db923dc793ee6497c76dcc03a98e108", "",
+			"f3f80f2cf0cb2dd9c5984fcda908456c" +
+				"c537703b5ba70324a6793a7bf218d3ea" +
+				"ffffffff000000000000000000000000",
+		},
+		{
+			zero + zero, "000000000000000000000000",
+			"eb3640277c7ffd1303c7a542d02d3e4c" +
+				"0000000000000000", "",
+			"18ce4f0b8cb4d0cac65fea8f79257b20" +
+				"888e53e72299e56dffffffff00000000" +
+				"0000000000000000",
+		},
+	}
+
+	for i, tt := range tests {
+		aead, err := newGCMSIV(mustHex(t, tt.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, plaintext := mustHex(t, tt.nonce), mustHex(t, tt.plaintext)
+		ad, expected := mustHex(t, tt.ad), mustHex(t, tt.result)
+
+		result := aead.Seal(nil, nonce, plaintext, ad)
+		if !bytes.Equal(result, expected) {
+			t.Errorf("Test %d: sealed %x, expected %x", i, result, expected)
+		}
+		opened, err := aead.Open(nil, nonce, expected, ad)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("Test %d: opened %x, expected %x: %v", i, opened,
+				plaintext, err)
+		}
+
+		expected[0] ^= 1
+		if _, err = aead.Open(nil, nonce, expected, ad); err == nil {
+			t.Errorf("Test %d: opened a modified ciphertext", i)
+		}
+		if _, err = aead.Open(nil, nonce[1:], expected, ad); err == nil {
+			t.Errorf("Test %d: opened with a short nonce", i)
+		}
+	}
+}
+
+// mustHex decodes the hex string.
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
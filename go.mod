@@ -9,9 +9,7 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/jwalterweatherman v1.1.0
 	golang.org/x/crypto v0.16.0
+	golang.org/x/sys v0.15.0
 )
 
-require (
-	github.com/stretchr/testify v1.8.2 // indirect
-	golang.org/x/sys v0.15.0 // indirect
-)
+require github.com/stretchr/testify v1.8.2 // indirect
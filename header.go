@@ -0,0 +1,438 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// header.go manages the .ekv file found at the root of every store. Stores
+// created before salted key derivation hold the string "version:1" encrypted
+// under a hash of the password. Newer stores hold a version 2 JSON header
+// along with a check value, the string "version:2" encrypted under the store
+// key, which is used to verify that the right key was recovered.
+//
+// In version 2 headers the store key is a random master key which the header
+// holds wrapped in one or more key slots or for recipients. The header also
+// holds a random store ID, which is bound to every value as associated data
+// along with its filename, the name salt mixed into every filename (see
+// keySchedule), the policies and features chosen when the store was created,
+// the format of the data in the store, which is moved forward by
+// [Filestore.Upgrade], and a protected copy of the header encrypted under the
+// store key (see format.go).
+//
+// Version:1 stores are opened as they are and moved to a version 2 header by
+// [Filestore.UpgradeKDF], which re-encrypts and renames every value. Headers
+// with a later version are refused with ErrNewerFormat.
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+const (
+	ekvFilename   = ".ekv"
+	legacyMarker  = "version:1"
+	headerVersion = 2
+	storeIDSize   = 16
+	errBadSecret  = "Cannot decrypt with password!"
+)
+
+// storeHeader is the contents of the .ekv file for stores using a salted key
+// derivation.
+type storeHeader struct {
+	Version int `json:"version"`
+	// Slots and Recipients hold the master key
+	Slots      []keySlot   `json:"slots,omitempty"`
+	Recipients []recipient `json:"recipients,omitempty"`
+	// StoreID is bound to every value
+	StoreID []byte `json:"storeID"`
+	// NameSalt is mixed into every filename
+	NameSalt []byte `json:"nameSalt"`
+	// Padding is the padding policy of every value. It is nil for stores
+	// that do not pad values.
+	Padding *Padding `json:"padding,omitempty"`
+	// Decoys is the decoy policy of the store. It is nil for stores without
+	// decoys.
+	Decoys *DecoyPolicy `json:"decoys,omitempty"`
+	// Cipher is the name of the cipher suite of the store. It is empty for
+	// stores using XChaCha20-Poly1305.
+	Cipher string `json:"cipher,omitempty"`
+	// Committing is set for stores whose ciphertexts start with a commitment
+	// to their key. It can only be chosen when the store is created.
+	Committing bool `json:"committing,omitempty"`
+	// Manifest is set for stores that keep a manifest of the version of
+	// every value. It can only be chosen when the store is created.
+	Manifest bool `json:"manifest,omitempty"`
+	// Compression is how the values of the store are compressed.
+	Compression Compression `json:"compression,omitempty"`
+	// Index is set for stores that keep an index of their keys.
+	Index bool `json:"index,omitempty"`
+	// EncryptedNames is set for stores whose filenames are an encryption of
+	// their key rather than a MAC. It can only be chosen when the store is
+	// created.
+	EncryptedNames bool `json:"encryptedNames,omitempty"`
+	// Format is the format of the data in the store.
+	Format int `json:"format"`
+	// Protected is the protected copy of the header, which also holds the
+	// metadata of the store.
+	Protected []byte `json:"protected"`
+	Check     []byte `json:"check"`
+
+	// metadata is the metadata held in the protected copy of the header
+	metadata map[string]string
+}
+
+// credential is what a store is opened with: either a password, which may be
+// the secret of any key slot, or the private key of a recipient.
+type credential struct {
+	password   []byte
+	privateKey []byte
+}
+
+// isIdentity returns true if the credential is the private key of a
+// recipient.
+func (c credential) isIdentity() bool {
+	return c.privateKey != nil
+}
+
+// unlock recovers the store key from the header using the credential.
+func (c credential) unlock(h *storeHeader) ([]byte, error) {
+	if c.isIdentity() {
+		return h.unlockRecipient(c.privateKey)
+	}
+	return h.unlock(c.password)
+}
+
+// newHeader creates a header for a new random master key held in a single key
+// slot opened by the password, using the KDF parameters, padding and decoy
+// policies, cipher suite, commitment, manifest, compression, key index,
+// filename encryption and metadata in the options. It returns the header and the master key.
+func newHeader(password []byte, opts Options,
+	csprng io.Reader) (*storeHeader, []byte, error) {
+	if err := opts.Padding.validate(); err != nil {
+		return nil, nil, err
+	}
+	if err := opts.Decoys.validate(); err != nil {
+		return nil, nil, err
+	}
+	if err := opts.Compression.validate(); err != nil {
+		return nil, nil, err
+	}
+	if opts.Index && opts.Decoys.Step != 0 {
+		return nil, nil, errors.New(errIndexDecoys)
+	}
+	if opts.EncryptedNames && opts.Decoys.Step != 0 {
+		return nil, nil, errors.New(errEncryptedNamesDecoys)
+	}
+	suite := XChaCha20Poly1305
+	if opts.Cipher != nil {
+		// Only known suites can be found again when the store is reopened
+		known, err := lookupCipherSuite(opts.Cipher.Name())
+		if err != nil {
+			return nil, nil, err
+		}
+		suite = known
+	}
+	cipherName := ""
+	if suite != XChaCha20Poly1305 {
+		cipherName = suite.Name()
+	}
+	if opts.Committing {
+		suite = committingSuite{suite}
+	}
+
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(csprng, key); err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate master key")
+	}
+
+	slot, err := newKeySlot(defaultSlotName, password, key, opts.KDF, suite,
+		csprng)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	storeID, err := newStoreID(csprng)
+	if err != nil {
+		return nil, nil, err
+	}
+	nameSalt, err := newNameSalt(csprng)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := &storeHeader{
+		Version:        headerVersion,
+		Slots:          []keySlot{slot},
+		StoreID:        storeID,
+		NameSalt:       nameSalt,
+		Cipher:         cipherName,
+		Committing:     opts.Committing,
+		Manifest:       opts.Manifest,
+		Compression:    opts.Compression,
+		Index:          opts.Index,
+		EncryptedNames: opts.EncryptedNames,
+		Format:         storeFormat,
+		metadata:       copyMetadata(opts.Metadata),
+	}
+	if opts.Padding.Scheme != NoPadding {
+		padding := opts.Padding
+		h.Padding = &padding
+	}
+	if opts.Decoys.Step != 0 {
+		decoys := opts.Decoys
+		h.Decoys = &decoys
+	}
+	if err = h.seal(key, csprng); err != nil {
+		return nil, nil, err
+	}
+	return h, key, nil
+}
+
+// newStoreID returns a random store ID.
+func newStoreID(csprng io.Reader) ([]byte, error) {
+	storeID := make([]byte, storeIDSize)
+	if _, err := io.ReadFull(csprng, storeID); err != nil {
+		return nil, errors.Wrap(err, "could not generate store ID")
+	}
+	return storeID, nil
+}
+
+// newNameSalt returns a random name salt.
+func newNameSalt(csprng io.Reader) ([]byte, error) {
+	nameSalt := make([]byte, saltSize)
+	if _, err := io.ReadFull(csprng, nameSalt); err != nil {
+		return nil, errors.Wrap(err, "could not generate name salt")
+	}
+	return nameSalt, nil
+}
+
+// cipherSuite returns the cipher suite of the store, made committing if the
+// store is. A nil header is a version:1 store, which uses XChaCha20-Poly1305.
+func (h *storeHeader) cipherSuite() CipherSuite {
+	if h == nil {
+		return XChaCha20Poly1305
+	}
+	// The name was checked when the header was validated
+	suite, err := lookupCipherSuite(h.Cipher)
+	if err != nil {
+		suite = XChaCha20Poly1305
+	}
+	if h.Committing {
+		return committingSuite{suite}
+	}
+	return suite
+}
+
+// marker returns the plaintext of the check value for the header version.
+func marker(version int) string {
+	return fmt.Sprintf("version:%d", version)
+}
+
+// clone returns a copy of the header that can be modified without affecting
+// the original.
+func (h *storeHeader) clone() *storeHeader {
+	c := *h
+	c.Slots = append([]keySlot(nil), h.Slots...)
+	c.Recipients = append([]recipient(nil), h.Recipients...)
+	return &c
+}
+
+// parseHeader decodes the contents of the .ekv file. It returns a nil header
+// for version:1 stores, whose .ekv file holds a bare ciphertext.
+func parseHeader(contents []byte) (*storeHeader, error) {
+	h := &storeHeader{}
+	if err := json.Unmarshal(contents, h); err != nil || h.Version == 0 {
+		return nil, nil
+	}
+
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// validate returns an error if the header cannot be used.
+func (h *storeHeader) validate() error {
+	if h.Version > headerVersion {
+		return errors.Wrapf(ErrNewerFormat, "store version %d, expected at "+
+			"most %d", h.Version, headerVersion)
+	}
+	if h.Format > storeFormat {
+		return errors.Wrapf(ErrNewerFormat, "store format %d, expected at "+
+			"most %d", h.Format, storeFormat)
+	}
+
+	if h.Version < headerVersion {
+		return errors.Errorf("invalid store version %d", h.Version)
+	}
+	if h.Protected == nil {
+		return errors.New("missing protected header")
+	}
+	if len(h.StoreID) != storeIDSize {
+		return errors.Errorf("invalid store ID length %d", len(h.StoreID))
+	}
+	if len(h.NameSalt) != saltSize {
+		return errors.Errorf("invalid name salt length %d", len(h.NameSalt))
+	}
+	if h.Padding != nil {
+		if err := h.Padding.validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := lookupCipherSuite(h.Cipher); err != nil {
+		return err
+	}
+	if err := h.Compression.validate(); err != nil {
+		return err
+	}
+	if h.Decoys != nil {
+		if h.Decoys.Step == 0 || h.Decoys.validate() != nil {
+			return errors.Errorf("invalid decoy step: %d", h.Decoys.Step)
+		}
+	}
+	if len(h.Slots)+len(h.Recipients) == 0 {
+		return errors.New("store has no key slots or recipients")
+	}
+	for _, slot := range h.Slots {
+		if err := slot.validate(); err != nil {
+			return errors.WithMessagef(err, "key slot %q", slot.Name)
+		}
+	}
+	for _, r := range h.Recipients {
+		if err := r.validate(); err != nil {
+			return errors.WithMessagef(err, "recipient %q", r.Name)
+		}
+	}
+	return nil
+}
+
+// unlock recovers the store key using the secret, which may open any of the
+// key slots, and verifies it against the check value in the header.
+func (h *storeHeader) unlock(secret []byte) ([]byte, error) {
+	_, key, err := h.findSlot(secret)
+	return key, err
+}
+
+// findSlot returns the index of the key slot opened by the secret and the
+// master key it holds.
+func (h *storeHeader) findSlot(secret []byte) (int, []byte, error) {
+	for i, slot := range h.Slots {
+		key, err := slot.unlock(secret, h.cipherSuite())
+		if err != nil {
+			continue
+		}
+		err = checkMarker(h.cipherSuite(), h.Check, key, marker(h.Version))
+		if err != nil {
+			zero(key)
+			return 0, nil, corrupt(err)
+		}
+		return i, key, nil
+	}
+	return 0, nil, errors.WithStack(ErrWrongPassword)
+}
+
+// checkMarker decrypts the ciphertext with the suite and verifies that it
+// holds the marker.
+func checkMarker(suite CipherSuite, ciphertext, key []byte,
+	marker string) error {
+	contents, err := decrypt(suite, ciphertext, key)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(contents, []byte(marker)) {
+		return errors.Errorf("Bad decryption: %s != %s", contents,
+			marker)
+	}
+	return nil
+}
+
+// loadHeader reads the .ekv file at path and unlocks it with the credential.
+// If the store does not exist, a new header is created for the password using
+// the options. The returned header is nil for version:1 stores.
+func loadHeader(path string, cred credential, opts Options, csprng io.Reader,
+	storage portable.Storage) (*storeHeader, []byte, error) {
+	contents, err := read(path, storage)
+	if !Exists(err) {
+		if cred.isIdentity() {
+			return nil, nil, errors.Errorf(errNoStore, path)
+		}
+		return newHeader(cred.password, opts, csprng)
+	} else if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	h, err := parseHeader(contents)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Stores created before salted key derivation only hold the marker
+	// encrypted under a hash of the password
+	if h == nil {
+		if cred.isIdentity() {
+			return nil, nil, errors.WithStack(ErrWrongPassword)
+		}
+		key := legacyKey(cred.password)
+		err = checkMarker(XChaCha20Poly1305, contents, key, legacyMarker)
+		if err != nil {
+			return nil, nil, errors.Wrap(ErrWrongPassword, err.Error())
+		}
+		return nil, key, nil
+	}
+
+	key, err := cred.unlock(h)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return h, key, nil
+}
+
+// writeHeader writes the header to the .ekv file at path. A nil header writes
+// the version:1 marker encrypted under the key.
+func writeHeader(path string, h *storeHeader, key []byte, csprng io.Reader,
+	storage portable.Storage) error {
+	if h == nil {
+		check, err := encrypt(XChaCha20Poly1305, []byte(legacyMarker), key,
+			csprng)
+		if err != nil {
+			return err
+		}
+		return write(path, check, storage)
+	}
+
+	contents, err := json.Marshal(h)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return write(path, contents, storage)
+}
+
+// verifyPassword returns an error if the password does not derive the key
+// currently in use by the store.
+func verifyPassword(h *storeHeader, key, password []byte) error {
+	var derived []byte
+	if h == nil {
+		derived = legacyKey(password)
+	} else {
+		var err error
+		if derived, err = h.unlock(password); err != nil {
+			return err
+		}
+	}
+	defer zero(derived)
+
+	if subtle.ConstantTimeCompare(derived, key) != 1 {
+		return errors.WithStack(ErrWrongPassword)
+	}
+	return nil
+}
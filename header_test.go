@@ -0,0 +1,93 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+)
+
+// TestHeader_RoundTrip creates a header, encodes it and checks that the
+// decoded header unlocks to the same key.
+func TestHeader_RoundTrip(t *testing.T) {
+	h, key, err := newHeader([]byte("password"), testOptions(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	contents, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := parseHeader(contents)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if decoded == nil {
+		t.Fatalf("Header decoded as a legacy store")
+	}
+
+	unlocked, err := decoded.unlock([]byte("password"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(key, unlocked) {
+		t.Errorf("Keys differ: %X != %X", key, unlocked)
+	}
+
+	if _, err = decoded.unlock([]byte("badpassword")); err == nil {
+		t.Errorf("Unlocked with a bad password")
+	}
+}
+
+// TestParseHeader_Legacy checks that the encrypted version:1 marker is
+// detected as a legacy store.
+func TestParseHeader_Legacy(t *testing.T) {
+	contents := mustEncrypt(t, XChaCha20Poly1305, []byte(legacyMarker),
+		legacyKey([]byte("password")))
+	h, err := parseHeader(contents)
+	if err != nil || h != nil {
+		t.Errorf("Legacy marker not detected: %+v, %+v", h, err)
+	}
+}
+
+// TestParseHeader_Invalid checks that unusable headers are rejected.
+func TestParseHeader_Invalid(t *testing.T) {
+	h, _, err := newHeader([]byte("password"), testOptions(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	future := h.clone()
+	future.Version = headerVersion + 1
+	noSlots := h.clone()
+	noSlots.Slots = nil
+	shortSalt := h.clone()
+	shortSalt.Slots[0].Salt = shortSalt.Slots[0].Salt[:4]
+	badKDF := h.clone()
+	badKDF.Slots[0].KDF.Threads = 0
+	older := h.clone()
+	older.Version = headerVersion - 1
+	noProtected := h.clone()
+	noProtected.Protected = nil
+	noNameSalt := h.clone()
+	noNameSalt.NameSalt = nil
+
+	for i, bad := range []*storeHeader{future, noSlots, shortSalt, badKDF,
+		older, noProtected, noNameSalt} {
+		contents, err := json.Marshal(bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = parseHeader(contents); err == nil {
+			t.Errorf("Invalid header %d accepted", i)
+		}
+	}
+}
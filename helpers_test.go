@@ -0,0 +1,60 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// testPassword is the password of the stores made by newTestStore.
+const testPassword = "password"
+
+// testKDFParams are the cheapest Argon2id parameters. Argon2id at its default
+// cost makes opening a store slow, so the tests create their stores with
+// these instead.
+var testKDFParams = KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+// testOptions returns the DefaultOptions with testKDFParams.
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.KDF = testKDFParams
+	return opts
+}
+
+// openTestStore opens the store in the directory of the storage with the
+// password, creating it with testOptions if it does not exist.
+func openTestStore(storage portable.Storage, dir,
+	password string) (*Filestore, error) {
+	return NewGenericFilestoreWithOptions(storage, dir, password, rand.Reader,
+		testOptions())
+}
+
+// newTestStore opens the store in "dir" of the storage with testPassword,
+// creating it with the options if there is none yet, and sets the values. A
+// nil storage is replaced with in-memory storage.
+func newTestStore(t *testing.T, storage portable.Storage, opts Options,
+	values map[string]string) *Filestore {
+	t.Helper()
+	if storage == nil {
+		storage = portable.UseKeyValue(newMemoryKV())
+	}
+	f, err := NewGenericFilestoreWithOptions(storage, "dir", testPassword,
+		rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for k, v := range values {
+		if err = f.SetBytes(k, []byte(v)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	return f
+}
@@ -0,0 +1,415 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// index.go keeps an encrypted index of the keys of stores created with
+// Options.Index, since filenames are a one-way hash of the key and cannot be
+// listed otherwise.
+//
+// The .ekv.index file holds every key of the store and is encrypted like a
+// value. A key is added to the index before its first value is written and
+// removed once its value is deleted, while holding the write lock of the key,
+// so the index always holds every key in the store, and at most a few more
+// keys if the store was interrupted in between. The index also records the
+// keys whose values were still being written when it was last written, and
+// only those are checked for a value when the store is opened, so that the
+// keys can then be listed from the index alone. Values written by
+// [Filestore.SetStream] are not listed.
+//
+// An index that is missing or cannot be decrypted, for instance because the
+// store was interrupted while being rekeyed, is marked as lost: the keys
+// written since are still added to it, but listing the keys returns
+// ErrIndexLost until [Filestore.RebuildIndex] is given the keys of the store.
+//
+// The size of the index reveals how many keys the store holds, so it cannot
+// be used along with decoys.
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+const indexFilename = ekvFilename + ".index"
+
+// ErrIndexLost is returned when listing the keys of a store whose index was
+// lost and must be rebuilt with [Filestore.RebuildIndex].
+var ErrIndexLost = errors.New("key index was lost and must be rebuilt")
+
+// errIndexDecoys is returned for stores that would have both a key index and
+// decoys.
+const errIndexDecoys = "a key index cannot be used along with decoys"
+
+// indexRecord is the contents of the .ekv.index file.
+type indexRecord struct {
+	Keys     []string `json:"keys"`
+	Pending  []string `json:"pending,omitempty"`
+	Complete bool     `json:"complete"`
+}
+
+// keyIndex holds the keys of a store. The index of the Filestore is nil for
+// stores without one.
+type keyIndex struct {
+	// mux guards keys, pending and complete, and is held while the index is
+	// written
+	mux  sync.Mutex
+	keys map[string]struct{}
+	// pending holds the keys added whose values may not be written yet
+	pending map[string]struct{}
+	// complete is false if the index was lost and not rebuilt since
+	complete bool
+}
+
+// newKeyIndex returns an empty index.
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		keys:    make(map[string]struct{}),
+		pending: make(map[string]struct{}),
+	}
+}
+
+// indexAdd adds the keys to the index before values are written to them,
+// writing the index once, and returns the keys that were not in it yet. They
+// are pending until passed to indexSettle or indexRemove. The caller must hold
+// the write locks of the keys.
+func (f *Filestore) indexAdd(keys ...string) ([]string, error) {
+	x := f.index
+	if x == nil {
+		return nil, nil
+	}
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	added := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := x.keys[key]; !ok {
+			x.keys[key] = struct{}{}
+			x.pending[key] = struct{}{}
+			added = append(added, key)
+		}
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+	if err := f.writeIndex(); err != nil {
+		for _, key := range added {
+			delete(x.keys, key)
+			delete(x.pending, key)
+		}
+		return nil, err
+	}
+	return added, nil
+}
+
+// indexSettle records that the values of keys returned by indexAdd were
+// written. The index is not written, so they stay pending on disk until the
+// next change to it. The caller must hold the write locks of the keys.
+func (f *Filestore) indexSettle(keys ...string) {
+	x := f.index
+	if x == nil {
+		return
+	}
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	for _, key := range keys {
+		delete(x.pending, key)
+	}
+}
+
+// indexRemove removes the keys from the index after their values were
+// deleted, writing the index once. The caller must hold the write locks of
+// the keys.
+func (f *Filestore) indexRemove(keys ...string) error {
+	x := f.index
+	if x == nil {
+		return nil
+	}
+	x.mux.Lock()
+	defer x.mux.Unlock()
+	removed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := x.keys[key]; ok {
+			delete(x.keys, key)
+			removed = append(removed, key)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := f.writeIndex(); err != nil {
+		for _, key := range removed {
+			x.keys[key] = struct{}{}
+		}
+		return err
+	}
+	for _, key := range removed {
+		delete(x.pending, key)
+	}
+	return nil
+}
+
+// writeIndex writes the index to the .ekv.index file. The caller must hold
+// the mutex of the index.
+func (f *Filestore) writeIndex() error {
+	x := f.index
+	record := indexRecord{
+		Keys:     make([]string, 0, len(x.keys)),
+		Complete: x.complete,
+	}
+	for key := range x.keys {
+		record.Keys = append(record.Keys, key)
+	}
+	sort.Strings(record.Keys)
+	for key := range x.pending {
+		record.Pending = append(record.Pending, key)
+	}
+	sort.Strings(record.Pending)
+	contents, err := json.Marshal(record)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	version := f.manifest.next(indexFilename)
+	contents, err = sealVersionedValue(f.header, f.keys.content,
+		indexFilename, version, contents, f.csprng)
+	if err != nil {
+		return err
+	}
+	if err = write(f.getPath(indexFilename), contents, f.storage); err != nil {
+		return errors.WithStack(err)
+	}
+	f.manifest.commit(indexFilename, version)
+	return nil
+}
+
+// saveIndex writes the index of a store with one.
+func (f *Filestore) saveIndex() error {
+	if f.index == nil {
+		return nil
+	}
+	f.index.mux.Lock()
+	defer f.index.mux.Unlock()
+	return f.writeIndex()
+}
+
+// loadIndex reads the index of a store created with one. A new index is
+// written for a store without any values.
+func (f *Filestore) loadIndex() error {
+	if f.header == nil || !f.header.Index {
+		return nil
+	}
+	x := newKeyIndex()
+
+	contents, err := read(f.getPath(indexFilename), f.storage)
+	if !Exists(err) {
+		empty, err := f.isEmpty()
+		if err != nil {
+			return err
+		}
+		f.index = x
+		if !empty {
+			jww.WARN.Printf("Key index of %s is missing", f.basedir)
+			return nil
+		}
+		x.complete = true
+		if err = f.saveIndex(); err != nil {
+			return err
+		}
+		return f.saveManifest()
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	plaintext, version, err := openVersionedValue(f.header, f.keys.content,
+		indexFilename, contents)
+	if err != nil {
+		jww.WARN.Printf("Key index of %s cannot be read: %+v", f.basedir, err)
+		f.index = x
+		return nil
+	}
+	if err = f.manifest.check(indexFilename, version); err != nil {
+		return err
+	}
+	record := indexRecord{}
+	if err = json.Unmarshal(plaintext, &record); err != nil {
+		return errors.Wrap(err, "invalid key index")
+	}
+	for _, key := range record.Keys {
+		x.keys[key] = struct{}{}
+	}
+	// Keys added just before the store was interrupted may have no value
+	for _, key := range record.Pending {
+		if !f.hasValue(f.keys.name(key)) {
+			delete(x.keys, key)
+		}
+	}
+	x.complete = record.Complete
+	f.index = x
+	return nil
+}
+
+// isEmpty returns true if the store directory holds no values.
+func (f *Filestore) isEmpty() (bool, error) {
+	names, err := portable.ReadDir(f.storage, f.basedir)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	for _, name := range names {
+		if stem, ok := splitPath(name); ok && !isInternal(stem) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// RebuildIndex replaces the index of the store with the keys, which must
+// include every key in the store; keys without a value are left out. An error
+// is returned if the directory holds values that none of the keys map to, as
+// for [Filestore.ChangePassword]. Stores without an index are given one.
+//
+// Every other operation on the store is blocked while the index is rebuilt.
+func (f *Filestore) RebuildIndex(keys ...string) error {
+	f.lockKeys()
+	defer f.unlockKeys()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+	if f.header == nil {
+		return errors.New(errNoKeySlots)
+	} else if f.decoys != nil {
+		return errors.New(errIndexDecoys)
+	}
+
+	known := make(map[string]struct{}, 2*len(keys))
+	for _, k := range append(streamKeys(keys), keys...) {
+		known[f.keys.name(k)] = struct{}{}
+	}
+	names, err := portable.ReadDir(f.storage, f.basedir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	unknown := make(map[string]struct{})
+	for _, name := range names {
+		stem, ok := splitPath(name)
+		if !ok || isInternal(stem) {
+			continue
+		}
+		if _, ok = known[stem]; !ok {
+			unknown[stem] = struct{}{}
+		}
+	}
+	if len(unknown) > 0 {
+		return errors.Errorf(errUnknownValues, len(unknown))
+	}
+
+	x := newKeyIndex()
+	x.complete = true
+	for _, k := range keys {
+		if f.hasValue(f.keys.name(k)) {
+			x.keys[k] = struct{}{}
+		}
+	}
+	old := f.index
+	f.index = x
+	if err = f.saveIndex(); err != nil {
+		f.index = old
+		return err
+	}
+	if err = f.saveManifest(); err != nil {
+		return err
+	}
+
+	if f.header.Index {
+		return nil
+	}
+	h := f.header.clone()
+	h.Index = true
+	if err = h.seal(f.key.bytes(), f.csprng); err != nil {
+		return err
+	}
+	return f.saveHeader(h)
+}
+
+// Keys returns every key in the store, sorted, per [KeyValue.Keys]. The keys
+// are listed from the filenames of stores with encrypted filenames and from
+// the index of stores with one. It returns an error for other stores, and
+// ErrIndexLost if the index must be rebuilt.
+func (f *Filestore) Keys() ([]string, error) {
+	return f.KeysWithPrefix("")
+}
+
+// KeysWithPrefix returns the sorted keys that start with the prefix per
+// [KeyValue.KeysWithPrefix].
+func (f *Filestore) KeysWithPrefix(prefix string) ([]string, error) {
+	keys, _, _, err := f.IterateKeys(prefix, "", 0)
+	return keys, err
+}
+
+// IterateKeys returns a page of the sorted keys that start with the prefix
+// per [KeyValue.IterateKeys].
+func (f *Filestore) IterateKeys(prefix, cursor string, limit int) ([]string,
+	string, bool, error) {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err := f.checkOpen(); err != nil {
+		return nil, "", false, err
+	}
+
+	var keys []string
+	x := f.index
+	if f.keys.names != nil {
+		var err error
+		if keys, err = f.nameKeys(prefix, cursor); err != nil {
+			return nil, "", false, err
+		}
+	} else if x == nil {
+		return nil, "", false, errors.New("store has no key index")
+	} else {
+		x.mux.Lock()
+		if !x.complete {
+			x.mux.Unlock()
+			return nil, "", false, errors.WithStack(ErrIndexLost)
+		}
+		keys = matchKeys(x.keys, prefix, cursor)
+		x.mux.Unlock()
+	}
+	keys, next, done := pageKeys(keys, limit)
+	return keys, next, done, nil
+}
+
+// matchKeys returns the sorted keys that start with the prefix, from the
+// cursor on.
+func matchKeys(keys map[string]struct{}, prefix, cursor string) []string {
+	matched := make([]string, 0, len(keys))
+	for key := range keys {
+		if matchKey(key, prefix, cursor) {
+			matched = append(matched, key)
+		}
+	}
+	sort.Strings(matched)
+	return matched
+}
+
+// matchKey returns true if the key starts with the prefix and does not come
+// before the cursor.
+func matchKey(key, prefix, cursor string) bool {
+	return strings.HasPrefix(key, prefix) && key >= cursor
+}
+
+// pageKeys returns up to limit of the sorted keys along with the cursor of
+// the next page, which is its first key, and whether there are no more keys.
+func pageKeys(keys []string, limit int) ([]string, string, bool) {
+	if limit <= 0 || len(keys) <= limit {
+		return keys, "", true
+	}
+	return keys[:limit], keys[limit], false
+}
@@ -0,0 +1,260 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// checkKeys checks that the store lists exactly the keys.
+func checkKeys(t *testing.T, kv KeyValue, expected ...string) {
+	t.Helper()
+	keys, err := kv.Keys()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(keys) != len(expected) ||
+		(len(keys) > 0 && !reflect.DeepEqual(keys, expected)) {
+		t.Errorf("Unexpected keys: %q, expected %q", keys, expected)
+	}
+}
+
+// testKeys lists the keys of a KeyValue with prefixes and pages.
+func testKeys(t *testing.T, kv KeyValue) {
+	for _, k := range []string{"b/2", "a", "b/1", "c", "b/3"} {
+		if err := kv.SetBytes(k, []byte(k)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := kv.Delete("c"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, kv, "a", "b/1", "b/2", "b/3")
+
+	keys, err := kv.KeysWithPrefix("b/")
+	if err != nil || !reflect.DeepEqual(keys, []string{"b/1", "b/2", "b/3"}) {
+		t.Errorf("Unexpected keys with prefix: %q, %+v", keys, err)
+	}
+
+	var pages [][]string
+	cursor, done := "", false
+	for !done {
+		var page []string
+		page, cursor, done, err = kv.IterateKeys("", cursor, 2)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		pages = append(pages, page)
+	}
+	expected := [][]string{{"a", "b/1"}, {"b/2", "b/3"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("Unexpected pages: %q, expected %q", pages, expected)
+	}
+
+	// Transactions update the index
+	err = kv.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Delete()
+		files["d"].Set([]byte("d"))
+		return nil
+	}, "a", "d")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, kv, "b/1", "b/2", "b/3", "d")
+}
+
+// TestFilestore_Keys lists the keys of a store with an index, before and
+// after reopening it.
+func TestFilestore_Keys(t *testing.T) {
+	kv := newMemoryKV()
+	opts := testOptions()
+	opts.Index = true
+	f := newTestStore(t, portable.UseKeyValue(kv), opts, nil)
+	checkKeys(t, f)
+	testKeys(t, f)
+
+	// Streams are not listed
+	if err := f.SetStream("e", strings.NewReader("stream")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, f, "b/1", "b/2", "b/3", "d")
+
+	f, err := openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, f, "b/1", "b/2", "b/3", "d")
+
+	f, err = openTestStore(portable.UseKeyValue(newMemoryKV()), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = f.Keys(); err == nil {
+		t.Errorf("Listed the keys of a store without an index")
+	}
+}
+
+// TestFilestore_Keys_Interrupted checks that keys added to the index without
+// a value, as when the store is interrupted, are not listed once the store is
+// reopened.
+func TestFilestore_Keys_Interrupted(t *testing.T) {
+	storage := portable.UseKeyValue(newMemoryKV())
+	opts := testOptions()
+	opts.Index = true
+	f := newTestStore(t, storage, opts, nil)
+	if err := f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := f.indexAdd("b", "c"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := f.SetBytes("c", []byte("3")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	f, err := openTestStore(storage, "dir", testPassword)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, f, "a", "c")
+	keys, next, done, err := f.IterateKeys("", "", 2)
+	if err != nil || len(keys) != 2 || next != "" || !done {
+		t.Errorf("Unexpected page: %q, %q, %t, %+v", keys, next, done, err)
+	}
+}
+
+// TestFilestore_Keys_FailedWrite fails the writes of values and checks that
+// only the keys that had no value before are taken out of the index again.
+func TestFilestore_Keys_FailedWrite(t *testing.T) {
+	storage := &flakyStorage{Storage: portable.UseKeyValue(newMemoryKV())}
+	opts := testOptions()
+	opts.Index = true
+	f := newTestStore(t, storage, opts, map[string]string{"a": "1"})
+
+	for _, key := range []string{"a", "b"} {
+		storage.failNext(f, key)
+		if err := f.SetBytes(key, []byte("2")); err == nil {
+			t.Fatalf("Write of %s did not fail", key)
+		}
+	}
+	storage.failNext(f, "c")
+	errs := f.SetMulti(map[string][]byte{"c": []byte("3"), "d": []byte("4")})
+	if len(errs) != 1 || errs["c"] == nil {
+		t.Fatalf("Unexpected errors: %+v", errs)
+	}
+
+	expected := map[string]struct{}{"a": {}, "d": {}}
+	if !reflect.DeepEqual(f.index.keys, expected) {
+		t.Errorf("Unexpected index: %v", f.index.keys)
+	}
+	f, err := openTestStore(storage, "dir", testPassword)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(f.index.keys, expected) {
+		t.Errorf("Unexpected index after reopening: %v", f.index.keys)
+	}
+	checkValues(t, f, map[string]string{"a": "1", "d": "4"})
+}
+
+// TestFilestore_RebuildIndex loses the index of a store and rebuilds it from
+// its keys.
+func TestFilestore_RebuildIndex(t *testing.T) {
+	kv := newMemoryKV()
+	storage := portable.UseKeyValue(kv)
+	opts := testOptions()
+	opts.Index = true
+	f := newTestStore(t, storage, opts, nil)
+	for _, k := range []string{"a", "b", "c"} {
+		if err := f.SetBytes(k, []byte(k)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	for _, suffix := range []string{".1", ".2"} {
+		_ = kv.Delete(f.getPath(indexFilename) + suffix)
+	}
+
+	f, err := openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("d", []byte("d")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = f.Keys(); !errors.Is(err, ErrIndexLost) {
+		t.Errorf("Unexpected error for a lost index: %v", err)
+	}
+
+	err = f.RebuildIndex("a", "b", "d")
+	if err == nil || err.Error() != fmt.Sprintf(errUnknownValues, 1) {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if err = f.RebuildIndex("a", "b", "c", "d", "e"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, f, "a", "b", "c", "d")
+
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, f, "a", "b", "c", "d")
+}
+
+// TestFilestore_RebuildIndex_Existing gives an index to a store created
+// without one and checks that it is kept when the store is reopened.
+func TestFilestore_RebuildIndex_Existing(t *testing.T) {
+	values := map[string]string{"a": "1", "b": "2"}
+	storage := newFaultyStorage()
+	f := newTestStore(t, storage, testOptions(), values)
+	if err := f.RebuildIndex("a", "b"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, f, "a", "b")
+
+	f, err := openTestStore(storage, "dir", testPassword)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !f.header.Index {
+		t.Errorf("Store has no index after reopening")
+	}
+	checkKeys(t, f, "a", "b")
+}
+
+// TestFilestore_Index_Decoys checks that stores cannot have both an index and
+// decoys.
+func TestFilestore_Index_Decoys(t *testing.T) {
+	opts := testOptions()
+	opts.Index = true
+	opts.Decoys = DecoyPolicy{Step: 4}
+	_, err := NewGenericFilestoreWithOptions(
+		portable.UseKeyValue(newMemoryKV()), "dir", "password", rand.Reader,
+		opts)
+	if err == nil || err.Error() != errIndexDecoys {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	opts.Index = false
+	f, err := NewGenericFilestoreWithOptions(
+		portable.UseKeyValue(newMemoryKV()), "dir", "password", rand.Reader,
+		opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.RebuildIndex(); err == nil || err.Error() != errIndexDecoys {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -8,9 +8,6 @@
 package ekv
 
 import (
-	"os"
-	"strings"
-
 	"github.com/pkg/errors"
 )
 
@@ -47,13 +44,52 @@ type KeyValue interface {
 	SetBytes(key string, data []byte) error
 	// GetBytes loads raw bytes.
 	GetBytes(key string) ([]byte, error)
+	// Has returns true if the key exists, without loading its value where
+	// possible. A value that exists but is damaged returns ErrCorrupt
+	// rather than false.
+	Has(key string) (bool, error)
+	// GetMulti loads the raw bytes of many keys at once. Keys that could
+	// not be loaded are left out of the values and given an error, which
+	// wraps ErrNotFound for keys that do not exist. The errors are nil if
+	// every key was loaded.
+	GetMulti(keys []string) (values map[string][]byte,
+		errs map[string]error)
+	// SetMulti stores the raw bytes of many keys at once, returning the
+	// errors of the keys that could not be stored, or nil. Unlike a
+	// transaction, it is not atomic.
+	SetMulti(values map[string][]byte) map[string]error
+	// DeleteMulti destroys many keys at once, returning the errors of the
+	// keys that could not be deleted, or nil. Unlike a transaction, it is
+	// not atomic.
+	DeleteMulti(keys []string) map[string]error
 	// Transaction locks a set of keys while they are being mutated and
 	// allows the function to operate on them exclusively.
 	// More keys can be added to the transaction, but they must only be operated
 	// on in conjunction with the previously locked keys otherwise deadlocks can
 	// occur
+	// The op must not start another transaction on the store; it adds keys
+	// through the Extender instead.
 	// If the op returns an error, the operation will be aborted.
 	Transaction(op TransactionOperation, keys ...string) error
+	// Keys returns every key in the store, sorted.
+	Keys() ([]string, error)
+	// KeysWithPrefix returns the sorted keys that start with the prefix.
+	KeysWithPrefix(prefix string) ([]string, error)
+	// IterateKeys returns up to limit sorted keys that start with the
+	// prefix, from the cursor on, along with the cursor of the next page.
+	// Done is true once there are no more keys, in which case next is
+	// empty. The empty cursor starts from the first key, and a limit of
+	// zero returns every key.
+	IterateKeys(prefix, cursor string, limit int) (keys []string,
+		next string, done bool, err error)
+	// Prefix returns a view of the store scoped to the namespace, whose
+	// keys never collide with those of other namespaces or of the store.
+	// Namespaces can be nested by calling Prefix on the view.
+	Prefix(ns string) KeyValue
+	// DeletePrefix deletes every key in the namespace, and in the
+	// namespaces nested in it, in a single transaction. Keys added to the
+	// namespace while it runs may be kept.
+	DeletePrefix(ns string) error
 }
 
 type TransactionOperation func(files map[string]Operable, ext Extender) error
@@ -63,20 +99,30 @@ type Operable interface {
 	// Key returns the key this interface is operating on
 	Key() string
 	// Exists returns if the file currently exists
-	// will panic if the current transaction isn't in scope
+	// if the current transaction isn't in scope, it returns false and the
+	// transaction fails with ErrClosed
 	Exists() bool
 	// Delete deletes the file at the key and destroy it.
-	// will panic if the current transaction isn't in scope
+	// if the current transaction isn't in scope, it does nothing and the
+	// transaction fails with ErrClosed
 	Delete()
 	// Set stores raw bytes.
-	// will panic if the current transaction isn't in scope
+	// if the current transaction isn't in scope, it does nothing and the
+	// transaction fails with ErrClosed
 	Set(data []byte)
 	// Get loads raw bytes.
-	// will panic if the current transaction isn't in scope
+	// if the current transaction isn't in scope, it returns nothing and the
+	// transaction fails with ErrClosed
 	Get() ([]byte, bool)
-	// Flush executes the operation and returns an error if the operation
-	// failed. It will set the operable to closed as well.
+	// Has returns if the file currently exists, like Exists, or ErrClosed
+	// if the current transaction isn't in scope
+	Has() (bool, error)
+	// Flush ends the operation on the key, setting the operable to closed.
+	// The writes and deletes of a transaction are committed together once
+	// its operation returns without an error, so that either all of them
+	// land or none do.
 	// if flush is not called, it will be called by the handler
+	// returns ErrClosed if the operable was already closed
 	Flush() error
 	// IsClosed returns true if the current transaction is in scope
 	// will always be true if inside the execution of the transaction
@@ -86,20 +132,16 @@ type Operable interface {
 type Extender interface {
 	// Extend can be used to add more keys to the current transaction
 	// if an error is returned, abort and return it
+	// returns ErrClosed once the transaction ended
 	Extend(keys []string) (map[string]Operable, error)
 	// IsClosed returns true if the current transaction is in scope
 	// will always be true if inside the execution of the transaction
 	IsClosed() bool
 }
 
-// Exists determines if the error message is known to report the key does not
-// exist. Returns true if the error does not specify or it is nil and false
-// otherwise.
+// Exists determines if the error reports that the key does not exist, which
+// is the case when it wraps ErrNotFound. Returns true if the error does not
+// specify or it is nil and false otherwise.
 func Exists(err error) bool {
-	if err == nil {
-		return true
-	}
-
-	return !(errors.Is(err, os.ErrNotExist) ||
-		strings.Contains(err.Error(), objectNotFoundErr))
+	return !errors.Is(err, ErrNotFound)
 }
@@ -44,7 +44,7 @@ func TestExists_Filestore(t *testing.T) {
 		}
 	}()
 
-	f, err := NewFilestore(dir, "Hello, World!")
+	f, err := openTestStore(portable.UsePosix(), dir, "Hello, World!")
 	if err != nil {
 		t.Fatalf("Failed to create filestore: %v", err)
 	}
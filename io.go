@@ -32,6 +32,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 	"gitlab.com/elixxir/ekv/portable"
@@ -50,9 +51,31 @@ const (
 	errCannotRead           = "Did not read the same data that was written!"
 	errIsDir                = "File path is a directory: %s"
 	errInvalidFile          = "Invalid file"
+	errRecordVersion        = "Record %s has version %d"
+	errRecordTooLarge       = "Record of %d bytes exceeds the limit of %d"
 	modMonCntrSize          = 1
+
+	// recordVersion is the layout of the records written by this version.
+	// It is held in the high bits of the first byte, above the counter, so
+	// records written before it was introduced read as version 0. Versions 0
+	// and 1 record the size in 4 bytes, version 2 in 8 bytes.
+	recordVersion      = 2
+	recordVersionShift = 4
+	modMonCntrMask     = 1<<recordVersionShift - 1
+	legacySizeLen      = 4
+	recordSizeLen      = 8
+	// legacySizeMask covers the bytes of the size that records written
+	// before version 2 actually held
+	legacySizeMask = 1<<24 - 1
 )
 
+// maxRecordSize is the largest record that is written. Every record is read
+// into memory whole.
+var maxRecordSize uint64 = 1 << 32
+
+// ErrValueTooLarge is returned when a value is too large to be stored.
+var ErrValueTooLarge = errors.New("value is too large")
+
 // getPaths returns "path.1" and "path.2"
 func getPaths(path string) (string, string) {
 	f1 := fmt.Sprintf("%s.1", path)
@@ -60,6 +83,17 @@ func getPaths(path string) (string, string) {
 	return f1, f2
 }
 
+// splitPath is the inverse of getPaths. It returns the path that a "path.1" or
+// "path.2" file belongs to, or false if the name is neither.
+func splitPath(name string) (string, bool) {
+	for _, suffix := range []string{".1", ".2"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+	return "", false
+}
+
 // compareModMonCntr returns 1 if t1 is newer, 2 if t2 is newer, and 0 if
 // there is an error. newer is defined as the second of 3 cases:
 // (0 < 1), (1 < 2), (2 < 0). Anything else is an error
@@ -99,25 +133,25 @@ func getFileOrder(path1, path2 string, storage portable.Storage) (portable.File,
 	if err1 == nil {
 		buf[0] = 3
 		_, err1 = file1.ReadAt(buf, 0)
-		t1 = buf[0]
+		t1 = buf[0] & modMonCntrMask
 	}
 	// Try to open and read file2
 	file2, err2 := storage.Open(path2)
 	if err2 == nil {
 		buf[0] = 3
 		_, err2 = file2.ReadAt(buf, 0)
-		t2 = buf[0]
+		t2 = buf[0] & modMonCntrMask
 	}
 
 	// If both files don't exist, return that
-	if os.IsNotExist(err1) && os.IsNotExist(err2) {
+	if errors.Is(err1, ErrNotFound) && errors.Is(err2, ErrNotFound) {
 		return nil, nil, err1
 	}
 
 	// Otherwise return composite error
 	if err1 != nil && err2 != nil {
-		return nil, nil, errors.Errorf(errNewestFile+", %s", err1,
-			err2)
+		return nil, nil, corrupt(errors.Errorf(errNewestFile+", %s", err1,
+			err2))
 	}
 
 	// Return file 2 or file 1 if one of them did not error out
@@ -137,17 +171,39 @@ func getFileOrder(path1, path2 string, storage portable.Storage) (portable.File,
 		return file2, file1, nil
 	}
 
-	return nil, nil, errors.Errorf(errModMonCntrInvalidVal, t1, t2)
+	file1.Close()
+	file2.Close()
+	return nil, nil, corrupt(errors.Errorf(errModMonCntrInvalidVal, t1, t2))
 }
 
 // readContents of a file, checking the checksum and returning the data.
 // this function assumes the file read header is at the beginning of the content
 // block
 func readContents(f portable.File) ([]byte, error) {
+	// Records written by newer versions may have a different layout
+	version := make([]byte, 1)
+	if _, err := f.ReadAt(version, 0); err != nil {
+		return nil, errors.Wrap(err, "error reading record version")
+	}
+	v := version[0] >> recordVersionShift
+	if v > recordVersion {
+		return nil, errors.Wrapf(ErrNewerFormat, errRecordVersion, f.Name(),
+			v)
+	}
+
+	// Every record fills its file, which bounds the size
+	fileSize, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading file size")
+	}
+
 	// Read the contents size
-	sizeBytes := make([]byte, 4)
-	_, _ = f.Seek(1, 0)
-	cnt, err := f.Read(sizeBytes)
+	sizeBytes := make([]byte, recordSizeLen)
+	if v < 2 {
+		sizeBytes = sizeBytes[:legacySizeLen]
+	}
+	_, _ = f.Seek(modMonCntrSize, io.SeekStart)
+	cnt, err := io.ReadFull(f, sizeBytes)
 	if err != nil {
 		return nil, errors.Wrap(err, "error reading size")
 	}
@@ -155,24 +211,39 @@ func readContents(f portable.File) ([]byte, error) {
 		return nil, errors.Errorf(errShortRead, f.Name(),
 			cnt, len(sizeBytes))
 	}
-	size := int(binary.LittleEndian.Uint32(sizeBytes))
-	if size <= 0 {
-		errors.Errorf(errInvalidSizeContents, size)
+	available := uint64(0)
+	if overhead := int64(modMonCntrSize + len(sizeBytes) +
+		blake2b.Size256); fileSize > overhead {
+		available = uint64(fileSize - overhead)
+	}
+	var size uint64
+	if v < 2 {
+		size = uint64(binary.LittleEndian.Uint32(sizeBytes))
+		// Older versions dropped the top byte of the size, so values of
+		// 16 MiB or more were recorded with a truncated size
+		if size != available && size == available&legacySizeMask {
+			size = available
+		}
+	} else {
+		size = binary.LittleEndian.Uint64(sizeBytes)
+	}
+	if size == 0 || size > available {
+		return nil, errors.Errorf(errInvalidSizeContents, size)
 	}
 
 	// Read the contents
 	contents := make([]byte, size)
-	cnt, err = f.Read(contents)
+	cnt, err = io.ReadFull(f, contents)
 	if err != nil {
 		return nil, errors.Wrap(err, "error reading contents")
 	}
-	if cnt != size {
+	if cnt != len(contents) {
 		return nil, errors.Errorf(errShortRead, f.Name(), cnt, size)
 	}
 
 	// Read checksum
 	checksumInFile := make([]byte, blake2b.Size256)
-	cnt, err = f.Read(checksumInFile)
+	cnt, err = io.ReadFull(f, checksumInFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "error reading checksum")
 	}
@@ -272,6 +343,10 @@ func write(path string, data []byte, storage portable.Storage) error {
 	if len(data) == 0 {
 		return errors.New(fmt.Sprintf(errInvalidSizeContents, 0))
 	}
+	if uint64(len(data)) > maxRecordSize {
+		return errors.Wrapf(ErrValueTooLarge, errRecordTooLarge, len(data),
+			maxRecordSize)
+	}
 	// First, check if either file can be read. Then write to the other one
 	path1, path2 := getPaths(path)
 	newest, oldest, _ := getFileOrder(path1, path2, storage)
@@ -295,7 +370,7 @@ func write(path string, data []byte, storage portable.Storage) error {
 		_, err := readContents(filesToRead[i])
 
 		if cnt == 1 && err == nil {
-			modMonCntr = buf[0]
+			modMonCntr = buf[0] & modMonCntrMask
 			filePathThatWasRead = filesToRead[i].Name()
 			break
 		}
@@ -312,20 +387,18 @@ func write(path string, data []byte, storage portable.Storage) error {
 
 	// Write the counter and contents of the file
 	modMonCntr = (modMonCntr + 1) % 3
-	// modMonCntrSize + 4 bytes to represent data len, len of data,
+	// modMonCntrSize + 8 bytes to represent data len, len of data,
 	// and 256 bit (32 byte) hash size
-	contents := make([]byte, 1+4+len(data)+32)
-	contents[0] = modMonCntr
+	contentStart := modMonCntrSize + recordSizeLen
+	contents := make([]byte, contentStart+len(data)+blake2b.Size256)
+	contents[0] = recordVersion<<recordVersionShift | modMonCntr
 
-	// Copy in the size
+	// Bytes 1:9 are the size
 	size := len(data)
-	sizeBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(sizeBytes, uint32(size))
-	// Bytes 1:4 are the size
-	copy(contents[1:4], sizeBytes)
+	binary.LittleEndian.PutUint64(contents[modMonCntrSize:contentStart],
+		uint64(size))
 
-	// Bytes 5 -> 5 + len(data) - 1 are the contents
-	contentStart := 5
+	// Bytes 9 -> 9 + len(data) - 1 are the contents
 	contentEnd := contentStart + size
 	copy(contents[contentStart:contentEnd], data)
 
@@ -395,8 +468,12 @@ func read(path string, storage portable.Storage) ([]byte, error) {
 		if filesToRead[i] == nil {
 			continue
 		}
-		contents, err := readContents(filesToRead[i])
-		if err != nil {
+		contents, readErr := readContents(filesToRead[i])
+		if errors.Is(readErr, ErrNewerFormat) {
+			return nil, readErr
+		} else if readErr != nil {
+			// Reported as corrupt if no other file can be read
+			err = corrupt(readErr)
 			continue
 		}
 		if len(contents) != 0 {
@@ -407,3 +484,39 @@ func read(path string, storage portable.Storage) ([]byte, error) {
 	// Read and return the contents
 	return nil, err
 }
+
+// upgradeRecord rewrites both files of the path in the current record layout,
+// keeping the newest contents, unless both already use it.
+func upgradeRecord(path string, storage portable.Storage) error {
+	path1, path2 := getPaths(path)
+	current := true
+	for _, p := range []string{path1, path2} {
+		f, err := storage.Open(p)
+		if err != nil {
+			continue
+		}
+		buf := make([]byte, 1)
+		if _, err = f.ReadAt(buf, 0); err == nil &&
+			buf[0]>>recordVersionShift < recordVersion {
+			current = false
+		}
+		f.Close()
+	}
+	if current {
+		return nil
+	}
+
+	contents, err := read(path, storage)
+	if !Exists(err) || (err == nil && len(contents) == 0) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	// Each write replaces the older of the two files
+	for i := 0; i < 2; i++ {
+		if err = write(path, contents, storage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
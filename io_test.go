@@ -8,9 +8,12 @@
 package ekv
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"testing"
 
+	"github.com/pkg/errors"
 	"gitlab.com/elixxir/ekv/portable"
 )
 
@@ -59,3 +62,88 @@ func TestZeroWrite(t *testing.T) {
 		t.Errorf("Unexpected error: %+v", err)
 	}
 }
+
+// legacyRecord converts a record to the layout written before record versions,
+// with a 4 byte size. If truncated is set, the top byte of the size is dropped
+// as it was by those versions.
+func legacyRecord(record []byte, truncated bool) []byte {
+	size := binary.LittleEndian.Uint64(record[modMonCntrSize:])
+	data := record[modMonCntrSize+recordSizeLen:]
+	legacy := make([]byte, modMonCntrSize+legacySizeLen, len(record))
+	legacy[0] = record[0] & modMonCntrMask
+	binary.LittleEndian.PutUint32(legacy[modMonCntrSize:], uint32(size))
+	if truncated {
+		legacy[modMonCntrSize+legacySizeLen-1] = 0
+	}
+	return append(legacy, data...)
+}
+
+// TestWrite_Large writes values around the 16 MiB boundary, where older
+// versions truncated the recorded size.
+func TestWrite_Large(t *testing.T) {
+	kv := newMemoryKV()
+	storage := portable.UseKeyValue(kv)
+	if err := storage.MkdirAll("dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{1<<24 - 1, 1 << 24, 1<<24 + 1, 17 << 20} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+		data[size-1] = 0xff
+		if err := write("dir/large", data, storage); err != nil {
+			t.Fatalf("%d: %+v", size, err)
+		}
+		contents, err := read("dir/large", storage)
+		if err != nil {
+			t.Fatalf("%d: %+v", size, err)
+		}
+		if !bytes.Equal(contents, data) {
+			t.Errorf("%d: read %d different bytes", size, len(contents))
+		}
+	}
+}
+
+// TestRead_Legacy reads records written before record versions, including
+// values of 16 MiB or more whose size was truncated.
+func TestRead_Legacy(t *testing.T) {
+	kv := newMemoryKV()
+	storage := portable.UseKeyValue(kv)
+	if err := storage.MkdirAll("dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{1, 1<<24 - 1, 1 << 24, 17 << 20} {
+		data := bytes.Repeat([]byte{0xaa}, size)
+		if err := write("dir/legacy", data, storage); err != nil {
+			t.Fatalf("%d: %+v", size, err)
+		}
+		_ = kv.Delete("dir/legacy.2")
+		record, _ := kv.Get("dir/legacy.1")
+		err := kv.Set("dir/legacy.1", legacyRecord(record, size >= 1<<24))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents, err := read("dir/legacy", storage)
+		if err != nil || !bytes.Equal(contents, data) {
+			t.Errorf("%d: read %d bytes: %+v", size, len(contents), err)
+		}
+		_ = kv.Delete("dir/legacy.1")
+	}
+}
+
+// TestWrite_TooLarge checks that records over the limit are rejected.
+func TestWrite_TooLarge(t *testing.T) {
+	defer func(limit uint64) { maxRecordSize = limit }(maxRecordSize)
+	maxRecordSize = 16
+
+	storage := portable.UseKeyValue(newMemoryKV())
+	if err := storage.MkdirAll("dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("dir/a", make([]byte, 16), storage); err != nil {
+		t.Errorf("Could not write a record at the limit: %+v", err)
+	}
+	err := write("dir/a", make([]byte, 17), storage)
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Unexpected error for a record over the limit: %v", err)
+	}
+}
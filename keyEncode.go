@@ -14,7 +14,16 @@ import (
 	"encoding/hex"
 )
 
+// maxNameSize is the size of the largest filename encodeKey encodes into at
+// most maxFilenameSize bytes along with the longest suffix.
+const maxNameSize = (maxFilenameSize - maxSuffixSize) / 2
+
 // encodeKey encodes a Filestore key using hex encoding.
 func encodeKey(key []byte) string {
 	return hex.EncodeToString(key)
 }
+
+// decodeKey is the inverse of encodeKey.
+func decodeKey(name string) ([]byte, error) {
+	return hex.DecodeString(name)
+}
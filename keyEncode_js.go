@@ -11,7 +11,17 @@ import (
 	"github.com/Max-Sum/base32768"
 )
 
+// maxNameSize is the size of the largest filename encodeKey encodes into at
+// most maxFilenameSize bytes along with the longest suffix. Each character
+// holds 15 bits and takes 3 bytes in UTF-8.
+const maxNameSize = (maxFilenameSize - maxSuffixSize) / 3 * 15 / 8
+
 // encodeKey encodes a Filestore key using base 32768 encoding.
 func encodeKey(key []byte) string {
 	return base32768.SafeEncoding.EncodeToString(key)
 }
+
+// decodeKey is the inverse of encodeKey.
+func decodeKey(name string) ([]byte, error) {
+	return base32768.SafeEncoding.DecodeString(name)
+}
@@ -0,0 +1,198 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultSlotName is the name of the key slot created for the password a
+	// store is created with.
+	defaultSlotName = "password"
+
+	errNoKeySlots    = "store does not use key slots, it must be upgraded first"
+	errSlotExists    = "key slot %q already exists"
+	errSlotNotFound  = "key slot %q does not exist"
+	errEmptySlotName = "key slot name cannot be empty"
+)
+
+// keySlot holds the master key of a store wrapped under a key derived from a
+// single credential, such as a password, a recovery code or a machine secret.
+type keySlot struct {
+	Name string    `json:"name"`
+	KDF  KDFParams `json:"kdf"`
+	Salt []byte    `json:"salt"`
+	Key  []byte    `json:"key"`
+}
+
+// KeySlotInfo describes a key slot of a Filestore without revealing any of its
+// key material.
+type KeySlotInfo struct {
+	// Name identifies the key slot.
+	Name string
+	// KDF are the Argon2id parameters used to derive the slot key from the
+	// secret.
+	KDF KDFParams
+}
+
+// newKeySlot wraps the master key with the suite under a key derived from the
+// secret with a random salt.
+func newKeySlot(name string, secret, masterKey []byte, params KDFParams,
+	suite CipherSuite, csprng io.Reader) (keySlot, error) {
+	if name == "" {
+		return keySlot{}, errors.New(errEmptySlotName)
+	}
+	if err := params.validate(); err != nil {
+		return keySlot{}, err
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(csprng, salt); err != nil {
+		return keySlot{}, errors.Wrap(err, "could not generate salt")
+	}
+
+	slotKey := deriveKey(secret, salt, params)
+	defer zero(slotKey)
+	wrapped, err := encrypt(suite, masterKey, slotKey, csprng)
+	if err != nil {
+		return keySlot{}, err
+	}
+	return keySlot{
+		Name: name,
+		KDF:  params,
+		Salt: salt,
+		Key:  wrapped,
+	}, nil
+}
+
+// unlock returns the master key if the secret opens the slot, which was
+// wrapped with the suite.
+func (s keySlot) unlock(secret []byte, suite CipherSuite) ([]byte, error) {
+	slotKey := deriveKey(secret, s.Salt, s.KDF)
+	defer zero(slotKey)
+	return decrypt(suite, s.Key, slotKey)
+}
+
+// validate returns an error if the slot cannot be used.
+func (s keySlot) validate() error {
+	if len(s.Salt) < saltSize {
+		return errors.Errorf("invalid salt length %d", len(s.Salt))
+	}
+	return s.KDF.validate()
+}
+
+// AddKeySlot adds a key slot that opens the store with the secret. The secret
+// can then be passed as the password to any of the constructors. Only the
+// header is rewritten; the values in the store are untouched.
+func (f *Filestore) AddKeySlot(name, secret string, params KDFParams) error {
+	secretBytes := []byte(secret)
+	defer zero(secretBytes)
+	return f.AddKeySlotBytes(name, secretBytes, params)
+}
+
+// AddKeySlotBytes is [Filestore.AddKeySlot] with the secret given as a byte
+// slice, so that it never has to be held in an immutable string. The store
+// does not keep or modify the slice, which the caller may zero as soon as this
+// returns.
+func (f *Filestore) AddKeySlotBytes(name string, secret []byte,
+	params KDFParams) error {
+	f.lockKeys()
+	defer f.unlockKeys()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+
+	if f.header == nil {
+		return errors.New(errNoKeySlots)
+	}
+	if f.findSlotByName(name) >= 0 {
+		return errors.Errorf(errSlotExists, name)
+	}
+
+	slot, err := newKeySlot(name, secret, f.key.bytes(), params,
+		f.header.cipherSuite(), f.csprng)
+	if err != nil {
+		return err
+	}
+
+	h := f.header.clone()
+	h.Slots = append(h.Slots, slot)
+	return f.saveHeader(h)
+}
+
+// RemoveKeySlot revokes the named key slot so that its secret no longer opens
+// the store. The last way to unlock the store, whether a key slot or a
+// recipient, cannot be removed. Only the header is rewritten; the values in
+// the store are untouched.
+//
+// Note that the master key does not change, so anyone who opened the store
+// with the revoked secret before may have kept it.
+func (f *Filestore) RemoveKeySlot(name string) error {
+	f.lockKeys()
+	defer f.unlockKeys()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+
+	if f.header == nil {
+		return errors.New(errNoKeySlots)
+	}
+	i := f.findSlotByName(name)
+	if i < 0 {
+		return errors.Errorf(errSlotNotFound, name)
+	}
+	if len(f.header.Slots)+len(f.header.Recipients) == 1 {
+		return errors.New(errLastUnlock)
+	}
+
+	h := f.header.clone()
+	h.Slots = append(h.Slots[:i], h.Slots[i+1:]...)
+	return f.saveHeader(h)
+}
+
+// ListKeySlots returns the key slots of the store. Stores that have not been
+// upgraded from version:1 have none.
+func (f *Filestore) ListKeySlots() []KeySlotInfo {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+
+	if f.header == nil {
+		return nil
+	}
+	slots := make([]KeySlotInfo, len(f.header.Slots))
+	for i, slot := range f.header.Slots {
+		slots[i] = KeySlotInfo{Name: slot.Name, KDF: slot.KDF}
+	}
+	return slots
+}
+
+// findSlotByName returns the index of the named key slot or -1 if there is
+// none. The caller must hold keyMux.
+func (f *Filestore) findSlotByName(name string) int {
+	for i, slot := range f.header.Slots {
+		if slot.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// saveHeader writes the header to the .ekv file and starts using it. The
+// caller must hold keyMux for writing.
+func (f *Filestore) saveHeader(h *storeHeader) error {
+	err := writeHeader(f.getPath(ekvFilename), h, f.key.bytes(), f.csprng,
+		f.storage)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	f.header = h
+	return nil
+}
@@ -0,0 +1,153 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// TestFilestore_KeySlots adds and removes key slots and checks which secrets
+// open the store.
+func TestFilestore_KeySlots(t *testing.T) {
+	kv := newMemoryKV()
+	values := map[string]string{"a": "1", "b": "2"}
+
+	f, err := openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for k, v := range values {
+		if err = f.SetBytes(k, []byte(v)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	before := snapshotValues(t, kv)
+
+	params := testKDFParams
+	if err = f.AddKeySlot("recovery", "recovery code", params); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.AddKeySlot("machine", "machine secret", params); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.AddKeySlot("recovery", "other", params); err == nil {
+		t.Errorf("Added a duplicate key slot")
+	}
+
+	slots := f.ListKeySlots()
+	if len(slots) != 3 || slots[0].Name != defaultSlotName ||
+		slots[1].Name != "recovery" || slots[2].Name != "machine" {
+		t.Errorf("Unexpected key slots: %+v", slots)
+	}
+
+	for _, secret := range []string{"password", "recovery code",
+		"machine secret"} {
+		f, err = openTestStore(portable.UseKeyValue(kv), "dir", secret)
+		if err != nil {
+			t.Fatalf("Could not open with %q: %+v", secret, err)
+		}
+		checkValues(t, f, values)
+	}
+
+	if err = f.RemoveKeySlot(defaultSlotName); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.RemoveKeySlot(defaultSlotName); err == nil {
+		t.Errorf("Removed a missing key slot")
+	}
+	if _, err = openTestStore(portable.UseKeyValue(kv), "dir", "password"); err == nil {
+		t.Errorf("Opened with a revoked secret")
+	}
+	if err = f.RemoveKeySlot("machine"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.RemoveKeySlot("recovery"); err == nil {
+		t.Errorf("Removed the last key slot")
+	}
+
+	f, err = openTestStore(portable.UseKeyValue(kv), "dir", "recovery code")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, values)
+
+	// None of the changes should have touched the values
+	after := snapshotValues(t, kv)
+	if len(before) != len(after) {
+		t.Fatalf("Values changed: %d != %d files", len(before), len(after))
+	}
+	for name, contents := range before {
+		if !bytes.Equal(contents, after[name]) {
+			t.Errorf("File %s was rewritten", name)
+		}
+	}
+}
+
+// TestFilestore_ChangePassword_KeySlot changes the password of a store with
+// key slots, which only rewraps the master key.
+func TestFilestore_ChangePassword_KeySlot(t *testing.T) {
+	kv := newMemoryKV()
+	f, err := openTestStore(portable.UseKeyValue(kv), "dir", "old")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.AddKeySlot("recovery", "code", testKDFParams); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	before := snapshotValues(t, kv)
+
+	if err = f.ChangePassword("bad", "new"); err == nil {
+		t.Errorf("Changed password with a bad password")
+	}
+	if err = f.ChangePassword("old", "new"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if _, err = openTestStore(portable.UseKeyValue(kv), "dir", "old"); err == nil {
+		t.Errorf("Opened with the old password")
+	}
+	for _, secret := range []string{"new", "code"} {
+		f, err = openTestStore(portable.UseKeyValue(kv), "dir", secret)
+		if err != nil {
+			t.Fatalf("Could not open with %q: %+v", secret, err)
+		}
+		checkValues(t, f, map[string]string{"a": "1"})
+	}
+	if slots := f.ListKeySlots(); slots[0].Name != defaultSlotName {
+		t.Errorf("Key slot was renamed: %+v", slots)
+	}
+
+	after := snapshotValues(t, kv)
+	for name, contents := range before {
+		if !bytes.Equal(contents, after[name]) {
+			t.Errorf("File %s was rewritten", name)
+		}
+	}
+}
+
+// snapshotValues returns the contents of every value file in the store.
+func snapshotValues(t *testing.T, kv *memoryKV) map[string][]byte {
+	t.Helper()
+	keys, err := kv.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, key := range keys {
+		if stem, ok := splitPath(key); ok && !isInternal(stem[len("dir/"):]) {
+			files[key], _ = kv.Get(key)
+		}
+	}
+	return files
+}
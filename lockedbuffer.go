@@ -0,0 +1,48 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// lockedBuffer holds key material. Where the platform allows it, the memory is
+// allocated outside of the Go heap, locked into RAM so it is never written to
+// swap and surrounded by inaccessible guard pages. Otherwise it falls back to
+// an ordinary slice. Either way, it is zeroed when destroyed.
+//
+// The buffer must not be used after it is destroyed.
+type lockedBuffer struct {
+	data []byte
+	// mem is the whole mapping holding data, including the guard pages. It
+	// is nil if data is an ordinary slice.
+	mem []byte
+}
+
+// lockBytes returns a locked buffer holding a copy of b and zeroes b.
+func lockBytes(b []byte) *lockedBuffer {
+	buf := newLockedBuffer(len(b))
+	copy(buf.data, b)
+	zero(b)
+	return buf
+}
+
+// bytes returns the key material held in the buffer.
+func (b *lockedBuffer) bytes() []byte {
+	return b.data
+}
+
+// destroy zeroes the buffer and releases its memory. It is safe to call more
+// than once and on a nil buffer.
+func (b *lockedBuffer) destroy() {
+	if b == nil || b.data == nil {
+		return
+	}
+	zero(b.data)
+	b.data = nil
+	if b.mem != nil {
+		freeLocked(b.mem)
+		b.mem = nil
+	}
+}
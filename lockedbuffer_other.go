@@ -0,0 +1,21 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// This file is only compiled for systems without mmap and mlock, such as
+// WebAssembly and Windows.
+//go:build !unix
+
+package ekv
+
+// newLockedBuffer returns an ordinary slice, as memory cannot be locked on
+// this platform. It is still zeroed when destroyed.
+func newLockedBuffer(size int) *lockedBuffer {
+	return &lockedBuffer{data: make([]byte, size)}
+}
+
+// freeLocked is never called on this platform.
+func freeLocked([]byte) {}
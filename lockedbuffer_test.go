@@ -0,0 +1,144 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// TestLockedBuffer checks that a locked buffer can be used up to both of its
+// ends, that it takes over the bytes it is made from and that destroying it
+// releases it.
+func TestLockedBuffer(t *testing.T) {
+	for _, size := range []int{0, 1, keySize, 4096, 5000} {
+		b := newLockedBuffer(size)
+		data := b.bytes()
+		if len(data) != size {
+			t.Errorf("Expected %d bytes, got %d", size, len(data))
+		}
+		for i := range data {
+			data[i] = 0xff
+		}
+		b.destroy()
+		if b.bytes() != nil {
+			t.Errorf("Buffer of %d bytes was not released", size)
+		}
+		b.destroy()
+	}
+
+	src := bytes.Repeat([]byte{1}, keySize)
+	b := lockBytes(src)
+	defer b.destroy()
+	if !bytes.Equal(b.bytes(), bytes.Repeat([]byte{1}, keySize)) {
+		t.Errorf("Buffer does not hold the source bytes: %x", b.bytes())
+	}
+	if !bytes.Equal(src, make([]byte, keySize)) {
+		t.Errorf("Source bytes were not zeroed: %x", src)
+	}
+
+	var nilBuffer *lockedBuffer
+	nilBuffer.destroy()
+}
+
+// TestFilestore_Close checks that closing a store releases its keys and that
+// a store opened with a byte slice password can be reopened with the same
+// password as a string.
+func TestFilestore_Close(t *testing.T) {
+	kv := newMemoryKV()
+	password := []byte("Hello, World!")
+	f, err := NewGenericFilestoreWithSecret(portable.UseKeyValue(kv), "dir",
+		password, rand.Reader, testOptions())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	keys := f.keys
+	f.Close()
+	if f.key != nil || f.keys != nil || keys.keys.bytes() != nil {
+		t.Errorf("Keys were not released")
+	}
+
+	f, err = openTestStore(portable.UseKeyValue(kv), "dir", "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"a": "1"})
+}
+
+// TestFilestore_SecretBytes checks that the functions taking secrets as byte
+// slices leave them as they were, for the caller to zero, and that the
+// secrets still open the store as strings.
+func TestFilestore_SecretBytes(t *testing.T) {
+	storage := portable.UseKeyValue(newMemoryKV())
+	checkUnchanged := func(name string, secret []byte, expected string) {
+		t.Helper()
+		if string(secret) != expected {
+			t.Errorf("%s was modified: %q", name, secret)
+		}
+	}
+
+	password := []byte(testPassword)
+	f, err := NewGenericFilestoreWithSecret(storage, "dir", password,
+		rand.Reader, testOptions())
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkUnchanged("Store password", password, testPassword)
+	if err = f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	secret := []byte("Slot Secret")
+	if err = f.AddKeySlotBytes("slot", secret, testKDFParams); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkUnchanged("Slot secret", secret, "Slot Secret")
+
+	oldSecret, newSecret := []byte(testPassword), []byte("New Password")
+	if err = f.ChangePasswordBytes(oldSecret, newSecret); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkUnchanged("Old password", oldSecret, testPassword)
+	checkUnchanged("New password", newSecret, "New Password")
+
+	params := testKDFParams
+	params.Time++
+	if err = f.UpgradeKDFBytes(newSecret, params); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkUnchanged("Password", newSecret, "New Password")
+
+	publicKey, privateKey, err := GenerateIdentity(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.AddRecipient("recipient", publicKey); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	identity := append([]byte{}, privateKey...)
+	f, err = NewFilestoreWithIdentity(storage, "dir", privateKey)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkUnchanged("Private key", privateKey, string(identity))
+	checkValues(t, f, map[string]string{"a": "1"})
+
+	for _, password := range []string{"Slot Secret", "New Password"} {
+		f, err = openTestStore(storage, "dir", password)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		checkValues(t, f, map[string]string{"a": "1"})
+	}
+}
@@ -0,0 +1,63 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// This file is only compiled for Unix systems.
+//go:build unix
+
+package ekv
+
+import (
+	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/sys/unix"
+)
+
+// newLockedBuffer maps size bytes between two guard pages and locks them into
+// RAM. The data is placed at the end of its pages so that overflowing it
+// faults on the guard page. Locking is best effort, as the amount of locked
+// memory is limited by RLIMIT_MEMLOCK; if it fails, the memory is still
+// guarded and zeroed when destroyed.
+func newLockedBuffer(size int) *lockedBuffer {
+	if size == 0 {
+		return &lockedBuffer{data: []byte{}}
+	}
+
+	pageSize := unix.Getpagesize()
+	dataSize := (size + pageSize - 1) / pageSize * pageSize
+	mem, err := unix.Mmap(-1, 0, dataSize+2*pageSize,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		jww.WARN.Printf("Could not map memory for keys, falling back to "+
+			"the heap: %+v", err)
+		return &lockedBuffer{data: make([]byte, size)}
+	}
+
+	inner := mem[pageSize : pageSize+dataSize]
+	if err = unix.Mprotect(mem[:pageSize], unix.PROT_NONE); err == nil {
+		err = unix.Mprotect(mem[pageSize+dataSize:], unix.PROT_NONE)
+	}
+	if err != nil {
+		jww.WARN.Printf("Could not protect guard pages: %+v", err)
+	}
+	if err = unix.Mlock(inner); err != nil {
+		jww.WARN.Printf("Could not lock memory for keys: %+v", err)
+	}
+
+	return &lockedBuffer{
+		data: inner[dataSize-size:],
+		mem:  mem,
+	}
+}
+
+// freeLocked unlocks and unmaps the memory of a locked buffer.
+func freeLocked(mem []byte) {
+	pageSize := unix.Getpagesize()
+	inner := mem[pageSize : len(mem)-pageSize]
+	_ = unix.Munlock(inner)
+	if err := unix.Munmap(mem); err != nil {
+		jww.WARN.Printf("Could not unmap memory for keys: %+v", err)
+	}
+}
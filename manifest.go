@@ -0,0 +1,503 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// manifest.go protects stores created with Options.Manifest against values
+// being rolled back, whether by an attacker putting back an older .1/.2 pair
+// or by read falling back to the older copy of a value.
+//
+// Every value of such a store holds a version, encrypted along with it, which
+// is one more than the version of the previous value written under the same
+// filename. The manifest holds the latest version of every filename along with
+// an epoch that is incremented by every change. Values older than the version
+// in the manifest are reported with ErrRollback. Deleted values keep their
+// version in the manifest, so that they cannot be brought back either.
+//
+// The manifest is kept in two files so that a write does not rewrite the
+// version of every value. The .ekv.manifest file holds every version and a
+// Merkle root over them as of some epoch, and the .ekv.manifest.delta file
+// holds the versions changed since then. The delta is folded back into the
+// .ekv.manifest file once it holds manifestDeltaSize filenames.
+//
+// Values are written before the manifest, so a value newer than the manifest
+// is accepted: it was written just before the store was interrupted. The
+// manifest files are themselves written as .1/.2 pairs, so an attacker who
+// damages their newest copy makes a reopened store fall back to the older
+// one, and a value rolled back to its version before the last change then
+// goes unnoticed. That, like a copy of the whole directory, can only be
+// detected against a state recorded outside of it, which is what
+// [Filestore.State] and [Filestore.CheckState] are for.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+const (
+	manifestFilename      = ekvFilename + ".manifest"
+	manifestDeltaFilename = manifestFilename + ".delta"
+
+	// manifestDeltaSize is the number of filenames in the delta at which it is
+	// folded back into the manifest.
+	manifestDeltaSize = 256
+)
+
+// ErrRollback is returned when a value or the store is older than the last
+// state committed to the manifest.
+var ErrRollback = errors.New("store was rolled back to an older state")
+
+// StoreState identifies a state committed to the manifest of a store.
+type StoreState struct {
+	// Epoch is incremented by every change to the store.
+	Epoch uint64 `json:"epoch"`
+	// Root is the Merkle root over the version of every value.
+	Root []byte `json:"root"`
+}
+
+// manifestEntry is the latest version written to a filename.
+type manifestEntry struct {
+	Version uint64 `json:"version"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// manifestRecord is the contents of the .ekv.manifest file.
+type manifestRecord struct {
+	Epoch   uint64                   `json:"epoch"`
+	Entries map[string]manifestEntry `json:"entries"`
+	Root    []byte                   `json:"root"`
+}
+
+// manifestDelta is the contents of the .ekv.manifest.delta file. It only
+// applies to the manifest written at the Base epoch.
+type manifestDelta struct {
+	Base    uint64                   `json:"base"`
+	Epoch   uint64                   `json:"epoch"`
+	Entries map[string]manifestEntry `json:"entries"`
+}
+
+// manifest holds the versions of the values of a store. The methods of a nil
+// manifest do nothing, which is the case for stores without one.
+type manifest struct {
+	// mux guards epoch, entries and changed
+	mux     sync.Mutex
+	epoch   uint64
+	entries map[string]manifestEntry
+	changed map[string]uint64 // epoch of the last change not in the base
+
+	// saveMux serializes saveManifest and guards saved, base and written
+	saveMux sync.Mutex
+	saved   uint64 // the last epoch written to disk
+	base    uint64 // the epoch of the .ekv.manifest file
+	written bool
+}
+
+// newManifest returns an empty manifest.
+func newManifest() *manifest {
+	return &manifest{
+		entries: make(map[string]manifestEntry),
+		changed: make(map[string]uint64),
+	}
+}
+
+// set changes the entry of the filename and increments the epoch. The caller
+// must hold mux.
+func (m *manifest) set(name string, entry manifestEntry) {
+	m.entries[name] = entry
+	m.epoch++
+	m.changed[name] = m.epoch
+}
+
+// next returns the version of the next value written to the filename. The
+// caller must hold the write lock of the filename.
+func (m *manifest) next(name string) uint64 {
+	if m == nil {
+		return 0
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.entries[name].Version + 1
+}
+
+// commit records the version written to the filename. The caller must hold
+// the write lock of the filename.
+func (m *manifest) commit(name string, version uint64) {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.set(name, manifestEntry{Version: version})
+}
+
+// remove records that the value under the filename was deleted. The caller
+// must hold the write lock of the filename.
+func (m *manifest) remove(name string) {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	entry, ok := m.entries[name]
+	if !ok || entry.Deleted {
+		return
+	}
+	m.set(name, manifestEntry{Version: entry.Version + 1, Deleted: true})
+}
+
+// lookup returns the entry of the filename and whether it has one, so that
+// it can be restored if a change to the value is undone.
+func (m *manifest) lookup(name string) (manifestEntry, bool) {
+	if m == nil {
+		return manifestEntry{}, false
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	entry, ok := m.entries[name]
+	return entry, ok
+}
+
+// restore puts back the entry of the filename returned by lookup after the
+// value was changed back. The caller must hold the write lock of the
+// filename.
+func (m *manifest) restore(name string, entry manifestEntry, ok bool) {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if ok {
+		m.set(name, entry)
+		return
+	}
+	delete(m.entries, name)
+	m.epoch++
+	m.changed[name] = m.epoch
+}
+
+// check returns ErrRollback if the version of the value read from the
+// filename is older than the one in the manifest.
+func (m *manifest) check(name string, version uint64) error {
+	if m == nil {
+		return nil
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	entry, ok := m.entries[name]
+	if ok && version < entry.Version {
+		return errors.Wrapf(ErrRollback, "value %s has version %d, "+
+			"expected %d", name, version, entry.Version)
+	}
+	return nil
+}
+
+// checkDeleted returns ErrRollback if the value under the filename was
+// deleted according to the manifest, for values that were found without
+// reading their version.
+func (m *manifest) checkDeleted(name string) error {
+	if m == nil {
+		return nil
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.entries[name].Deleted {
+		return errors.Wrapf(ErrRollback, "value %s was deleted", name)
+	}
+	return nil
+}
+
+// state returns the epoch and the Merkle root of the manifest.
+func (m *manifest) state() StoreState {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return StoreState{Epoch: m.epoch, Root: merkleRoot(m.entries)}
+}
+
+// merkleRoot returns the root of the Merkle tree whose leaves are the entries
+// sorted by filename. Nodes without a sibling are carried up unchanged.
+func merkleRoot(entries map[string]manifestEntry) []byte {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	level := make([][]byte, len(names))
+	for i, name := range names {
+		entry := entries[name]
+		leaf := make([]byte, 0, 1+len(name)+versionSize+1)
+		leaf = append(leaf, 0x00)
+		leaf = append(leaf, name...)
+		leaf = binary.BigEndian.AppendUint64(leaf, entry.Version)
+		if entry.Deleted {
+			leaf = append(leaf, 1)
+		} else {
+			leaf = append(leaf, 0)
+		}
+		sum := sha256.Sum256(leaf)
+		level[i] = sum[:]
+	}
+	if len(level) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			node := make([]byte, 0, 1+2*sha256.Size)
+			node = append(node, 0x01)
+			node = append(append(node, level[i]...), level[i+1]...)
+			sum := sha256.Sum256(node)
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// State returns the state of the store. Recording it outside the store
+// directory allows a later [Filestore.CheckState] to detect the whole
+// directory being rolled back. It returns an error for stores without a
+// manifest.
+func (f *Filestore) State() (StoreState, error) {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err := f.checkOpen(); err != nil {
+		return StoreState{}, err
+	}
+	if f.manifest == nil {
+		return StoreState{}, errors.New("store has no manifest")
+	}
+	if err := f.saveManifest(); err != nil {
+		return StoreState{}, err
+	}
+	return f.manifest.state(), nil
+}
+
+// CheckState returns ErrRollback if the store is older than the state, which
+// was returned by [Filestore.State], or has diverged from it.
+func (f *Filestore) CheckState(s StoreState) error {
+	current, err := f.State()
+	if err != nil {
+		return err
+	}
+	if current.Epoch < s.Epoch {
+		return errors.Wrapf(ErrRollback, "store is at epoch %d, expected "+
+			"at least %d", current.Epoch, s.Epoch)
+	}
+	if current.Epoch == s.Epoch && !bytes.Equal(current.Root, s.Root) {
+		return errors.Wrapf(ErrRollback, "store has diverged at epoch %d",
+			s.Epoch)
+	}
+	return nil
+}
+
+// saveManifest writes the manifest if it changed since it was last written.
+// Only the versions changed since the .ekv.manifest file was written go to
+// the delta, unless there are manifestDeltaSize of them, in which case the
+// whole manifest is written instead. Later calls always write a later state.
+func (f *Filestore) saveManifest() error {
+	m := f.manifest
+	if m == nil {
+		return nil
+	}
+	m.saveMux.Lock()
+	defer m.saveMux.Unlock()
+
+	m.mux.Lock()
+	epoch := m.epoch
+	if m.written && epoch == m.saved {
+		m.mux.Unlock()
+		return nil
+	}
+	compact := !m.written || len(m.changed) >= manifestDeltaSize
+	var record interface{}
+	if compact {
+		entries := make(map[string]manifestEntry, len(m.entries))
+		for name, entry := range m.entries {
+			entries[name] = entry
+		}
+		record = manifestRecord{
+			Epoch:   epoch,
+			Entries: entries,
+			Root:    merkleRoot(entries),
+		}
+	} else {
+		delta := manifestDelta{
+			Base:    m.base,
+			Epoch:   epoch,
+			Entries: make(map[string]manifestEntry, len(m.changed)),
+		}
+		for name := range m.changed {
+			// Names restored to no entry are written as version 0, which
+			// every value passes
+			delta.Entries[name] = m.entries[name]
+		}
+		record = delta
+	}
+	m.mux.Unlock()
+
+	if !compact {
+		err := f.writeManifest(manifestDeltaFilename, epoch, record)
+		if err != nil {
+			return err
+		}
+		m.saved = epoch
+		return nil
+	}
+	if err := f.writeManifest(manifestFilename, epoch, record); err != nil {
+		return err
+	}
+
+	// A new store starts with an empty delta, so that a missing delta is
+	// detected once the store has values
+	if !m.written {
+		err := f.writeManifest(manifestDeltaFilename, epoch, manifestDelta{
+			Base:    epoch,
+			Epoch:   epoch,
+			Entries: map[string]manifestEntry{},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	m.saved, m.written, m.base = epoch, true, epoch
+
+	// Changes made after the manifest was copied stay in the delta
+	m.mux.Lock()
+	for name, changed := range m.changed {
+		if changed <= epoch {
+			delete(m.changed, name)
+		}
+	}
+	m.mux.Unlock()
+	return nil
+}
+
+// writeManifest encrypts the record at the epoch and writes it to the named
+// manifest file.
+func (f *Filestore) writeManifest(name string, epoch uint64,
+	record interface{}) error {
+	contents, err := json.Marshal(record)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	contents, err = sealVersionedValue(f.header, f.keys.content, name, epoch,
+		contents, f.csprng)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(write(f.getPath(name), contents, f.storage))
+}
+
+// loadManifest reads the manifest of a store created with one, along with its
+// delta. A new manifest is written for a store without any values.
+func (f *Filestore) loadManifest() error {
+	if f.header == nil || !f.header.Manifest {
+		return nil
+	}
+	m := newManifest()
+
+	contents, err := read(f.getPath(manifestFilename), f.storage)
+	if !Exists(err) {
+		names, err := portable.ReadDir(f.storage, f.basedir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, name := range names {
+			if stem, ok := splitPath(name); ok && !isInternal(stem) {
+				return errors.Wrap(ErrRollback, "manifest is missing")
+			}
+		}
+		f.manifest = m
+		return f.saveManifest()
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	plaintext, epoch, err := openVersionedValue(f.header, f.keys.content,
+		manifestFilename, contents)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	record := manifestRecord{}
+	if err = json.Unmarshal(plaintext, &record); err != nil {
+		return errors.Wrap(err, "invalid manifest")
+	}
+	if record.Epoch != epoch || record.Entries == nil ||
+		!bytes.Equal(record.Root, merkleRoot(record.Entries)) {
+		return errors.New("invalid manifest")
+	}
+	m.epoch, m.entries = record.Epoch, record.Entries
+	m.base = record.Epoch
+
+	delta, err := f.loadManifestDelta()
+	if err != nil {
+		return err
+	}
+	switch {
+	case delta == nil:
+		return errors.Wrap(ErrRollback, "manifest delta is missing")
+	case delta.Base < record.Epoch:
+		// The delta was folded into the manifest
+	case delta.Base > record.Epoch:
+		return errors.Wrapf(ErrRollback, "manifest is at epoch %d, its "+
+			"delta expects %d", record.Epoch, delta.Base)
+	default:
+		for name, entry := range delta.Entries {
+			if entry == (manifestEntry{}) {
+				delete(m.entries, name)
+			} else {
+				m.entries[name] = entry
+			}
+			m.changed[name] = delta.Epoch
+		}
+		m.epoch = delta.Epoch
+	}
+
+	m.saved, m.written = m.epoch, true
+	f.manifest = m
+	return nil
+}
+
+// loadManifestDelta returns the contents of the .ekv.manifest.delta file, or
+// nil if there is none.
+func (f *Filestore) loadManifestDelta() (*manifestDelta, error) {
+	contents, err := read(f.getPath(manifestDeltaFilename), f.storage)
+	if !Exists(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	plaintext, epoch, err := openVersionedValue(f.header, f.keys.content,
+		manifestDeltaFilename, contents)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	delta := &manifestDelta{}
+	if err = json.Unmarshal(plaintext, delta); err != nil {
+		return nil, errors.Wrap(err, "invalid manifest delta")
+	}
+	if delta.Epoch != epoch || delta.Epoch < delta.Base ||
+		delta.Entries == nil {
+		return nil, errors.New("invalid manifest delta")
+	}
+	return delta, nil
+}
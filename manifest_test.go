@@ -0,0 +1,322 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// snapshotKV returns a copy of every file in the kv.
+func snapshotKV(t *testing.T, kv *memoryKV) map[string][]byte {
+	t.Helper()
+	keys, err := kv.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		contents, _ := kv.Get(key)
+		files[key] = append([]byte(nil), contents...)
+	}
+	return files
+}
+
+// restoreKV puts back the files of the snapshot whose names have the prefix
+// and removes those that were not in it.
+func restoreKV(t *testing.T, kv *memoryKV, files map[string][]byte,
+	prefix string) {
+	t.Helper()
+	keys, err := kv.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, ok := files[key]; !ok && strings.HasPrefix(key, prefix) {
+			if err = kv.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for key, contents := range files {
+		if strings.HasPrefix(key, prefix) {
+			if err = kv.Set(key, contents); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestFilestore_Manifest_Rollback puts back older copies of values and checks
+// that they are reported with ErrRollback.
+func TestFilestore_Manifest_Rollback(t *testing.T) {
+	kv := newMemoryKV()
+	opts := testOptions()
+	opts.Manifest = true
+	f := newTestStore(t, portable.UseKeyValue(kv), opts, nil)
+
+	for _, v := range []string{"1", "2"} {
+		if err := f.SetBytes("a", []byte(v)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := f.SetBytes("b", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	old := snapshotKV(t, kv)
+	if err := f.SetBytes("a", []byte("3")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := f.SetBytes("a", []byte("4")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := f.Delete("b"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	restoreKV(t, kv, old, f.getKey("a"))
+	restoreKV(t, kv, old, f.getKey("b"))
+	for _, k := range []string{"a", "b"} {
+		if _, err := f.GetBytes(k); !errors.Is(err, ErrRollback) {
+			t.Errorf("Unexpected error reading %s: %v", k, err)
+		}
+	}
+	err := f.Transaction(func(map[string]Operable, Extender) error {
+		return nil
+	}, "a")
+	if !errors.Is(err, ErrRollback) {
+		t.Errorf("Unexpected error from a transaction: %v", err)
+	}
+
+	// The versions are kept when the store is reopened
+	f, err = openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = f.GetBytes("a"); !errors.Is(err, ErrRollback) {
+		t.Errorf("Unexpected error after reopening: %v", err)
+	}
+
+	// Newer values can still be written and read
+	if err = f.SetBytes("a", []byte("5")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"a": "5"})
+}
+
+// TestFilestore_Manifest_OlderCopy damages each copy of a value in turn and
+// checks that the older copy is never returned in its place.
+func TestFilestore_Manifest_OlderCopy(t *testing.T) {
+	kv := newMemoryKV()
+	opts := testOptions()
+	opts.Manifest = true
+	f := newTestStore(t, portable.UseKeyValue(kv), opts, nil)
+	for _, v := range []string{"1", "2", "3"} {
+		if err := f.SetBytes("a", []byte(v)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	rolledBack := false
+	for _, suffix := range []string{".1", ".2"} {
+		path := f.getKey("a") + suffix
+		contents, err := kv.Get(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		damaged := append([]byte(nil), contents...)
+		damaged[len(damaged)-1] ^= 1
+		if err = kv.Set(path, damaged); err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := f.GetBytes("a")
+		if errors.Is(err, ErrRollback) {
+			rolledBack = true
+		} else if err == nil && string(value) != "3" {
+			t.Errorf("Read stale value %q", value)
+		}
+		if err = kv.Set(path, contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !rolledBack {
+		t.Errorf("Falling back to the older copy was not detected")
+	}
+}
+
+// TestFilestore_CheckState puts back a copy of the whole directory and checks
+// that it is detected against the state recorded before.
+func TestFilestore_CheckState(t *testing.T) {
+	kv := newMemoryKV()
+	opts := testOptions()
+	opts.Manifest = true
+	f := newTestStore(t, portable.UseKeyValue(kv), opts, nil)
+	if err := f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	old := snapshotKV(t, kv)
+	oldState, err := f.State()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err = f.SetBytes("a", []byte("2")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	state, err := f.State()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if state.Epoch <= oldState.Epoch {
+		t.Errorf("Epoch did not increase: %d <= %d", state.Epoch,
+			oldState.Epoch)
+	}
+	if err = f.CheckState(oldState); err != nil {
+		t.Errorf("Newer store failed the check: %+v", err)
+	}
+	if err = f.CheckState(state); err != nil {
+		t.Errorf("Store failed its own state: %+v", err)
+	}
+
+	restoreKV(t, kv, old, "dir")
+	f, err = openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"a": "1"})
+	if err = f.CheckState(state); !errors.Is(err, ErrRollback) {
+		t.Errorf("Unexpected error for a rolled back store: %v", err)
+	}
+
+	// A store that diverged from the state at the same epoch
+	if err = f.SetBytes("b", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.CheckState(state); !errors.Is(err, ErrRollback) {
+		t.Errorf("Unexpected error for a diverged store: %v", err)
+	}
+
+	f, err = openTestStore(portable.UseKeyValue(newMemoryKV()), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = f.State(); err == nil {
+		t.Errorf("Got the state of a store without a manifest")
+	}
+}
+
+// TestFilestore_Manifest_Missing checks that a store with values cannot be
+// opened without its manifest.
+func TestFilestore_Manifest_Missing(t *testing.T) {
+	kv := newMemoryKV()
+	opts := testOptions()
+	opts.Manifest = true
+	f := newTestStore(t, portable.UseKeyValue(kv), opts, nil)
+	if err := f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, suffix := range []string{".1", ".2"} {
+		_ = kv.Delete(f.getPath(manifestFilename) + suffix)
+	}
+
+	_, err := openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if !errors.Is(err, ErrRollback) {
+		t.Errorf("Unexpected error without a manifest: %v", err)
+	}
+}
+
+// TestFilestore_Manifest_Delta checks that writes only change the delta until
+// it is folded back into the manifest, and that the versions survive both.
+func TestFilestore_Manifest_Delta(t *testing.T) {
+	kv := newMemoryKV()
+	opts := testOptions()
+	opts.Manifest = true
+	f := newTestStore(t, portable.UseKeyValue(kv), opts, nil)
+	manifestPath := f.getPath(manifestFilename)
+	before := snapshotKV(t, kv)
+
+	values := make(map[string]string, manifestDeltaSize)
+	for i := 0; i < manifestDeltaSize-1; i++ {
+		k := strconv.Itoa(i)
+		values[k] = k
+		if err := f.SetBytes(k, []byte(k)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	for _, suffix := range []string{".1", ".2"} {
+		contents, _ := kv.Get(manifestPath + suffix)
+		if string(contents) != string(before[manifestPath+suffix]) {
+			t.Errorf("Manifest was rewritten by a write")
+		}
+	}
+	old := snapshotKV(t, kv)
+	if err := f.SetBytes("0", []byte("new")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	values["0"] = "new"
+
+	// The next write folds the delta into the manifest
+	values["last"] = "last"
+	if err := f.SetBytes("last", []byte("last")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	contents, _ := kv.Get(manifestPath + ".2")
+	if string(contents) == string(before[manifestPath+".2"]) {
+		t.Errorf("Delta was not folded into the manifest")
+	}
+
+	f, err := openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, values)
+	restoreKV(t, kv, old, f.getKey("0"))
+	if _, err = f.GetBytes("0"); !errors.Is(err, ErrRollback) {
+		t.Errorf("Unexpected error after folding the delta: %v", err)
+	}
+
+	// A store whose delta is gone does not open
+	for _, suffix := range []string{".1", ".2"} {
+		_ = kv.Delete(f.getPath(manifestDeltaFilename) + suffix)
+	}
+	_, err = openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if !errors.Is(err, ErrRollback) {
+		t.Errorf("Unexpected error without a delta: %v", err)
+	}
+}
+
+// TestMerkleRoot checks that the root depends on every entry.
+func TestMerkleRoot(t *testing.T) {
+	entries := map[string]manifestEntry{
+		"a": {Version: 1}, "b": {Version: 2}, "c": {Version: 3},
+	}
+	root := merkleRoot(entries)
+	for name, entry := range entries {
+		for _, changed := range []manifestEntry{
+			{Version: entry.Version + 1},
+			{Version: entry.Version, Deleted: true},
+		} {
+			entries[name] = changed
+			if string(merkleRoot(entries)) == string(root) {
+				t.Errorf("Root did not change with %s: %+v", name, changed)
+			}
+		}
+		entries[name] = entry
+	}
+	if string(merkleRoot(entries)) != string(root) {
+		t.Errorf("Root is not deterministic")
+	}
+	if len(merkleRoot(nil)) != 32 {
+		t.Errorf("Unexpected root of an empty manifest")
+	}
+}
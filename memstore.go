@@ -10,6 +10,7 @@ package ekv
 import (
 	"encoding/json"
 	jww "github.com/spf13/jwalterweatherman"
+	"sort"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -92,12 +93,97 @@ func (m *Memstore) GetBytes(key string) ([]byte, error) {
 	defer m.mux.Unlock()
 	data, ok := m.store[key]
 	if !ok {
-		return nil, errors.New(objectNotFoundErr)
+		return nil, errors.WithMessage(ErrNotFound, objectNotFoundErr)
 	}
 
 	return data, nil
 }
 
+// Has implements [KeyValue.Has]
+func (m *Memstore) Has(key string) (bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	_, ok := m.store[key]
+	return ok, nil
+}
+
+// GetMulti implements [KeyValue.GetMulti]
+func (m *Memstore) GetMulti(keys []string) (map[string][]byte,
+	map[string]error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	values := make(map[string][]byte, len(keys))
+	var errs map[string]error
+	for _, key := range keys {
+		if data, ok := m.store[key]; ok {
+			values[key] = data
+			continue
+		}
+		if errs == nil {
+			errs = make(map[string]error)
+		}
+		errs[key] = errors.WithMessage(ErrNotFound, objectNotFoundErr)
+	}
+	return values, errs
+}
+
+// SetMulti implements [KeyValue.SetMulti]
+func (m *Memstore) SetMulti(values map[string][]byte) map[string]error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for key, data := range values {
+		m.store[key] = data
+	}
+	return nil
+}
+
+// DeleteMulti implements [KeyValue.DeleteMulti]
+func (m *Memstore) DeleteMulti(keys []string) map[string]error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, key := range keys {
+		delete(m.store, key)
+	}
+	return nil
+}
+
+// Keys implements [KeyValue.Keys]
+func (m *Memstore) Keys() ([]string, error) {
+	return m.KeysWithPrefix("")
+}
+
+// KeysWithPrefix implements [KeyValue.KeysWithPrefix]
+func (m *Memstore) KeysWithPrefix(prefix string) ([]string, error) {
+	keys, _, _, err := m.IterateKeys(prefix, "", 0)
+	return keys, err
+}
+
+// IterateKeys implements [KeyValue.IterateKeys]
+func (m *Memstore) IterateKeys(prefix, cursor string, limit int) ([]string,
+	string, bool, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	keys := make([]string, 0, len(m.store))
+	for key := range m.store {
+		if matchKey(key, prefix, cursor) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	keys, next, done := pageKeys(keys, limit)
+	return keys, next, done, nil
+}
+
+// Prefix implements [KeyValue.Prefix]
+func (m *Memstore) Prefix(ns string) KeyValue {
+	return newPrefixKV(m, ns)
+}
+
+// DeletePrefix implements [KeyValue.DeletePrefix]
+func (m *Memstore) DeletePrefix(ns string) error {
+	return deletePrefix(m, namespacePrefix(ns))
+}
+
 // Transaction implements [KeyValue.Transaction]
 func (m *Memstore) Transaction(op TransactionOperation, keys ...string) error {
 	m.mux.Lock()
@@ -114,6 +200,9 @@ func (m *Memstore) Transaction(op TransactionOperation, keys ...string) error {
 	}
 
 	err = op(operables, e)
+	if err == nil {
+		err = e.err
+	}
 	if err != nil {
 		return err
 	}
@@ -126,11 +215,15 @@ type extendableMem struct {
 	closed    bool
 	mem       *Memstore
 	operables []map[string]Operable
+
+	// err is the first misuse of a closed operable, which fails the
+	// transaction
+	err error
 }
 
 func (e *extendableMem) Extend(keys []string) (map[string]Operable, error) {
 	if e.closed {
-		jww.FATAL.Panicf("Cannot extend, transaction already closed")
+		return nil, errors.Wrap(ErrClosed, "cannot extend transaction")
 	}
 	operables := make(map[string]Operable, len(keys))
 
@@ -140,7 +233,7 @@ func (e *extendableMem) Extend(keys []string) (map[string]Operable, error) {
 			key:    key,
 			closed: false,
 			op:     readOp,
-			mem:    e.mem,
+			e:      e,
 		}
 	}
 
@@ -157,14 +250,18 @@ func (e *extendableMem) IsClosed() bool {
 	return e.closed
 }
 
+// flush commits the writes and deletes of every operable of the transaction,
+// closing the operables.
 func (e *extendableMem) flush() {
 	for _, opMap := range e.operables {
 		for _, oper := range opMap {
-			if !oper.IsClosed() {
-				if err := oper.Flush(); err != nil {
-					jww.FATAL.Panicf("Failed on a flush of key %s in "+
-						"transaction: %+v", oper.Key(), err)
-				}
+			operInternal := oper.(*operableMem)
+			operInternal.closed = true
+			switch operInternal.op {
+			case writeOp:
+				e.mem.store[operInternal.key] = operInternal.data
+			case deleteOp:
+				delete(e.mem.store, operInternal.key)
 			}
 		}
 	}
@@ -174,6 +271,16 @@ func (e *extendableMem) close() {
 	e.closed = true
 }
 
+// misuse records the use of a closed operable of the transaction, which then
+// fails with the error. Once the transaction ended, the misuse is only logged.
+func (e *extendableMem) misuse(err error) {
+	if e.closed {
+		jww.ERROR.Printf("%+v", err)
+	} else if e.err == nil {
+		e.err = err
+	}
+}
+
 type operableMem struct {
 	key    string
 	closed bool
@@ -183,7 +290,7 @@ type operableMem struct {
 
 	op OperableOps
 
-	mem *Memstore
+	e *extendableMem
 }
 
 func (op *operableMem) Key() string {
@@ -192,12 +299,23 @@ func (op *operableMem) Key() string {
 }
 
 func (op *operableMem) Exists() bool {
-	op.testClosed("Exists()")
+	if op.testClosed("Exists()") {
+		return false
+	}
 	return op.exists
 }
 
+func (op *operableMem) Has() (bool, error) {
+	if op.closed {
+		return false, errors.Wrapf(ErrClosed, "cannot check %s", op.key)
+	}
+	return op.exists, nil
+}
+
 func (op *operableMem) Delete() {
-	op.testClosed("Delete()")
+	if op.testClosed("Delete()") {
+		return
+	}
 
 	op.data = nil
 	op.exists = false
@@ -205,7 +323,9 @@ func (op *operableMem) Delete() {
 }
 
 func (op *operableMem) Set(data []byte) {
-	op.testClosed("Set()")
+	if op.testClosed("Set()") {
+		return
+	}
 
 	op.data = data
 	op.exists = true
@@ -213,23 +333,19 @@ func (op *operableMem) Set(data []byte) {
 }
 
 func (op *operableMem) Get() ([]byte, bool) {
-	op.testClosed("Get()")
+	if op.testClosed("Get()") {
+		return nil, false
+	}
 	return op.data, op.exists
 }
 
+// Flush closes the operable. Its write or delete is committed along with the
+// rest of the transaction once the operation returns.
 func (op *operableMem) Flush() error {
-	op.testClosed("Flush()")
-	defer func() {
-		op.closed = true
-	}()
-	switch op.op {
-	case readOp:
-		return nil
-	case writeOp:
-		op.mem.store[op.key] = op.data
-	case deleteOp:
-		delete(op.mem.store, op.key)
+	if op.closed {
+		return errors.Wrapf(ErrClosed, "cannot flush %s", op.key)
 	}
+	op.closed = true
 	return nil
 }
 
@@ -237,8 +353,13 @@ func (op *operableMem) IsClosed() bool {
 	return op.closed
 }
 
-func (op *operableMem) testClosed(action string) {
-	if op.closed {
-		jww.FATAL.Panicf("Cannot '%s' on '%s', already closed", action, op.key)
+// testClosed reports whether the operable is closed, in which case the action
+// is not taken and fails the transaction with ErrClosed.
+func (op *operableMem) testClosed(action string) bool {
+	if !op.closed {
+		return false
 	}
+	op.e.misuse(errors.Wrapf(ErrClosed, "cannot '%s' on '%s'", action,
+		op.key))
+	return true
 }
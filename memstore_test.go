@@ -105,3 +105,18 @@ func TestMemstore_Multiset(t *testing.T) {
 		}
 	}
 }
+
+// TestMemstore_Keys lists the keys of a Memstore with prefixes and pages.
+func TestMemstore_Keys(t *testing.T) {
+	testKeys(t, MakeMemstore())
+}
+
+// TestMemstore_Has checks which keys exist in a Memstore.
+func TestMemstore_Has(t *testing.T) {
+	testHas(t, MakeMemstore())
+}
+
+// TestMemstore_Batch runs batches on a Memstore.
+func TestMemstore_Batch(t *testing.T) {
+	testBatch(t, MakeMemstore())
+}
@@ -0,0 +1,137 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// names.go lets stores created with Options.EncryptedNames name their values
+// with an encryption of the key rather than a MAC, so that the keys can be
+// recovered from the filenames alone.
+//
+// The key is padded to a multiple of nameBlockSize and encrypted with
+// AES-GCM-SIV under a subkey of the master key, using a zero nonce and the
+// name salt as associated data. AES-GCM-SIV stays secure when its nonce is
+// repeated, apart from revealing which messages are equal, so the filenames
+// are deterministic like MACs and equal keys map to the same filename. They
+// do reveal the length of the key, rounded up to the block size.
+//
+// Filenames must fit in the 255 bytes allowed by most file systems along with
+// the longest suffix added to them, which is that of a blob. Keys too long for
+// that cannot be written and are refused with ErrKeyTooLong.
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+const (
+	// nameCipherInfo separates the subkey that encrypts filenames.
+	nameCipherInfo = "ekv filename encryption key"
+	// nameBlockSize is the block size keys are padded to before they are
+	// encrypted.
+	nameBlockSize = 16
+	// maxFilenameSize is the longest filename allowed by most file systems.
+	maxFilenameSize = 255
+	// maxSuffixSize is the size of the longest suffix added to a filename,
+	// which is the random ID and extension of a blob.
+	maxSuffixSize = 1 + 2*streamIDSize + len(streamSuffix)
+)
+
+// ErrKeyTooLong is returned when writing a key whose encrypted filename would
+// be too long for the file system.
+var ErrKeyTooLong = errors.New("key is too long to be encrypted into a " +
+	"filename")
+
+// errEncryptedNamesDecoys is returned for stores that would have both
+// encrypted filenames and decoys.
+const errEncryptedNamesDecoys = "encrypted filenames cannot be used along " +
+	"with decoys"
+
+// nameNonce is the nonce of every encrypted filename.
+var nameNonce = make([]byte, gcmSIVNonceSize)
+
+// padName pads the key with a 0x80 byte followed by zeros up to a multiple of
+// nameBlockSize.
+func padName(key string) []byte {
+	padded := make([]byte, (len(key)/nameBlockSize+1)*nameBlockSize)
+	padded[copy(padded, key)] = 0x80
+	return padded
+}
+
+// unpadName is the inverse of padName.
+func unpadName(padded []byte) (string, bool) {
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+	if i < 0 || padded[i] != 0x80 || len(padded)-i > nameBlockSize {
+		return "", false
+	}
+	return string(padded[:i]), true
+}
+
+// encryptName returns the encrypted filename of the key.
+func (k *keySchedule) encryptName(key string) string {
+	padded := padName(key)
+	name := encodeKey(k.names.Seal(nil, nameNonce, padded, k.nameSalt))
+	zero(padded)
+	return name
+}
+
+// key returns the key of a filename of a store with encrypted filenames. It
+// returns false for filenames that are not the encryption of a key.
+func (k *keySchedule) key(name string) (string, bool) {
+	ciphertext, err := decodeKey(name)
+	if err != nil {
+		return "", false
+	}
+	padded, err := k.names.Open(nil, nameNonce, ciphertext, k.nameSalt)
+	if err != nil {
+		return "", false
+	}
+	return unpadName(padded)
+}
+
+// checkKey returns ErrKeyTooLong if the filename of the key would be too long.
+func (k *keySchedule) checkKey(key string) error {
+	if k.names == nil {
+		return nil
+	}
+	size := (len(key)/nameBlockSize+1)*nameBlockSize + gcmSIVTagSize
+	if size > maxNameSize {
+		return errors.Wrapf(ErrKeyTooLong, "key of %d bytes", len(key))
+	}
+	return nil
+}
+
+// nameKeys returns the sorted keys that start with the prefix, from the cursor
+// on, from the filenames of a store with encrypted filenames. Blobs are left out.
+func (f *Filestore) nameKeys(prefix, cursor string) ([]string, error) {
+	names, err := portable.ReadDir(f.storage, f.basedir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys := make(map[string]struct{}, len(names)/2)
+	for _, name := range names {
+		stem, ok := splitPath(name)
+		if !ok || isInternal(stem) {
+			continue
+		}
+		key, ok := f.keys.key(stem)
+		if !ok {
+			jww.WARN.Printf("Filename %s in %s is not an encrypted key",
+				stem, f.basedir)
+			continue
+		}
+		if !strings.HasPrefix(key, streamPrefix) {
+			keys[key] = struct{}{}
+		}
+	}
+	return matchKeys(keys, prefix, cursor), nil
+}
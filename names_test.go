@@ -0,0 +1,124 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// TestPadName checks that padded keys fill whole blocks and unpad to the key.
+func TestPadName(t *testing.T) {
+	for _, key := range []string{"", "a", strings.Repeat("b", 15),
+		strings.Repeat("c", 16), "d\x80\x00"} {
+		padded := padName(key)
+		if len(padded)%nameBlockSize != 0 || len(padded) <= len(key) {
+			t.Errorf("Bad padding of %q: %x", key, padded)
+		}
+		if unpadded, ok := unpadName(padded); !ok || unpadded != key {
+			t.Errorf("Unpadded %q to %q, %t", key, unpadded, ok)
+		}
+	}
+
+	for _, padded := range [][]byte{nil, make([]byte, 16),
+		append([]byte{0x80}, make([]byte, 16)...)} {
+		if _, ok := unpadName(padded); ok {
+			t.Errorf("Unpadded bad padding %x", padded)
+		}
+	}
+}
+
+// TestFilestore_EncryptedNames lists the keys of a store with encrypted
+// filenames without an index.
+func TestFilestore_EncryptedNames(t *testing.T) {
+	kv := newMemoryKV()
+	storage := portable.UseKeyValue(kv)
+	opts := testOptions()
+	opts.EncryptedNames = true
+	f, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+		rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	testKeys(t, f)
+	if err = f.SetStream("e", strings.NewReader("stream")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	name := f.keys.name("b/1")
+	if key, ok := f.keys.key(name); !ok || key != "b/1" {
+		t.Errorf("Could not recover the key from %s: %q", name, key)
+	}
+
+	// A file that is not an encrypted key is left out
+	contents, _ := kv.Get(f.getKey("d") + ".1")
+	err = kv.Set(f.getPath(encodeKey(make([]byte, 48)))+".1", contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.keys.name("b/1") != name {
+		t.Errorf("Filename changed after reopening")
+	}
+	checkKeys(t, f, "b/1", "b/2", "b/3", "d")
+	checkValues(t, f, map[string]string{"b/1": "b/1", "d": "d"})
+}
+
+// TestFilestore_EncryptedNames_TooLong checks that keys too long to be
+// encrypted into a filename are refused.
+func TestFilestore_EncryptedNames_TooLong(t *testing.T) {
+	opts := testOptions()
+	opts.EncryptedNames = true
+	f, err := NewGenericFilestoreWithOptions(
+		portable.UseKeyValue(newMemoryKV()), "dir", "password", rand.Reader,
+		opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	longest := (maxNameSize-gcmSIVTagSize)/nameBlockSize*nameBlockSize - 1
+	key := strings.Repeat("k", longest)
+	if err = f.SetBytes(key, []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if n := len(f.getKey(key)) - len("dir/") + maxSuffixSize; n >
+		maxFilenameSize {
+		t.Errorf("Filename of %d bytes", n)
+	}
+	checkKeys(t, f, key)
+
+	key += "k"
+	if err = f.SetBytes(key, []byte("1")); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Unexpected error for a long key: %v", err)
+	}
+	err = f.Transaction(func(map[string]Operable, Extender) error {
+		return nil
+	}, key)
+	if !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Unexpected error for a long key in a transaction: %v", err)
+	}
+	err = f.SetStream(key[len(streamPrefix):], strings.NewReader("1"))
+	if !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Unexpected error for a long stream key: %v", err)
+	}
+
+	opts.Decoys = DecoyPolicy{Step: 4}
+	_, err = NewGenericFilestoreWithOptions(
+		portable.UseKeyValue(newMemoryKV()), "dir", "password", rand.Reader,
+		opts)
+	if err == nil || err.Error() != errEncryptedNamesDecoys {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
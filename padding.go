@@ -0,0 +1,124 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// padding.go pads values before they are encrypted so that the size of their
+// files only reveals a coarse size class. Padding is chosen when a store is
+// created and recorded in its header, so every value in a store is padded the
+// same way.
+//
+// A padded value is the value followed by a single 0x80 byte and as many zero
+// bytes as the scheme requires (ISO/IEC 7816-4), so it can be unpadded without
+// knowing its original length.
+
+import (
+	"math/bits"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxPaddingBlockSize bounds the block size of BlockPadding.
+	maxPaddingBlockSize = 1 << 24
+	// paddingMarker separates a value from its padding.
+	paddingMarker = 0x80
+
+	errInvalidPadding = "invalid padding"
+)
+
+// PaddingScheme selects how the length of values is padded.
+type PaddingScheme uint8
+
+const (
+	// NoPadding stores values at their exact length.
+	NoPadding PaddingScheme = iota
+	// BlockPadding pads values to a multiple of Padding.BlockSize.
+	BlockPadding
+	// PowerOfTwoPadding pads values to the next power of two.
+	PowerOfTwoPadding
+	// PadmePadding pads values with the PADMÉ scheme, which limits the
+	// overhead to 12% while leaving O(log log n) bits of the length.
+	PadmePadding
+)
+
+// Padding is the padding policy of a store.
+type Padding struct {
+	// Scheme is how values are padded.
+	Scheme PaddingScheme `json:"scheme"`
+	// BlockSize is the block size in bytes used by BlockPadding.
+	BlockSize uint32 `json:"blockSize,omitempty"`
+}
+
+// validate returns an error if the policy cannot be used.
+func (p Padding) validate() error {
+	switch p.Scheme {
+	case NoPadding, PowerOfTwoPadding, PadmePadding:
+		return nil
+	case BlockPadding:
+		if p.BlockSize < 1 || p.BlockSize > maxPaddingBlockSize {
+			return errors.Errorf("invalid padding block size: %d",
+				p.BlockSize)
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown padding scheme: %d", p.Scheme)
+	}
+}
+
+// paddedLen returns the length that a value of n bytes, including the padding
+// marker, is padded to.
+func (p Padding) paddedLen(n int) int {
+	switch p.Scheme {
+	case BlockPadding:
+		block := int(p.BlockSize)
+		return (n + block - 1) / block * block
+	case PowerOfTwoPadding:
+		if n <= 1 {
+			return n
+		}
+		return 1 << bits.Len(uint(n-1))
+	case PadmePadding:
+		return padme(n)
+	default:
+		return n
+	}
+}
+
+// padme returns the length that n is padded to by PADMÉ, which only keeps the
+// top bits of the length: as many as are needed to represent the position
+// of its highest set bit.
+func padme(n int) int {
+	if n < 2 {
+		return n
+	}
+	e := bits.Len(uint(n)) - 1
+	s := bits.Len(uint(e))
+	mask := 1<<(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// pad returns the data followed by the padding marker and zeros up to the
+// padded length.
+func (p Padding) pad(data []byte) []byte {
+	padded := make([]byte, p.paddedLen(len(data)+1))
+	copy(padded, data)
+	padded[len(data)] = paddingMarker
+	return padded
+}
+
+// unpad returns the data without its padding.
+func unpad(padded []byte) ([]byte, error) {
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+	if i < 0 || padded[i] != paddingMarker {
+		return nil, errors.New(errInvalidPadding)
+	}
+	return padded[:i], nil
+}
@@ -0,0 +1,131 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// TestPadding_paddedLen checks the size classes of every padding scheme.
+func TestPadding_paddedLen(t *testing.T) {
+	tests := []struct {
+		padding Padding
+		n, want int
+	}{
+		{Padding{Scheme: NoPadding}, 100, 100},
+		{Padding{Scheme: BlockPadding, BlockSize: 64}, 1, 64},
+		{Padding{Scheme: BlockPadding, BlockSize: 64}, 64, 64},
+		{Padding{Scheme: BlockPadding, BlockSize: 64}, 65, 128},
+		{Padding{Scheme: PowerOfTwoPadding}, 1, 1},
+		{Padding{Scheme: PowerOfTwoPadding}, 3, 4},
+		{Padding{Scheme: PowerOfTwoPadding}, 1024, 1024},
+		{Padding{Scheme: PowerOfTwoPadding}, 1025, 2048},
+		{Padding{Scheme: PadmePadding}, 1, 1},
+		{Padding{Scheme: PadmePadding}, 9, 10},
+		{Padding{Scheme: PadmePadding}, 100, 104},
+		{Padding{Scheme: PadmePadding}, 1000, 1024},
+		{Padding{Scheme: PadmePadding}, 1 << 20, 1 << 20},
+	}
+	for _, tt := range tests {
+		if got := tt.padding.paddedLen(tt.n); got != tt.want {
+			t.Errorf("%+v: padded %d to %d, expected %d", tt.padding,
+				tt.n, got, tt.want)
+		}
+	}
+
+	// PADMÉ never adds more than 12% to the length
+	for n := 2; n < 1<<16; n++ {
+		if got := padme(n); got < n || float64(got) > 1.12*float64(n) {
+			t.Fatalf("PADMÉ padded %d to %d", n, got)
+		}
+	}
+}
+
+// TestPadding_pad checks that padded values unpad to the original and that
+// bad padding is rejected.
+func TestPadding_pad(t *testing.T) {
+	p := Padding{Scheme: BlockPadding, BlockSize: 16}
+	for _, data := range [][]byte{{}, {0}, {0x80}, bytes.Repeat([]byte{1}, 15),
+		bytes.Repeat([]byte{0}, 16)} {
+		padded := p.pad(data)
+		if len(padded)%16 != 0 {
+			t.Errorf("Bad padded length %d for %x", len(padded), data)
+		}
+		unpadded, err := unpad(padded)
+		if err != nil || !bytes.Equal(unpadded, data) {
+			t.Errorf("Bad unpad of %x: %x, %+v", data, unpadded, err)
+		}
+	}
+
+	for _, padded := range [][]byte{{}, {0, 0}, {1, 0}} {
+		if _, err := unpad(padded); err == nil {
+			t.Errorf("Unpadded invalid padding %x", padded)
+		}
+	}
+}
+
+// TestPadding_validate checks that unusable policies are rejected.
+func TestPadding_validate(t *testing.T) {
+	for _, p := range []Padding{
+		{Scheme: BlockPadding},
+		{Scheme: BlockPadding, BlockSize: maxPaddingBlockSize + 1},
+		{Scheme: PadmePadding + 1},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("Invalid policy %+v accepted", p)
+		}
+	}
+}
+
+// TestFilestore_Padding checks that values of different lengths in the same
+// size class produce files of the same size.
+func TestFilestore_Padding(t *testing.T) {
+	kv := newMemoryKV()
+	storage := portable.UseKeyValue(kv)
+	opts := testOptions()
+	opts.Padding = Padding{Scheme: BlockPadding, BlockSize: 256}
+	f, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+		rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	values := map[string]string{"a": "1", "b": string(make([]byte, 200))}
+	for k, v := range values {
+		if err = f.SetBytes(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkValues(t, f, values)
+
+	a, err := kv.Get(f.getKey("a") + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := kv.Get(f.getKey("b") + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != len(b) {
+		t.Errorf("File sizes differ: %d != %d", len(a), len(b))
+	}
+
+	// The policy is kept when the store is reopened with other options
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.header.Padding == nil || *f.header.Padding != opts.Padding {
+		t.Errorf("Padding policy was not kept: %+v", f.header.Padding)
+	}
+	checkValues(t, f, values)
+}
@@ -0,0 +1,71 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package portable
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+var (
+	// ErrNotFound is reported by Storage when a file does not exist, and
+	// must be returned, or wrapped, by GenericKeyValue.Get when a key does
+	// not exist. It is fs.ErrNotExist, so errors from the os package match
+	// it with errors.Is.
+	ErrNotFound = fs.ErrNotExist
+
+	// ErrReadOnly is reported by Storage when it cannot be written to, and
+	// should be returned, or wrapped, by GenericKeyValue.Set and
+	// GenericKeyValue.Delete when the key-value store is read-only.
+	ErrReadOnly = errors.New("storage is read-only")
+
+	// ErrNoReadDir is reported by ReadDir for Storage that does not
+	// implement DirReader.
+	ErrNoReadDir = errors.New("storage cannot list directories")
+)
+
+// warnNotFound makes sure that missing keys recognised by their message are
+// only warned about once.
+var warnNotFound sync.Once
+
+// isNotFound returns true if the error returned by a GenericKeyValue reports
+// a missing key.
+//
+// Deprecated: errors that do not wrap ErrNotFound are still recognised by
+// their message, as implementations written before it was defined relied on
+// it. This fallback logs a warning and will be removed in the next release.
+func isNotFound(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return true
+	}
+	if !strings.Contains(err.Error(), "not exist") &&
+		!strings.Contains(err.Error(), "not found") {
+		return false
+	}
+	warnNotFound.Do(func() {
+		jww.WARN.Printf("GenericKeyValue.Get reported a missing key with "+
+			"%q, which does not wrap portable.ErrNotFound. Recognising "+
+			"missing keys by their message is deprecated and will be "+
+			"removed in the next release.", err)
+	})
+	return true
+}
+
+// wrapReadOnly marks the error as ErrReadOnly if the read-only error, which
+// is specific to the backend, matches it, keeping the error as the cause.
+func wrapReadOnly(err, readOnly error) error {
+	if err != nil && !errors.Is(err, ErrReadOnly) && errors.Is(err, readOnly) {
+		return fmt.Errorf("%w: %w", ErrReadOnly, err)
+	}
+	return err
+}
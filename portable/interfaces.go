@@ -16,8 +16,14 @@
 //	"file already exists"
 //	"file does not exist"
 //	"file already closed"
+//
+// Errors for files that do not exist must also match ErrNotFound, and errors
+// for storage that cannot be written to must match ErrReadOnly, with
+// errors.Is.
 package portable
 
+import "fmt"
+
 // File represents an open file descriptor. It contains a subset of the methods
 // on os.File that are used in this repository.
 type File interface {
@@ -118,3 +124,24 @@ type Storage interface {
 	// Stat returns a FileInfo describing the named file.
 	Stat(name string) (FileInfo, error)
 }
+
+// DirReader is implemented by Storage that can list the files in a
+// directory. It is optional, so that Storage implemented outside of this
+// package keeps working, but the features of ekv that need to list the files
+// of a store return ErrNoReadDir without it.
+type DirReader interface {
+	// ReadDir reads the named directory and returns the names of all its
+	// entries sorted by filename.
+	ReadDir(name string) ([]string, error)
+}
+
+// ReadDir reads the named directory with the storage and returns the names of
+// all its entries sorted by filename. It returns an error matching
+// ErrNoReadDir if the storage does not implement DirReader.
+func ReadDir(storage Storage, name string) ([]string, error) {
+	r, ok := storage.(DirReader)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNoReadDir, storage)
+	}
+	return r.ReadDir(name)
+}
@@ -10,6 +10,7 @@ package portable
 import (
 	"bytes"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -19,13 +20,17 @@ import (
 // key-value store including browser localStorage, IndexedDB, etc.
 type GenericKeyValue interface {
 	// Get retrieves the value for the given key.
-	// Returns an error if the key does not exist.
+	// Returns an error matching ErrNotFound with errors.Is if the key does
+	// not exist. Errors that only mention "not exist" or "not found" are
+	// still accepted, but this is deprecated.
 	Get(key string) ([]byte, error)
 
 	// Set stores the value for the given key.
+	// Returns an error matching ErrReadOnly if the store is read-only.
 	Set(key string, value []byte) error
 
 	// Delete removes the key and its value.
+	// Returns an error matching ErrReadOnly if the store is read-only.
 	Delete(key string) error
 
 	// Keys returns all keys in the store.
@@ -48,10 +53,8 @@ func UseKeyValue(storage GenericKeyValue) Storage {
 func (k *kv) Open(name string) (File, error) {
 	keyValue, err := k.storage.Get(name)
 	if err != nil {
-		// Convert to os.ErrNotExist if appropriate
-		if strings.Contains(err.Error(), "not exist") ||
-			strings.Contains(err.Error(), "not found") {
-			return nil, os.ErrNotExist
+		if isNotFound(err) {
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
@@ -117,10 +120,8 @@ func (k *kv) MkdirAll(path string, perm FileMode) error {
 func (k *kv) Stat(name string) (FileInfo, error) {
 	keyValue, err := k.storage.Get(name)
 	if err != nil {
-		// Convert to os.ErrNotExist if appropriate
-		if strings.Contains(err.Error(), "not exist") ||
-			strings.Contains(err.Error(), "not found") {
-			return nil, os.ErrNotExist
+		if isNotFound(err) {
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
@@ -131,6 +132,38 @@ func (k *kv) Stat(name string) (FileInfo, error) {
 	}, nil
 }
 
+// ReadDir reads the named directory and returns the names of all its entries
+// sorted by filename. Entries are the keys that start with the directory path
+// followed by a path separator; deeper keys are reported by the name of their
+// first path element.
+func (k *kv) ReadDir(name string) ([]string, error) {
+	keys, err := k.storage.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := name + string(os.PathSeparator)
+	seen := make(map[string]struct{})
+	names := make([]string, 0)
+	for _, keyName := range keys {
+		if !strings.HasPrefix(keyName, prefix) {
+			continue
+		}
+		entry := strings.TrimPrefix(keyName, prefix)
+		if i := strings.IndexRune(entry, os.PathSeparator); i >= 0 {
+			entry = entry[:i]
+		}
+		if _, ok := seen[entry]; ok || entry == "" {
+			continue
+		}
+		seen[entry] = struct{}{}
+		names = append(names, entry)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
 // kvFile represents a File for a key-value pair in a GenericKeyValue store.
 type kvFile struct {
 	keyName string
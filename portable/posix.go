@@ -37,12 +37,16 @@ func (p *posix) Open(name string) (File, error) {
 // umask). If successful, methods on the returned File can be used for I/O; the
 // associated file descriptor has mode os.O_RDWR.
 func (p *posix) Create(name string) (File, error) {
-	return os.Create(name)
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, wrapReadOnly(err, errReadOnlyFS)
+	}
+	return f, nil
 }
 
 // Remove removes the named file or directory.
 func (p *posix) Remove(name string) error {
-	return os.Remove(name)
+	return wrapReadOnly(os.Remove(name), errReadOnlyFS)
 }
 
 // RemoveAll removes path and any children it contains.
@@ -50,7 +54,7 @@ func (p *posix) Remove(name string) error {
 // it encounters. If the path does not exist, RemoveAll
 // returns nil (no error).
 func (p *posix) RemoveAll(path string) error {
-	return os.RemoveAll(path)
+	return wrapReadOnly(os.RemoveAll(path), errReadOnlyFS)
 }
 
 // MkdirAll creates a directory named path, along with any necessary parents,
@@ -58,10 +62,25 @@ func (p *posix) RemoveAll(path string) error {
 // umask) are used for all directories that MkdirAll creates. If path is already
 // a directory, MkdirAll does nothing and returns nil.
 func (p *posix) MkdirAll(path string, perm FileMode) error {
-	return os.MkdirAll(path, os.FileMode(perm))
+	return wrapReadOnly(os.MkdirAll(path, os.FileMode(perm)), errReadOnlyFS)
 }
 
 // Stat returns a FileInfo describing the named file.
 func (p *posix) Stat(name string) (FileInfo, error) {
 	return os.Stat(name)
 }
+
+// ReadDir reads the named directory and returns the names of all its entries
+// sorted by filename.
+func (p *posix) ReadDir(name string) ([]string, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
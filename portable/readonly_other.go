@@ -0,0 +1,18 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+//go:build !plan9
+
+package portable
+
+import (
+	"syscall"
+)
+
+// errReadOnlyFS is the error reported by the file system when it is mounted
+// read-only.
+var errReadOnlyFS error = syscall.EROFS
@@ -0,0 +1,12 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package portable
+
+// errReadOnlyFS is nil on Plan 9, which has no error number for read-only
+// file systems.
+var errReadOnlyFS error
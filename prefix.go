@@ -0,0 +1,235 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// prefix.go scopes a KeyValue to a namespace. Every key used through the view
+// returned by Prefix is stored in the underlying store under the namespace
+// prefix, which starts with a zero byte and holds the length of the namespace,
+// so that keys of different namespaces, of nested namespaces and of the store
+// itself never collide as long as keys outside namespaces do not start with a
+// zero byte.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// namespacePrefix returns the prefix of the keys in the namespace.
+func namespacePrefix(ns string) string {
+	return "\x00" + strconv.Itoa(len(ns)) + ":" + ns
+}
+
+// deletePrefix deletes every key of the store that starts with the prefix in
+// a single transaction. The keys are listed before the transaction locks them,
+// so this is best-effort: a key added under the prefix in between is kept, and
+// only the keys that were listed are deleted together.
+func deletePrefix(kv KeyValue, prefix string) error {
+	keys, err := kv.KeysWithPrefix(prefix)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return kv.Transaction(func(files map[string]Operable, _ Extender) error {
+		for _, file := range files {
+			file.Delete()
+		}
+		return nil
+	}, keys...)
+}
+
+// prefixKV is a view of a KeyValue scoped to the keys that start with a
+// prefix. Keys are given to it and returned by it without the prefix.
+type prefixKV struct {
+	kv     KeyValue
+	prefix string
+}
+
+// newPrefixKV returns the view of the namespace of the store.
+func newPrefixKV(kv KeyValue, ns string) *prefixKV {
+	return &prefixKV{kv: kv, prefix: namespacePrefix(ns)}
+}
+
+// Set implements [KeyValue.Set]
+func (p *prefixKV) Set(key string, objectToStore Marshaler) error {
+	return p.kv.Set(p.prefix+key, objectToStore)
+}
+
+// Get implements [KeyValue.Get]
+func (p *prefixKV) Get(key string, loadIntoThisObject Unmarshaler) error {
+	return p.kv.Get(p.prefix+key, loadIntoThisObject)
+}
+
+// Delete implements [KeyValue.Delete]
+func (p *prefixKV) Delete(key string) error {
+	return p.kv.Delete(p.prefix + key)
+}
+
+// SetInterface implements [KeyValue.SetInterface]
+func (p *prefixKV) SetInterface(key string, objectToStore interface{}) error {
+	return p.kv.SetInterface(p.prefix+key, objectToStore)
+}
+
+// GetInterface implements [KeyValue.GetInterface]
+func (p *prefixKV) GetInterface(key string, v interface{}) error {
+	return p.kv.GetInterface(p.prefix+key, v)
+}
+
+// SetBytes implements [KeyValue.SetBytes]
+func (p *prefixKV) SetBytes(key string, data []byte) error {
+	return p.kv.SetBytes(p.prefix+key, data)
+}
+
+// GetBytes implements [KeyValue.GetBytes]
+func (p *prefixKV) GetBytes(key string) ([]byte, error) {
+	return p.kv.GetBytes(p.prefix + key)
+}
+
+// Has implements [KeyValue.Has]
+func (p *prefixKV) Has(key string) (bool, error) {
+	return p.kv.Has(p.prefix + key)
+}
+
+// GetMulti implements [KeyValue.GetMulti]
+func (p *prefixKV) GetMulti(keys []string) (map[string][]byte,
+	map[string]error) {
+	values, errs := p.kv.GetMulti(p.prefixKeys(keys))
+	unprefixed := make(map[string][]byte, len(values))
+	for key, data := range values {
+		unprefixed[strings.TrimPrefix(key, p.prefix)] = data
+	}
+	return unprefixed, p.unprefixErrors(errs)
+}
+
+// SetMulti implements [KeyValue.SetMulti]
+func (p *prefixKV) SetMulti(values map[string][]byte) map[string]error {
+	prefixed := make(map[string][]byte, len(values))
+	for key, data := range values {
+		prefixed[p.prefix+key] = data
+	}
+	return p.unprefixErrors(p.kv.SetMulti(prefixed))
+}
+
+// DeleteMulti implements [KeyValue.DeleteMulti]
+func (p *prefixKV) DeleteMulti(keys []string) map[string]error {
+	return p.unprefixErrors(p.kv.DeleteMulti(p.prefixKeys(keys)))
+}
+
+// Transaction implements [KeyValue.Transaction]. The operables are keyed by
+// and report the keys without the prefix.
+func (p *prefixKV) Transaction(op TransactionOperation, keys ...string) error {
+	return p.kv.Transaction(func(files map[string]Operable,
+		ext Extender) error {
+		return op(p.unprefixFiles(files), &prefixExtender{ext, p})
+	}, p.prefixKeys(keys)...)
+}
+
+// Keys implements [KeyValue.Keys]
+func (p *prefixKV) Keys() ([]string, error) {
+	return p.KeysWithPrefix("")
+}
+
+// KeysWithPrefix implements [KeyValue.KeysWithPrefix]
+func (p *prefixKV) KeysWithPrefix(prefix string) ([]string, error) {
+	keys, err := p.kv.KeysWithPrefix(p.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	return p.unprefixKeys(keys), nil
+}
+
+// IterateKeys implements [KeyValue.IterateKeys]
+func (p *prefixKV) IterateKeys(prefix, cursor string, limit int) ([]string,
+	string, bool, error) {
+	keys, next, done, err := p.kv.IterateKeys(p.prefix+prefix,
+		p.prefix+cursor, limit)
+	if err != nil {
+		return nil, "", false, err
+	}
+	return p.unprefixKeys(keys), strings.TrimPrefix(next, p.prefix), done,
+		nil
+}
+
+// Prefix implements [KeyValue.Prefix]. The namespace is nested in the
+// namespace of the view.
+func (p *prefixKV) Prefix(ns string) KeyValue {
+	return &prefixKV{kv: p.kv, prefix: p.prefix + namespacePrefix(ns)}
+}
+
+// DeletePrefix implements [KeyValue.DeletePrefix]
+func (p *prefixKV) DeletePrefix(ns string) error {
+	return deletePrefix(p.kv, p.prefix+namespacePrefix(ns))
+}
+
+// prefixKeys returns the keys with the prefix.
+func (p *prefixKV) prefixKeys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = p.prefix + key
+	}
+	return prefixed
+}
+
+// unprefixKeys returns the keys without the prefix.
+func (p *prefixKV) unprefixKeys(keys []string) []string {
+	unprefixed := make([]string, len(keys))
+	for i, key := range keys {
+		unprefixed[i] = strings.TrimPrefix(key, p.prefix)
+	}
+	return unprefixed
+}
+
+// unprefixErrors returns the errors of a batch keyed without the prefix.
+func (p *prefixKV) unprefixErrors(errs map[string]error) map[string]error {
+	if errs == nil {
+		return nil
+	}
+	unprefixed := make(map[string]error, len(errs))
+	for key, err := range errs {
+		unprefixed[strings.TrimPrefix(key, p.prefix)] = err
+	}
+	return unprefixed
+}
+
+// unprefixFiles returns the operables keyed by and reporting the keys without
+// the prefix.
+func (p *prefixKV) unprefixFiles(
+	files map[string]Operable) map[string]Operable {
+	unprefixed := make(map[string]Operable, len(files))
+	for key, file := range files {
+		key = strings.TrimPrefix(key, p.prefix)
+		unprefixed[key] = &prefixOperable{Operable: file, key: key}
+	}
+	return unprefixed
+}
+
+// prefixExtender adds the prefix to the keys a transaction is extended with.
+type prefixExtender struct {
+	Extender
+	p *prefixKV
+}
+
+// Extend implements [Extender.Extend]
+func (e *prefixExtender) Extend(keys []string) (map[string]Operable, error) {
+	files, err := e.Extender.Extend(e.p.prefixKeys(keys))
+	if err != nil {
+		return nil, err
+	}
+	return e.p.unprefixFiles(files), nil
+}
+
+// prefixOperable reports the key of an operable without the prefix.
+type prefixOperable struct {
+	Operable
+	key string
+}
+
+// Key implements [Operable.Key]
+func (op *prefixOperable) Key() string {
+	// Called for its check that the transaction is in scope
+	op.Operable.Key()
+	return op.key
+}
@@ -0,0 +1,181 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"testing"
+)
+
+// testPrefix checks that namespaces of the KeyValue are kept apart and can be
+// deleted.
+func testPrefix(t *testing.T, kv KeyValue) {
+	a, ab := kv.Prefix("a"), kv.Prefix("ab")
+	nested := a.Prefix("b")
+	for i, view := range []KeyValue{kv, a, ab, nested} {
+		for _, key := range []string{"b", "bc", "x"} {
+			err := view.SetBytes(key, []byte{byte(i)})
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+	}
+	for i, view := range []KeyValue{kv, a, ab, nested} {
+		for _, key := range []string{"b", "bc", "x"} {
+			data, err := view.GetBytes(key)
+			if err != nil || len(data) != 1 || data[0] != byte(i) {
+				t.Errorf("Bad value for %s in view %d: %v, %+v", key, i,
+					data, err)
+			}
+		}
+	}
+	checkKeys(t, nested, "b", "bc", "x")
+	keys, err := a.KeysWithPrefix("b")
+	if err != nil || len(keys) != 2 {
+		t.Errorf("Unexpected keys with prefix: %q, %+v", keys, err)
+	}
+	page, next, done, err := a.IterateKeys("", "bc", 1)
+	if err != nil || len(page) != 1 || page[0] != "bc" || next != "x" ||
+		done {
+		t.Errorf("Unexpected page: %q, %q, %t, %+v", page, next, done, err)
+	}
+
+	// The empty key is paged through like any other
+	empty := kv.Prefix("empty")
+	for _, key := range []string{"", "a"} {
+		if err = empty.SetBytes(key, []byte(key)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	var pages [][]string
+	for cursor, done := "", false; !done; {
+		if len(pages) > 2 {
+			t.Fatalf("Iteration did not end: %q", pages)
+		}
+		page, cursor, done, err = empty.IterateKeys("", cursor, 1)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		pages = append(pages, page)
+	}
+	if len(pages) != 2 || pages[0][0] != "" || pages[1][0] != "a" {
+		t.Errorf("Unexpected pages: %q", pages)
+	}
+
+	// Transactions report the keys without the prefix
+	err = a.Transaction(func(files map[string]Operable, ext Extender) error {
+		if files["b"].Key() != "b" {
+			t.Errorf("Unexpected key %q", files["b"].Key())
+		}
+		more, err := ext.Extend([]string{"y"})
+		if err != nil {
+			return err
+		}
+		more["y"].Set([]byte("y"))
+		files["b"].Delete()
+		return nil
+	}, "b")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if data, err := kv.GetBytes(namespacePrefix("a") + "y"); err != nil ||
+		string(data) != "y" {
+		t.Errorf("Extended key was not prefixed: %q, %+v", data, err)
+	}
+	if _, err = a.GetBytes("b"); Exists(err) {
+		t.Errorf("Deleted key still exists: %+v", err)
+	}
+
+	// Deleting a namespace also deletes the namespaces nested in it
+	if err = kv.DeletePrefix("a"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, a)
+	checkKeys(t, nested)
+	checkKeys(t, ab, "b", "bc", "x")
+	if err = ab.DeletePrefix("missing"); err != nil {
+		t.Errorf("%+v", err)
+	}
+}
+
+// TestFilestore_Prefix checks the namespaces of a store with an index.
+func TestFilestore_Prefix(t *testing.T) {
+	opts := testOptions()
+	opts.Index = true
+	testPrefix(t, newTestStore(t, nil, opts, nil))
+}
+
+// TestMemstore_Prefix checks the namespaces of a Memstore.
+func TestMemstore_Prefix(t *testing.T) {
+	testPrefix(t, MakeMemstore())
+}
+
+// racingKV runs add once right after the keys of a prefix are listed, as if
+// another goroutine added a key at that moment.
+type racingKV struct {
+	KeyValue
+	add func()
+}
+
+func (r *racingKV) KeysWithPrefix(prefix string) ([]string, error) {
+	keys, err := r.KeyValue.KeysWithPrefix(prefix)
+	if r.add != nil {
+		r.add()
+		r.add = nil
+	}
+	return keys, err
+}
+
+// testDeletePrefixConcurrentAdd adds a key to a namespace while it is being
+// deleted and checks that the listed keys are deleted and the new key is kept.
+func testDeletePrefixConcurrentAdd(t *testing.T, kv KeyValue) {
+	ns := kv.Prefix("ns")
+	for _, key := range []string{"a", "b"} {
+		if err := ns.SetBytes(key, []byte(key)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	racing := &racingKV{KeyValue: kv, add: func() {
+		if err := ns.SetBytes("c", []byte("c")); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}}
+	if err := deletePrefix(racing, namespacePrefix("ns")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkKeys(t, ns, "c")
+}
+
+// TestFilestore_DeletePrefix_ConcurrentAdd runs
+// testDeletePrefixConcurrentAdd on a store with an index.
+func TestFilestore_DeletePrefix_ConcurrentAdd(t *testing.T) {
+	opts := testOptions()
+	opts.Index = true
+	testDeletePrefixConcurrentAdd(t, newTestStore(t, nil, opts, nil))
+}
+
+// TestMemstore_DeletePrefix_ConcurrentAdd runs
+// testDeletePrefixConcurrentAdd on a Memstore.
+func TestMemstore_DeletePrefix_ConcurrentAdd(t *testing.T) {
+	testDeletePrefixConcurrentAdd(t, MakeMemstore())
+}
+
+// TestNamespacePrefix checks that namespaces do not share prefixes.
+func TestNamespacePrefix(t *testing.T) {
+	seen := make(map[string][]string)
+	for _, ns := range [][]string{{"a"}, {"ab"}, {"a", "b"}, {"a", "b:"},
+		{"1:a"}, {""}, {"", ""}} {
+		prefix := ""
+		for _, part := range ns {
+			prefix += namespacePrefix(part)
+		}
+		if other, ok := seen[prefix]; ok {
+			t.Errorf("Namespaces %q and %q share a prefix", ns, other)
+		}
+		seen[prefix] = ns
+	}
+}
@@ -0,0 +1,214 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// recipient.go lets a store be opened with an X25519 private key instead of a
+// password. The master key is sealed to the public key of every recipient
+// listed in the header using an anonymous NaCl box, so granting a new device
+// access only requires its public key.
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// IdentityKeySize is the size of the public and private keys of an
+	// identity.
+	IdentityKeySize = curve25519.PointSize
+
+	errRecipientExists   = "recipient %q already exists"
+	errRecipientNotFound = "recipient %q does not exist"
+	errEmptyRecipient    = "recipient name cannot be empty"
+	errIdentityKeySize   = "invalid identity key size %d, expected %d"
+	errLastUnlock        = "cannot remove the last key slot or recipient"
+	errNoStore           = "no store exists in %s"
+)
+
+// recipient holds the master key of a store sealed to an X25519 public key.
+type recipient struct {
+	Name      string `json:"name"`
+	PublicKey []byte `json:"publicKey"`
+	Key       []byte `json:"key"`
+}
+
+// RecipientInfo describes a recipient of a Filestore.
+type RecipientInfo struct {
+	// Name identifies the recipient.
+	Name string
+	// PublicKey is the X25519 public key the master key is sealed to.
+	PublicKey []byte
+}
+
+// GenerateIdentity generates an X25519 key pair. The public key can be
+// published and added to a store with [Filestore.AddRecipient], after which
+// the private key opens it with [NewFilestoreWithIdentity].
+func GenerateIdentity(csprng io.Reader) (publicKey, privateKey []byte,
+	err error) {
+	pub, priv, err := box.GenerateKey(csprng)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not generate identity")
+	}
+	return pub[:], priv[:], nil
+}
+
+// newRecipient seals the master key to the public key.
+func newRecipient(name string, publicKey, masterKey []byte,
+	csprng io.Reader) (recipient, error) {
+	if name == "" {
+		return recipient{}, errors.New(errEmptyRecipient)
+	}
+	pub, err := toIdentityKey(publicKey)
+	if err != nil {
+		return recipient{}, err
+	}
+
+	sealed, err := box.SealAnonymous(nil, masterKey, pub, csprng)
+	if err != nil {
+		return recipient{}, errors.Wrap(err, "could not seal master key")
+	}
+	return recipient{
+		Name:      name,
+		PublicKey: append([]byte(nil), publicKey...),
+		Key:       sealed,
+	}, nil
+}
+
+// validate returns an error if the recipient cannot be used.
+func (r recipient) validate() error {
+	_, err := toIdentityKey(r.PublicKey)
+	return err
+}
+
+// unlockRecipient recovers the master key sealed to the public key of the
+// private key and verifies it against the check value in the header.
+func (h *storeHeader) unlockRecipient(privateKey []byte) ([]byte, error) {
+	priv, err := toIdentityKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pub, _ := toIdentityKey(publicKey)
+
+	for _, r := range h.Recipients {
+		if !bytes.Equal(r.PublicKey, publicKey) {
+			continue
+		}
+		key, ok := box.OpenAnonymous(nil, r.Key, pub, priv)
+		if !ok {
+			continue
+		}
+		if err = checkMarker(h.cipherSuite(), h.Check, key, marker(h.Version)); err != nil {
+			return nil, corrupt(err)
+		}
+		return key, nil
+	}
+	return nil, errors.WithStack(ErrWrongPassword)
+}
+
+// toIdentityKey converts a public or private key to the form used by box.
+func toIdentityKey(key []byte) (*[IdentityKeySize]byte, error) {
+	if len(key) != IdentityKeySize {
+		return nil, errors.Errorf(errIdentityKeySize, len(key),
+			IdentityKeySize)
+	}
+	var k [IdentityKeySize]byte
+	copy(k[:], key)
+	return &k, nil
+}
+
+// AddRecipient grants the holder of the private key matching the public key
+// access to the store by sealing the master key to it. Only the header is
+// rewritten; the values in the store are untouched.
+func (f *Filestore) AddRecipient(name string, publicKey []byte) error {
+	f.lockKeys()
+	defer f.unlockKeys()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+
+	if f.header == nil {
+		return errors.New(errNoKeySlots)
+	}
+	if f.findRecipient(name) >= 0 {
+		return errors.Errorf(errRecipientExists, name)
+	}
+
+	r, err := newRecipient(name, publicKey, f.key.bytes(), f.csprng)
+	if err != nil {
+		return err
+	}
+
+	h := f.header.clone()
+	h.Recipients = append(h.Recipients, r)
+	return f.saveHeader(h)
+}
+
+// RemoveRecipient revokes the access of the named recipient. The last way to
+// unlock the store, whether a key slot or a recipient, cannot be removed.
+//
+// Note that the master key does not change, so a recipient that opened the
+// store before may have kept it.
+func (f *Filestore) RemoveRecipient(name string) error {
+	f.lockKeys()
+	defer f.unlockKeys()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+
+	if f.header == nil {
+		return errors.New(errNoKeySlots)
+	}
+	i := f.findRecipient(name)
+	if i < 0 {
+		return errors.Errorf(errRecipientNotFound, name)
+	}
+	if len(f.header.Slots)+len(f.header.Recipients) == 1 {
+		return errors.New(errLastUnlock)
+	}
+
+	h := f.header.clone()
+	h.Recipients = append(h.Recipients[:i], h.Recipients[i+1:]...)
+	return f.saveHeader(h)
+}
+
+// ListRecipients returns the recipients of the store.
+func (f *Filestore) ListRecipients() []RecipientInfo {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+
+	if f.header == nil {
+		return nil
+	}
+	recipients := make([]RecipientInfo, len(f.header.Recipients))
+	for i, r := range f.header.Recipients {
+		recipients[i] = RecipientInfo{
+			Name:      r.Name,
+			PublicKey: append([]byte(nil), r.PublicKey...),
+		}
+	}
+	return recipients
+}
+
+// findRecipient returns the index of the named recipient or -1 if there is
+// none. The caller must hold keyMux.
+func (f *Filestore) findRecipient(name string) int {
+	for i, r := range f.header.Recipients {
+		if r.Name == name {
+			return i
+		}
+	}
+	return -1
+}
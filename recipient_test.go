@@ -0,0 +1,141 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// TestFilestore_Recipients grants a new device access to a store with its
+// public key and checks that its private key opens the store.
+func TestFilestore_Recipients(t *testing.T) {
+	storage := portable.UseKeyValue(newMemoryKV())
+	values := map[string]string{"a": "1", "b": "2"}
+
+	f, err := openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for k, v := range values {
+		if err = f.SetBytes(k, []byte(v)); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	pub, priv, err := GenerateIdentity(rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	otherPub, otherPriv, err := GenerateIdentity(rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if _, err = NewFilestoreWithIdentity(storage, "dir", priv); err == nil {
+		t.Errorf("Opened with an identity that is not a recipient")
+	}
+
+	if err = f.AddRecipient("phone", pub); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.AddRecipient("phone", otherPub); err == nil {
+		t.Errorf("Added a duplicate recipient")
+	}
+	if err = f.AddRecipient("short", pub[:16]); err == nil {
+		t.Errorf("Added a recipient with a short public key")
+	}
+
+	recipients := f.ListRecipients()
+	if len(recipients) != 1 || recipients[0].Name != "phone" ||
+		!bytes.Equal(recipients[0].PublicKey, pub) {
+		t.Errorf("Unexpected recipients: %+v", recipients)
+	}
+
+	device, err := NewFilestoreWithIdentity(storage, "dir", priv)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, device, values)
+	if _, err = NewFilestoreWithIdentity(storage, "dir", otherPriv); err == nil {
+		t.Errorf("Opened with another identity")
+	}
+
+	// The password still opens the store
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, values)
+
+	if err = f.RemoveRecipient("phone"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.RemoveRecipient("phone"); err == nil {
+		t.Errorf("Removed a missing recipient")
+	}
+	if _, err = NewFilestoreWithIdentity(storage, "dir", priv); err == nil {
+		t.Errorf("Opened with a revoked identity")
+	}
+}
+
+// TestFilestore_Recipients_Only revokes the password of a store so that only
+// a recipient can open it.
+func TestFilestore_Recipients_Only(t *testing.T) {
+	storage := portable.UseKeyValue(newMemoryKV())
+
+	f, err := openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("a", []byte("1")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	pub, priv, err := GenerateIdentity(rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.AddRecipient("phone", pub); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if err = f.RemoveKeySlot(defaultSlotName); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.RemoveRecipient("phone"); err == nil {
+		t.Errorf("Removed the last recipient")
+	}
+	if _, err = openTestStore(storage, "dir", "password"); err == nil {
+		t.Errorf("Opened with a revoked password")
+	}
+
+	f, err = NewFilestoreWithIdentity(storage, "dir", priv)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"a": "1"})
+}
+
+// TestNewFilestoreWithIdentity_NoStore checks that an identity cannot be used
+// to create a store.
+func TestNewFilestoreWithIdentity_NoStore(t *testing.T) {
+	storage := portable.UseKeyValue(newMemoryKV())
+	_, priv, err := GenerateIdentity(rand.Reader)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = NewFilestoreWithIdentity(storage, "dir", priv); err == nil {
+		t.Errorf("Created a store with an identity")
+	}
+	if _, err = NewFilestoreWithIdentity(storage, "dir", priv[:8]); err == nil {
+		t.Errorf("Opened with a short private key")
+	}
+}
@@ -0,0 +1,434 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// rekey.go moves every value in a store to a new store key and key schedule.
+// This is needed to move version:1 stores, whose key is derived directly from
+// the password, to a master key held in key slots along with subkeys and
+// salted filenames. Both the hashed filenames and the ciphertexts depend on
+// the keys, so each value is decrypted, re-encrypted and written under its
+// new name.
+//
+// To survive a crash midway, a journal is written to the .ekv.journal file
+// before any value is touched. It holds the header being installed, the
+// current key encrypted under the new key and the old and new name of every
+// value. The rekey then proceeds in three steps:
+//
+//  1. Every value is copied to its new name. The old files are left alone.
+//  2. The new header is written to the .ekv file. This is the commit point.
+//  3. The old files and then the journal are removed.
+//
+// When a store with a journal is opened, the interrupted rekey is finished or
+// undone. With the current password it is rolled back if the commit point was
+// not reached and cleaned up otherwise. With the new password the header in
+// the journal is unlocked, which also recovers the current key, and the rekey
+// is rolled forward.
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+const (
+	journalFilename  = ekvFilename + ".journal"
+	errUnknownValues = "store holds %d values that are not in the key list"
+)
+
+// rekeyJournal is the contents of the .ekv.journal file.
+type rekeyJournal struct {
+	// Header is the header being installed.
+	Header *storeHeader `json:"header"`
+	// OldHeader is the header being replaced, nil for version:1 stores.
+	OldHeader *storeHeader `json:"oldHeader,omitempty"`
+	// OldKey is the key being replaced, encrypted under the new key.
+	OldKey []byte `json:"oldKey"`
+	// Entries are the values being moved.
+	Entries []rekeyEntry `json:"entries"`
+}
+
+// rekeyEntry is the old and new name of a single value being moved.
+type rekeyEntry struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// ChangePassword changes the password of the store. For stores using key
+// slots, the master key in the slot opened by the old password is wrapped
+// under the new password and only the header is rewritten.
+//
+// Version:1 stores derive their key directly from the password, so a new
+// master key is generated and every value is re-encrypted under it and moved
+// to its new hashed filename. Keys are stored hashed, so the caller must list
+// every key held by such a store. The change is refused before anything is
+// modified if the directory holds a value that is not accounted for by the
+// list.
+//
+// If a re-encryption is interrupted, the store can be opened with either
+// password. Opening it finishes the change if the new password is used, or if
+// the new header was already written. Otherwise the change is undone.
+func (f *Filestore) ChangePassword(oldPassword, newPassword string,
+	keys ...string) error {
+	oldSecret, newSecret := []byte(oldPassword), []byte(newPassword)
+	defer zero(oldSecret)
+	defer zero(newSecret)
+	return f.ChangePasswordBytes(oldSecret, newSecret, keys...)
+}
+
+// ChangePasswordBytes is [Filestore.ChangePassword] with the passwords given
+// as byte slices, so that they never have to be held in immutable strings.
+// The store does not keep or modify the slices, which the caller may zero as
+// soon as this returns.
+func (f *Filestore) ChangePasswordBytes(oldSecret, newSecret []byte,
+	keys ...string) error {
+	f.lockKeys()
+	defer f.unlockKeys()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+
+	if f.header != nil {
+		return f.rewrapSlot(oldSecret, newSecret, nil)
+	}
+
+	if err := verifyPassword(f.header, f.key.bytes(), oldSecret); err != nil {
+		return errors.WithStack(err)
+	}
+	header, key, err := newHeader(newSecret, DefaultOptions(), f.csprng)
+	if err != nil {
+		return err
+	}
+	return f.rekey(header, lockBytes(key), keys)
+}
+
+// UpgradeKDF changes the Argon2id parameters used to derive the key of the slot
+// opened by the password.
+//
+// Version:1 stores use an unsalted hash of the password as their key. For
+// those, a new master key is generated in a key slot using the parameters, and
+// every value is re-encrypted under it. Like [Filestore.ChangePassword], every
+// key in such a store must be listed, and an interrupted upgrade is recovered
+// when the store is opened.
+func (f *Filestore) UpgradeKDF(password string, params KDFParams,
+	keys ...string) error {
+	secret := []byte(password)
+	defer zero(secret)
+	return f.UpgradeKDFBytes(secret, params, keys...)
+}
+
+// UpgradeKDFBytes is [Filestore.UpgradeKDF] with the password given as a byte
+// slice, so that it never has to be held in an immutable string. The store
+// does not keep or modify the slice, which the caller may zero as soon as this
+// returns.
+func (f *Filestore) UpgradeKDFBytes(secret []byte, params KDFParams,
+	keys ...string) error {
+	f.lockKeys()
+	defer f.unlockKeys()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+
+	if f.header != nil {
+		return f.rewrapSlot(secret, secret, &params)
+	}
+
+	if err := verifyPassword(f.header, f.key.bytes(), secret); err != nil {
+		return errors.WithStack(err)
+	}
+	header, key, err := newHeader(secret, Options{KDF: params}, f.csprng)
+	if err != nil {
+		return err
+	}
+	return f.rekey(header, lockBytes(key), keys)
+}
+
+// rewrapSlot replaces the key slot opened by the old secret with one opened by
+// the new secret, using the given parameters or else those of the old slot.
+// The caller must hold keyMux for writing.
+func (f *Filestore) rewrapSlot(oldSecret, newSecret []byte,
+	params *KDFParams) error {
+	i, key, err := f.header.findSlot(oldSecret)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	zero(key)
+
+	old := f.header.Slots[i]
+	if params == nil {
+		params = &old.KDF
+	}
+	slot, err := newKeySlot(old.Name, newSecret, f.key.bytes(), *params,
+		f.header.cipherSuite(), f.csprng)
+	if err != nil {
+		return err
+	}
+
+	h := f.header.clone()
+	h.Slots[i] = slot
+	return f.saveHeader(h)
+}
+
+// rekey journals and then moves the values for the keys to the new key and
+// header. The new key is destroyed if the rekey fails. The caller must hold
+// keyMux for writing.
+func (f *Filestore) rekey(header *storeHeader, key *lockedBuffer,
+	keys []string) error {
+	// Stores with decoys or a manifest are created with the current key
+	// schedule and never need to be rekeyed
+	if f.decoys != nil || f.manifest != nil {
+		key.destroy()
+		return errors.New("cannot rekey a store with decoys or a manifest")
+	}
+	newKeys, err := newKeySchedule(header, key.bytes())
+	if err != nil {
+		key.destroy()
+		return err
+	}
+	entries, err := f.rekeyEntries(newKeys, keys)
+	newKeys.wipe()
+	if err != nil {
+		key.destroy()
+		return err
+	}
+	oldKey, err := encrypt(header.cipherSuite(), f.key.bytes(), key.bytes(),
+		f.csprng)
+	if err != nil {
+		key.destroy()
+		return err
+	}
+
+	j := &rekeyJournal{
+		Header:    header,
+		OldHeader: f.header,
+		OldKey:    oldKey,
+		Entries:   entries,
+	}
+	if err = f.writeJournal(j); err != nil {
+		key.destroy()
+		return err
+	}
+	if err = f.finishRekey(j, f.key, key); err != nil {
+		if f.key != key {
+			key.destroy()
+		}
+		return err
+	}
+	// The index is encrypted under the old key
+	return f.saveIndex()
+}
+
+// finishRekey copies every value in the journal from the old to the new key,
+// commits the new header and cleans up. It can be repeated any number of times
+// until it succeeds.
+//
+// Once the new header is committed, the old key is destroyed and the store
+// takes over the new key. Before that, neither key is touched.
+func (f *Filestore) finishRekey(j *rekeyJournal,
+	oldKey, newKey *lockedBuffer) error {
+	oldKeys, err := newKeySchedule(j.OldHeader, oldKey.bytes())
+	if err != nil {
+		return err
+	}
+	defer oldKeys.wipe()
+	newKeys, err := newKeySchedule(j.Header, newKey.bytes())
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			newKeys.wipe()
+		}
+	}()
+
+	for _, entry := range j.Entries {
+		contents, err := read(f.getPath(entry.Old), f.storage)
+		if !Exists(err) {
+			continue
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+
+		plaintext, err := openValue(j.OldHeader, oldKeys.content,
+			entry.Old, contents)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		ciphertext, err := sealValue(j.Header, newKeys.content, entry.New,
+			plaintext, f.csprng)
+		if err != nil {
+			return err
+		}
+		err = write(f.getPath(entry.New), ciphertext, f.storage)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	// Switch the store over to the new key
+	err = writeHeader(f.getPath(ekvFilename), j.Header, newKey.bytes(),
+		f.csprng, f.storage)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	committed = true
+	oldKey.destroy()
+	if f.keys != nil {
+		f.keys.wipe()
+	}
+	f.header = j.Header
+	f.key = newKey
+	f.keys = newKeys
+
+	return f.cleanupRekey(j, false)
+}
+
+// cleanupRekey removes the journal along with either the files under the old
+// names, once the new header is in place, or the files under the new names
+// when the rekey is being rolled back.
+func (f *Filestore) cleanupRekey(j *rekeyJournal, rollback bool) error {
+	for _, entry := range j.Entries {
+		name := entry.Old
+		if rollback {
+			name = entry.New
+		}
+		err := deleteFiles(f.getPath(name), f.csprng, f.storage)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return deleteFiles(f.getPath(journalFilename), f.csprng, f.storage)
+}
+
+// resumeRekey finishes or undoes the rekey recorded in the journal while the
+// store is being opened. The header, key and error are the result of unlocking
+// the .ekv file with the credential; the header and key the store should use are
+// returned.
+func (f *Filestore) resumeRekey(j *rekeyJournal, cred credential,
+	header *storeHeader, key *lockedBuffer, loadErr error) (*storeHeader,
+	*lockedBuffer, error) {
+	if loadErr == nil {
+		// Every new header has its own check value
+		committed := header != nil && bytes.Equal(header.Check, j.Header.Check)
+		return header, key, f.cleanupRekey(j, !committed)
+	}
+
+	// The password does not open the current header, so try the one
+	// being installed
+	rawKey, err := cred.unlock(j.Header)
+	if err != nil {
+		return nil, nil, loadErr
+	}
+	newKey := lockBytes(rawKey)
+	rawKey, err = decrypt(j.Header.cipherSuite(), j.OldKey, newKey.bytes())
+	if err != nil {
+		newKey.destroy()
+		return nil, nil, errors.WithStack(err)
+	}
+	oldKey := lockBytes(rawKey)
+
+	if err = f.finishRekey(j, oldKey, newKey); err != nil {
+		// Once committed, the store owns the new key and the old one is
+		// already destroyed
+		if f.key != newKey {
+			oldKey.destroy()
+			newKey.destroy()
+		}
+		return nil, nil, err
+	}
+	return j.Header, newKey, nil
+}
+
+// rekeyEntries returns the old and new names for every key and the pointer to
+// its blob. An error is returned if the directory holds values that none of
+// the keys map to.
+func (f *Filestore) rekeyEntries(newKeys *keySchedule,
+	keys []string) ([]rekeyEntry, error) {
+	known := make(map[string]struct{}, 2*len(keys))
+	entries := make([]rekeyEntry, 0, 2*len(keys))
+	for _, k := range append(streamKeys(keys), keys...) {
+		oldName := f.keys.name(k)
+		if _, ok := known[oldName]; ok {
+			continue
+		}
+		known[oldName] = struct{}{}
+		entries = append(entries, rekeyEntry{
+			Old: oldName,
+			New: newKeys.name(k),
+		})
+	}
+
+	names, err := portable.ReadDir(f.storage, f.basedir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	unknown := make(map[string]struct{})
+	for _, name := range names {
+		stem, ok := splitPath(name)
+		if !ok || isInternal(stem) {
+			continue
+		}
+		if _, ok = known[stem]; !ok {
+			unknown[stem] = struct{}{}
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, errors.Errorf(errUnknownValues, len(unknown))
+	}
+	return entries, nil
+}
+
+// readJournal returns the journal of an interrupted rekey, or nil if there is
+// none.
+func (f *Filestore) readJournal() (*rekeyJournal, error) {
+	contents, err := read(f.getPath(journalFilename), f.storage)
+	if !Exists(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	j := &rekeyJournal{}
+	if err = json.Unmarshal(contents, j); err != nil {
+		return nil, errors.Wrap(err, "invalid rekey journal")
+	}
+	if j.Header == nil {
+		return nil, errors.New("invalid rekey journal: missing header")
+	}
+	if err = j.Header.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid rekey journal")
+	}
+	return j, nil
+}
+
+// writeJournal writes the journal to the .ekv.journal file.
+func (f *Filestore) writeJournal(j *rekeyJournal) error {
+	contents, err := json.Marshal(j)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(
+		write(f.getPath(journalFilename), contents, f.storage))
+}
+
+// isInternal returns true for the names of files used by the store itself
+// rather than to hold values. Encoded keys never start with a dot.
+func isInternal(name string) bool {
+	return strings.HasPrefix(name, ekvFilename)
+}
+
+// getPath returns the path of the named file inside the store directory.
+func (f *Filestore) getPath(name string) string {
+	return f.basedir + string(os.PathSeparator) + name
+}
@@ -0,0 +1,345 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// makeLegacyStore writes a version:1 store holding the values, as created by
+// versions of ekv that hashed the password without a salt.
+func makeLegacyStore(t *testing.T, storage portable.Storage, dir,
+	password string, values map[string]string) {
+	key := legacyKey([]byte(password))
+	if err := storage.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	sep := string(os.PathSeparator)
+	err := write(dir+sep+ekvFilename,
+		mustEncrypt(t, XChaCha20Poly1305, []byte(legacyMarker), key),
+		storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		path := dir + sep + encodeKey(hashStringWithKey(k, key))
+		ciphertext := mustEncrypt(t, XChaCha20Poly1305, []byte(v), key)
+		err = write(path, ciphertext, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestFilestore_UpgradeKDF opens a version:1 store, checks its values can be
+// read and then upgrades it to the salted key derivation.
+func TestFilestore_UpgradeKDF(t *testing.T) {
+	dir := ".ekv_testdir_upgradekdf"
+	storage := portable.UsePosix()
+	defer func() {
+		if err := storage.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	values := map[string]string{"key1": "value1", "key2": "value2"}
+	makeLegacyStore(t, storage, dir, "Hello, World!", values)
+
+	f, err := openTestStore(portable.UsePosix(), dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.header != nil {
+		t.Fatalf("Legacy store opened with a header: %+v", f.header)
+	}
+	checkValues(t, f, values)
+
+	err = f.UpgradeKDF("badpassword", testKDFParams, "key1", "key2")
+	if err == nil {
+		t.Errorf("Upgraded with a bad password")
+	}
+
+	err = f.UpgradeKDF("Hello, World!", testKDFParams, "key1", "key2")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.header == nil || f.header.Version != headerVersion ||
+		len(f.header.Slots) != 1 || f.header.NameSalt == nil {
+		t.Errorf("Store was not upgraded: %+v", f.header)
+	}
+
+	// Old files should be gone, leaving one per key
+	if n := countValues(t, storage, dir); n != len(values) {
+		t.Errorf("Expected %d values on disk, found %d", len(values), n)
+	}
+
+	f, err = openTestStore(portable.UsePosix(), dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.header == nil {
+		t.Fatalf("Upgraded store reopened without a header")
+	}
+	checkValues(t, f, values)
+
+	if _, err = openTestStore(portable.UsePosix(), dir, "badpassword"); err == nil {
+		t.Errorf("Opened upgraded store with bad password!")
+	}
+}
+
+// TestFilestore_UpgradeKDF_UnknownValues checks that an upgrade is refused
+// when the key list does not cover every value in the store.
+func TestFilestore_UpgradeKDF_UnknownValues(t *testing.T) {
+	dir := ".ekv_testdir_upgradekdf_unknown"
+	storage := portable.UsePosix()
+	defer func() {
+		if err := storage.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	values := map[string]string{"key1": "value1", "key2": "value2"}
+	makeLegacyStore(t, storage, dir, "Hello, World!", values)
+
+	f, err := openTestStore(portable.UsePosix(), dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	err = f.UpgradeKDF("Hello, World!", testKDFParams, "key1")
+	if err == nil || err.Error() != fmt.Sprintf(errUnknownValues, 1) {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+
+	// Nothing should have changed
+	f, err = openTestStore(portable.UsePosix(), dir, "Hello, World!")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.header != nil {
+		t.Errorf("Store was upgraded: %+v", f.header)
+	}
+	checkValues(t, f, values)
+}
+
+// faultyStorage wraps a Storage and fails every Create or Remove once the
+// number of allowed calls is used up. A negative count never fails.
+type faultyStorage struct {
+	portable.Storage
+	mux     sync.Mutex
+	creates int
+	removes int
+}
+
+func (s *faultyStorage) Create(name string) (portable.File, error) {
+	s.mux.Lock()
+	if s.creates == 0 {
+		s.mux.Unlock()
+		return nil, errors.New("injected create failure")
+	}
+	s.creates--
+	s.mux.Unlock()
+	return s.Storage.Create(name)
+}
+
+func (s *faultyStorage) Remove(name string) error {
+	s.mux.Lock()
+	if s.removes == 0 {
+		s.mux.Unlock()
+		return errors.New("injected remove failure")
+	}
+	s.removes--
+	s.mux.Unlock()
+	return s.Storage.Remove(name)
+}
+
+func (s *faultyStorage) ReadDir(name string) ([]string, error) {
+	return portable.ReadDir(s.Storage, name)
+}
+
+// newFaultyStorage returns in-memory storage that fails no calls until told
+// to with fail.
+func newFaultyStorage() *faultyStorage {
+	return &faultyStorage{
+		Storage: portable.UseKeyValue(newMemoryKV()),
+		creates: -1,
+		removes: -1,
+	}
+}
+
+// fail sets the number of Create and Remove calls allowed from now on.
+func (s *faultyStorage) fail(creates, removes int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.creates, s.removes = creates, removes
+}
+
+// checkValues verifies that the store holds the values.
+func checkValues(t *testing.T, f *Filestore, values map[string]string) {
+	t.Helper()
+	for k, v := range values {
+		data, err := f.GetBytes(k)
+		if err != nil || string(data) != v {
+			t.Errorf("Bad value for %s: %q, %+v", k, data, err)
+		}
+	}
+}
+
+// countValues returns the number of values held in the directory.
+func countValues(t *testing.T, storage portable.Storage, dir string) int {
+	t.Helper()
+	names, err := portable.ReadDir(storage, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stems := make(map[string]struct{})
+	for _, name := range names {
+		if stem, ok := splitPath(name); ok && !isInternal(stem) {
+			stems[stem] = struct{}{}
+		}
+	}
+	return len(stems)
+}
+
+// TestFilestore_ChangePassword_Legacy changes the password of a version:1
+// store and checks that only the new one opens the store.
+func TestFilestore_ChangePassword_Legacy(t *testing.T) {
+	values := map[string]string{"a": "1", "b": "2", "c": "3"}
+	storage := newFaultyStorage()
+	makeLegacyStore(t, storage, "dir", testPassword, values)
+	f := newTestStore(t, storage, testOptions(), nil)
+
+	err := f.ChangePassword("bad", "new", "a", "b", "c")
+	if err == nil {
+		t.Errorf("Changed password with a bad password")
+	}
+	err = f.ChangePassword(testPassword, "new", "a", "b")
+	if err == nil || err.Error() != fmt.Sprintf(errUnknownValues, 1) {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+
+	if err = f.ChangePassword(testPassword, "new", "a", "b", "c"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if f.header == nil {
+		t.Errorf("Store was not moved to key slots")
+	}
+	checkValues(t, f, values)
+	if n := countValues(t, storage, "dir"); n != len(values) {
+		t.Errorf("Expected %d values on disk, found %d", len(values), n)
+	}
+
+	if _, err = openTestStore(storage, "dir", testPassword); err == nil {
+		t.Errorf("Opened with the old password")
+	}
+	f, err = openTestStore(storage, "dir", "new")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, values)
+}
+
+// TestFilestore_ChangePassword_RollForward interrupts a password change while
+// values are being copied and checks that opening the store with the new
+// password finishes it.
+func TestFilestore_ChangePassword_RollForward(t *testing.T) {
+	values := map[string]string{"a": "1", "b": "2", "c": "3"}
+	storage := newFaultyStorage()
+	makeLegacyStore(t, storage, "dir", testPassword, values)
+	f := newTestStore(t, storage, testOptions(), nil)
+
+	// Allow the journal and one value to be written
+	storage.creates = 4
+	if err := f.ChangePassword(testPassword, "new", "a", "b", "c"); err == nil {
+		t.Fatalf("Password change was not interrupted")
+	}
+	storage.creates = -1
+
+	f, err := openTestStore(storage, "dir", "new")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, values)
+	if n := countValues(t, storage, "dir"); n != len(values) {
+		t.Errorf("Expected %d values on disk, found %d", len(values), n)
+	}
+	if _, err = openTestStore(storage, "dir", testPassword); err == nil {
+		t.Errorf("Opened with the old password")
+	}
+}
+
+// TestFilestore_ChangePassword_RollBack interrupts a password change while
+// values are being copied and checks that opening the store with the old
+// password undoes it.
+func TestFilestore_ChangePassword_RollBack(t *testing.T) {
+	values := map[string]string{"a": "1", "b": "2", "c": "3"}
+	storage := newFaultyStorage()
+	makeLegacyStore(t, storage, "dir", testPassword, values)
+	f := newTestStore(t, storage, testOptions(), nil)
+
+	storage.creates = 4
+	if err := f.ChangePassword(testPassword, "new", "a", "b", "c"); err == nil {
+		t.Fatalf("Password change was not interrupted")
+	}
+	storage.creates = -1
+
+	f, err := openTestStore(storage, "dir", testPassword)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, values)
+	if n := countValues(t, storage, "dir"); n != len(values) {
+		t.Errorf("Expected %d values on disk, found %d", len(values), n)
+	}
+	if _, err = openTestStore(storage, "dir", "new"); err == nil {
+		t.Errorf("Opened with the new password")
+	}
+
+	// The password can still be changed afterwards
+	if err = f.ChangePassword(testPassword, "new", "a", "b", "c"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+// TestFilestore_ChangePassword_Cleanup interrupts a password change after the
+// new header is written and checks that the old files are removed when the
+// store is opened.
+func TestFilestore_ChangePassword_Cleanup(t *testing.T) {
+	values := map[string]string{"a": "1", "b": "2", "c": "3"}
+	storage := newFaultyStorage()
+	makeLegacyStore(t, storage, "dir", testPassword, values)
+	f := newTestStore(t, storage, testOptions(), nil)
+
+	storage.removes = 0
+	if err := f.ChangePassword(testPassword, "new", "a", "b", "c"); err == nil {
+		t.Fatalf("Password change was not interrupted")
+	}
+	storage.removes = -1
+	if n := countValues(t, storage, "dir"); n != 2*len(values) {
+		t.Errorf("Expected old and new values on disk, found %d", n)
+	}
+
+	if _, err := openTestStore(storage, "dir", testPassword); err == nil {
+		t.Errorf("Opened with the old password")
+	}
+	f, err := openTestStore(storage, "dir", "new")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, values)
+	if n := countValues(t, storage, "dir"); n != len(values) {
+		t.Errorf("Expected %d values on disk, found %d", len(values), n)
+	}
+}
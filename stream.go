@@ -0,0 +1,484 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// stream.go stores blobs too large to be held in memory, such as attachments.
+//
+// A blob is encrypted in chunks with the STREAM construction of Hoang,
+// Reyhanitabar, Rogaway and Vizár: every chunk is sealed with the store's
+// cipher suite under a random key used for that blob alone, with a nonce
+// holding the index of the chunk and a flag set only on the last one. Chunks
+// cannot be reordered, dropped or moved to another blob, and the blob cannot
+// be truncated at a chunk boundary without it being detected. Chunks have a
+// fixed size, so any offset can be read by decrypting only the chunk holding
+// it.
+//
+// The chunks are written to a file of their own, which is not a .1/.2 pair:
+// a blob is written once and only then made visible by storing a pointer to
+// it, holding its filename, key and size, as a regular value. Pointers live
+// under names derived from the key with streamPrefix, apart from the values
+// of the same keys, and get the same protection as any other value. The file
+// of the blob a pointer replaces is deleted once the new pointer is written.
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+const (
+	// streamChunkSize is the size of the plaintext of every chunk but the
+	// last.
+	streamChunkSize = 64 << 10
+	// streamPrefix is prepended to keys to name the pointers of their blobs.
+	streamPrefix = "\x00ekv stream\x00"
+	// streamSuffix ends the filename of every blob.
+	streamSuffix = ".blob"
+	// streamIDSize is the size of the random part of blob filenames.
+	streamIDSize = 16
+	// streamCounterSize is the size of the chunk index and last chunk flag
+	// at the end of each nonce.
+	streamCounterSize = 5
+)
+
+// streamPointer is the value stored for a blob.
+type streamPointer struct {
+	// File is the filename of the blob in the store directory
+	File string `json:"file"`
+	// Key is the key the chunks are encrypted under
+	Key []byte `json:"key"`
+	// Size is the size of the plaintext
+	Size int64 `json:"size"`
+	// ChunkSize is the size of the plaintext of each chunk but the last
+	ChunkSize int64 `json:"chunkSize"`
+}
+
+// SetStream stores everything read from the reader as a blob under the key.
+// The blob is encrypted in chunks as it is read, so it is never held in memory
+// whole. It replaces the previous blob under the key once it is completely
+// written, and nothing is replaced if reading or writing fails. The store is
+// not locked while the reader is read, so closing the store meanwhile does
+// not wait for it, and SetStream then returns ErrClosed.
+//
+// Blobs are kept apart from the values of [Filestore.SetBytes]: a key can
+// hold both a value and a blob, and blobs are only read by
+// [Filestore.GetStream] and deleted by [Filestore.DeleteStream].
+func (f *Filestore) SetStream(key string, r io.Reader) error {
+	// The blob is written without holding the store key, so that a slow
+	// reader does not hold up Close and rekeys
+	w, err := f.newBlobWriter(key)
+	if err != nil {
+		return err
+	}
+	p, err := w.write(r)
+	if err != nil {
+		return err
+	}
+	contents, err := json.Marshal(p)
+	zero(p.Key)
+	if err != nil {
+		_ = w.storage.Remove(w.path)
+		return errors.WithStack(err)
+	}
+	defer zero(contents)
+
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err = f.checkOpen(); err != nil {
+		_ = w.storage.Remove(w.path)
+		return err
+	}
+	name := f.keys.name(streamPrefix + key)
+	jww.TRACE.Printf("%s,SETSTREAM,%s,%s", kvDebugHeader, key, name)
+	unlock := f.takeWriteLock(f.getPath(name) + streamSuffix)
+	defer unlock()
+
+	old, err := f.readStreamPointer(name)
+	if err == nil {
+		zero(old.Key)
+	} else if Exists(err) {
+		_ = f.removeBlob(p.File)
+		return err
+	}
+	if err = f.setValue(key, name, contents, false); err != nil {
+		_ = f.removeBlob(p.File)
+		return err
+	}
+
+	if old != nil {
+		return f.removeBlob(old.File)
+	}
+	return nil
+}
+
+// GetStream opens the blob stored under the key. Reads and seeks on the
+// returned stream only decrypt the chunks they touch, and it must be closed
+// once done. Reading a stream may fail once its blob is replaced or deleted.
+func (f *Filestore) GetStream(key string) (io.ReadSeekCloser, error) {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err := f.checkOpen(); err != nil {
+		return nil, err
+	}
+	name := f.keys.name(streamPrefix + key)
+	unlock := f.takeReadLock(f.getPath(name) + streamSuffix)
+	defer unlock()
+
+	p, err := f.readStreamPointer(name)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(p.Key)
+	file, err := f.storage.Open(f.getPath(p.File))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	aead, err := newAEAD(f.header.cipherSuite(), p.Key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &blobReader{
+		file:      file,
+		aead:      aead,
+		size:      p.Size,
+		chunkSize: p.ChunkSize,
+		chunk:     -1,
+	}, nil
+}
+
+// DeleteStream deletes the blob stored under the key, if there is one.
+func (f *Filestore) DeleteStream(key string) error {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err := f.checkOpen(); err != nil {
+		return err
+	}
+	name := f.keys.name(streamPrefix + key)
+	jww.TRACE.Printf("%s,DELETESTREAM,%s,%s", kvDebugHeader, key, name)
+	unlock := f.takeWriteLock(f.getPath(name) + streamSuffix)
+	defer unlock()
+
+	p, err := f.readStreamPointer(name)
+	if !Exists(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	zero(p.Key)
+	if err = f.deleteValue(key, name, false); err != nil {
+		return err
+	}
+	return f.removeBlob(p.File)
+}
+
+// streamKeys returns the keys that name the pointers to the blobs of the keys.
+func streamKeys(keys []string) []string {
+	pointers := make([]string, len(keys))
+	for i, k := range keys {
+		pointers[i] = streamPrefix + k
+	}
+	return pointers
+}
+
+// readStreamPointer reads the pointer stored under the filename.
+func (f *Filestore) readStreamPointer(name string) (*streamPointer, error) {
+	contents, err := f.getValue(name)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(contents)
+
+	p := &streamPointer{}
+	if err = json.Unmarshal(contents, p); err != nil {
+		return nil, errors.Wrap(err, "invalid stream pointer")
+	}
+	if p.Size < 0 || p.ChunkSize <= 0 ||
+		uint64(p.ChunkSize) > maxRecordSize || len(p.Key) != keySize ||
+		!strings.HasSuffix(p.File, streamSuffix) ||
+		strings.ContainsRune(p.File, os.PathSeparator) {
+		return nil, errors.New("invalid stream pointer")
+	}
+	return p, nil
+}
+
+// blobWriter writes a new blob. It holds everything it needs from the store,
+// so that it can be used without holding the store key.
+type blobWriter struct {
+	file    string
+	path    string
+	suite   CipherSuite
+	csprng  io.Reader
+	storage portable.Storage
+}
+
+// newBlobWriter returns a writer for a new blob of the key.
+func (f *Filestore) newBlobWriter(key string) (*blobWriter, error) {
+	f.keyMux.RLock()
+	defer f.keyMux.RUnlock()
+	if err := f.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := f.keys.checkKey(streamPrefix + key); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, streamIDSize)
+	if _, err := io.ReadFull(f.csprng, id); err != nil {
+		return nil, errors.Wrap(err, "could not generate blob name")
+	}
+	file := f.keys.name(streamPrefix+key) + "." + hex.EncodeToString(id) +
+		streamSuffix
+	return &blobWriter{
+		file:    file,
+		path:    f.getPath(file),
+		suite:   f.header.cipherSuite(),
+		csprng:  f.csprng,
+		storage: f.storage,
+	}, nil
+}
+
+// write encrypts everything read from the reader into the blob file and
+// returns its pointer.
+func (w *blobWriter) write(r io.Reader) (*streamPointer, error) {
+	p := &streamPointer{
+		File:      w.file,
+		Key:       make([]byte, keySize),
+		ChunkSize: streamChunkSize,
+	}
+	if _, err := io.ReadFull(w.csprng, p.Key); err != nil {
+		return nil, errors.Wrap(err, "could not generate blob key")
+	}
+	aead, err := newAEAD(w.suite, p.Key)
+	if err != nil {
+		zero(p.Key)
+		return nil, err
+	}
+
+	path := w.path
+	out, err := createFile(path, w.storage)
+	if err != nil {
+		zero(p.Key)
+		return nil, err
+	}
+	fail := func(err error) (*streamPointer, error) {
+		out.Close()
+		_ = w.storage.Remove(path)
+		zero(p.Key)
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	plaintext := make([]byte, streamChunkSize)
+	ciphertext := make([]byte, 0, streamChunkSize+aead.Overhead())
+	nonce := make([]byte, aead.NonceSize())
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(br, plaintext)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return fail(errors.WithStack(err))
+		}
+		if !last {
+			// A full chunk is the last if nothing follows it
+			if _, err = br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return fail(errors.WithStack(err))
+			}
+		}
+		if !last && i == math.MaxUint32 {
+			return fail(errors.Wrap(ErrValueTooLarge, "too many chunks"))
+		}
+
+		// Chunks are far below the size limits of every AEAD, and the
+		// nonce has the size of the AEAD
+		streamNonce(nonce, i, last)
+		ciphertext = aead.Seal(ciphertext[:0], nonce, plaintext[:n], nil)
+		written, err := out.Write(ciphertext)
+		if err != nil {
+			return fail(errors.WithStack(err))
+		} else if written != len(ciphertext) {
+			return fail(errors.Errorf(errShortWrite, path, written,
+				len(ciphertext)))
+		}
+		p.Size += int64(n)
+		if last {
+			break
+		}
+	}
+
+	if err = out.Sync(); err != nil {
+		return fail(errors.WithStack(err))
+	}
+	if err = out.Close(); err != nil {
+		_ = w.storage.Remove(path)
+		zero(p.Key)
+		return nil, errors.WithStack(err)
+	}
+	return p, nil
+}
+
+// removeBlob overwrites the blob file with random data, one chunk at a time,
+// and then deletes it.
+func (f *Filestore) removeBlob(file string) error {
+	path := f.getPath(file)
+	info, err := f.storage.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	out, err := f.storage.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	buf := make([]byte, streamChunkSize)
+	for remaining := info.Size(); remaining > 0; {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err = io.ReadFull(f.csprng, buf[:n]); err == nil {
+			_, err = out.Write(buf[:n])
+		}
+		if err != nil {
+			out.Close()
+			return errors.WithStack(err)
+		}
+		remaining -= n
+	}
+	out.Sync()
+	out.Close()
+	return errors.WithStack(f.storage.Remove(path))
+}
+
+// streamNonce sets the nonce of the chunk at the index. The nonce ends with
+// the big endian index followed by 1 for the last chunk and 0 otherwise. The
+// rest is zero, as every blob has its own key.
+func streamNonce(nonce []byte, index uint32, last bool) {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	counter := nonce[len(nonce)-streamCounterSize:]
+	binary.BigEndian.PutUint32(counter, index)
+	if last {
+		counter[4] = 1
+	}
+}
+
+// blobReader reads a blob, decrypting one chunk at a time.
+type blobReader struct {
+	file      portable.File
+	aead      cipher.AEAD
+	size      int64
+	chunkSize int64
+	offset    int64
+
+	// chunk is the index of the chunk held in plaintext, or -1
+	chunk      int64
+	plaintext  []byte
+	ciphertext []byte
+}
+
+// Read implements [io.Reader].
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.file == nil {
+		return 0, os.ErrClosed
+	}
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	i := b.offset / b.chunkSize
+	if err := b.load(i); err != nil {
+		return 0, err
+	}
+	n := copy(p, b.plaintext[b.offset-i*b.chunkSize:])
+	b.offset += int64(n)
+	return n, nil
+}
+
+// Seek implements [io.Seeker]. Seeking past the end is allowed, after which
+// Read returns io.EOF.
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+// Close implements [io.Closer].
+func (b *blobReader) Close() error {
+	if b.file == nil {
+		return os.ErrClosed
+	}
+	zero(b.plaintext)
+	err := b.file.Close()
+	b.file, b.aead = nil, nil
+	return err
+}
+
+// load decrypts the chunk at the index, unless it is already held.
+func (b *blobReader) load(i int64) error {
+	if i == b.chunk {
+		return nil
+	}
+	chunks := (b.size + b.chunkSize - 1) / b.chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	length := b.chunkSize
+	if i == chunks-1 {
+		length = b.size - i*b.chunkSize
+	}
+
+	overhead := int64(b.aead.Overhead())
+	if int64(cap(b.ciphertext)) < length+overhead {
+		b.ciphertext = make([]byte, length+overhead)
+	}
+	ciphertext := b.ciphertext[:length+overhead]
+	n, err := b.file.ReadAt(ciphertext, i*(b.chunkSize+overhead))
+	if n != len(ciphertext) {
+		if err == nil || err == io.EOF {
+			err = errors.Errorf(errShortRead, b.file.Name(), n,
+				len(ciphertext))
+		}
+		return errors.WithStack(err)
+	}
+
+	nonce := make([]byte, b.aead.NonceSize())
+	streamNonce(nonce, uint32(i), i == chunks-1)
+	b.chunk = -1
+	b.plaintext, err = b.aead.Open(b.plaintext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return errors.Wrapf(err, "cannot decrypt chunk %d", i)
+	}
+	b.chunk = i
+	return nil
+}
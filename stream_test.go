@@ -0,0 +1,306 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// blobFiles returns the contents of every blob file in the kv.
+func blobFiles(t *testing.T, kv *memoryKV) map[string][]byte {
+	t.Helper()
+	keys, err := kv.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, key := range keys {
+		if strings.HasSuffix(key, streamSuffix) {
+			files[key], _ = kv.Get(key)
+		}
+	}
+	return files
+}
+
+// TestFilestore_Stream writes blobs of sizes around the chunk size and reads
+// them back whole.
+func TestFilestore_Stream(t *testing.T) {
+	kv := newMemoryKV()
+	f, err := openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize,
+		streamChunkSize + 1, 3*streamChunkSize + 100} {
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+		if err = f.SetStream("blob", bytes.NewReader(data)); err != nil {
+			t.Fatalf("%d: %+v", size, err)
+		}
+		if n := len(blobFiles(t, kv)); n != 1 {
+			t.Errorf("%d: %d blob files after replacing the blob", size, n)
+		}
+
+		r, err := f.GetStream("blob")
+		if err != nil {
+			t.Fatalf("%d: %+v", size, err)
+		}
+		read, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(read, data) {
+			t.Errorf("%d: read %d bytes: %+v", size, len(read), err)
+		}
+		if err = r.Close(); err != nil {
+			t.Errorf("%d: %+v", size, err)
+		}
+	}
+
+	// Blobs and values are kept apart
+	if _, err = f.GetBytes("blob"); Exists(err) {
+		t.Errorf("Blob was read as a value: %v", err)
+	}
+	if err = f.SetBytes("blob", []byte("value")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"blob": "value"})
+
+	if err = f.DeleteStream("blob"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err = f.GetStream("blob"); Exists(err) {
+		t.Errorf("Unexpected error for a deleted blob: %v", err)
+	}
+	if n := len(blobFiles(t, kv)); n != 0 {
+		t.Errorf("%d blob files after deleting the blob", n)
+	}
+	checkValues(t, f, map[string]string{"blob": "value"})
+	if err = f.DeleteStream("blob"); err != nil {
+		t.Errorf("Deleting a missing blob failed: %+v", err)
+	}
+}
+
+// TestFilestore_Stream_Seek reads from random offsets and checks that only the
+// chunk holding the offset is decrypted.
+func TestFilestore_Stream_Seek(t *testing.T) {
+	f, err := openTestStore(portable.UseKeyValue(newMemoryKV()), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data := make([]byte, 5*streamChunkSize+17)
+	_, _ = rand.Read(data)
+	if err = f.SetStream("blob", bytes.NewReader(data)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	r, err := f.GetStream("blob")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer r.Close()
+
+	for _, offset := range []int64{3*streamChunkSize + 5, 10,
+		int64(len(data)) - 3, streamChunkSize - 2} {
+		if _, err = r.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		n, err := io.ReadFull(r, buf)
+		end := offset + 4
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if !bytes.Equal(buf[:n], data[offset:end]) {
+			t.Errorf("Read %x at %d, expected %x: %v", buf[:n], offset,
+				data[offset:end], err)
+		}
+		if chunk := r.(*blobReader).chunk; chunk != (end-1)/streamChunkSize {
+			t.Errorf("Chunk %d is held after reading at %d", chunk, offset)
+		}
+	}
+
+	if pos, err := r.Seek(-1, io.SeekEnd); err != nil ||
+		pos != int64(len(data))-1 {
+		t.Errorf("Seeking from the end returned %d: %v", pos, err)
+	}
+	if _, err = r.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("Seeked to a negative position")
+	}
+	if _, err = r.Seek(1, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Unexpected error reading past the end: %v", err)
+	}
+}
+
+// TestFilestore_Stream_Tampered checks that reordered and truncated chunks are
+// detected.
+func TestFilestore_Stream_Tampered(t *testing.T) {
+	kv := newMemoryKV()
+	f, err := openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data := make([]byte, 2*streamChunkSize)
+	if err = f.SetStream("blob", bytes.NewReader(data)); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var path string
+	var original []byte
+	for path, original = range blobFiles(t, kv) {
+	}
+	chunk := len(original) / 2
+
+	swapped := append(append([]byte(nil), original[chunk:]...),
+		original[:chunk]...)
+	// The first chunk repeated, so that the last chunk is not marked last
+	truncated := append(append([]byte(nil), original[:chunk]...),
+		original[:chunk]...)
+	for i, contents := range [][]byte{swapped, truncated} {
+		if err = kv.Set(path, contents); err != nil {
+			t.Fatal(err)
+		}
+		r, err := f.GetStream("blob")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if _, err = io.ReadAll(r); err == nil {
+			t.Errorf("Read modified blob %d", i)
+		}
+		r.Close()
+	}
+}
+
+// failingReader returns an error after the data it holds.
+type failingReader struct {
+	r io.Reader
+}
+
+// Read implements [io.Reader].
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("read failed")
+	}
+	return n, err
+}
+
+// TestFilestore_Stream_Failed checks that a blob whose reader fails does not
+// replace the previous one.
+func TestFilestore_Stream_Failed(t *testing.T) {
+	kv := newMemoryKV()
+	f, err := openTestStore(portable.UseKeyValue(kv), "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetStream("blob", strings.NewReader("old")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	r := &failingReader{bytes.NewReader(make([]byte, 2*streamChunkSize))}
+	if err = f.SetStream("blob", r); err == nil {
+		t.Errorf("Stored a blob whose reader failed")
+	}
+	if n := len(blobFiles(t, kv)); n != 1 {
+		t.Errorf("%d blob files after a failed write", n)
+	}
+
+	stream, err := f.GetStream("blob")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer stream.Close()
+	if read, err := io.ReadAll(stream); err != nil || string(read) != "old" {
+		t.Errorf("Read %q: %+v", read, err)
+	}
+}
+
+// waitingReader blocks once its data is read until it is released.
+type waitingReader struct {
+	r       io.Reader
+	waiting chan struct{}
+	release chan struct{}
+}
+
+// Read implements [io.Reader].
+func (w *waitingReader) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	if err == io.EOF {
+		close(w.waiting)
+		<-w.release
+	}
+	return n, err
+}
+
+// TestFilestore_Stream_Close checks that a store can be closed while a blob
+// is read from a slow reader, and that the blob is then not stored.
+func TestFilestore_Stream_Close(t *testing.T) {
+	kv := newMemoryKV()
+	f := newTestStore(t, portable.UseKeyValue(kv), testOptions(), nil)
+	r := &waitingReader{
+		r:       bytes.NewReader(make([]byte, 2*streamChunkSize)),
+		waiting: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f.SetStream("blob", r)
+	}()
+	<-r.waiting
+
+	closed := make(chan struct{})
+	go func() {
+		f.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close waited for the reader")
+	}
+	close(r.release)
+
+	if err := <-done; !errors.Is(err, ErrClosed) {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if n := len(blobFiles(t, kv)); n != 0 {
+		t.Errorf("%d blob files after the store was closed", n)
+	}
+}
+
+// TestFilestore_Stream_Rekey checks that blobs are kept when a version:1 store
+// is moved to a key slot.
+func TestFilestore_Stream_Rekey(t *testing.T) {
+	values := map[string]string{"a": "1", "b": "2"}
+	storage := portable.UseKeyValue(newMemoryKV())
+	makeLegacyStore(t, storage, "dir", testPassword, values)
+	f := newTestStore(t, storage, testOptions(), nil)
+	if err := f.SetStream("a", strings.NewReader("blob")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	err := f.UpgradeKDF(testPassword, testKDFParams, "a", "b")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, values)
+
+	r, err := f.GetStream("a")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer r.Close()
+	if read, err := io.ReadAll(r); err != nil || string(read) != "blob" {
+		t.Errorf("Read %q: %+v", read, err)
+	}
+}
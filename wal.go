@@ -0,0 +1,518 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+// wal.go makes transactions atomic with a redo journal. Before a transaction
+// that changes more than one value touches any of them, every write and
+// delete it makes is recorded in a .ekv.tx file, encrypted under the content
+// key. Journals are kept in a fixed set of slots, so that concurrent
+// transactions on other keys do not share one and so that the store finds
+// them again without listing its directory, which not every storage can do.
+// Each journal records a sequence number, which orders the transactions by
+// when they committed. Writes are recorded as the ciphertexts that will be
+// written, along with their versions, so that applying the journal again
+// writes exactly the same files. The transaction then proceeds in three
+// steps:
+//
+//  1. The journal is written and synced. This is the commit point.
+//  2. The values are written and deleted.
+//  3. The journal is removed, before the keys are unlocked.
+//
+// If a write or delete fails in step 2, the transaction is rolled back by
+// writing back the ciphertexts the values had before, which are kept in
+// memory rather than in the journal, and the journal is removed. Only if that
+// fails as well is the journal left behind, and its slot is not used again
+// until the store is reopened.
+//
+// When a store is opened, the journals left by interrupted transactions are
+// applied again in the order they committed, which finishes them. A journal
+// whose write was interrupted cannot be read back, and as no value was
+// touched yet it is discarded, which leaves the transaction undone. A journal
+// that could not be removed after its transaction was applied may be followed
+// by newer changes to its values, so entries whose value changed since are
+// skipped: in stores with a manifest, those whose value has a newer version,
+// and in others, those whose value holds neither the ciphertext written by
+// the entry nor the one it had before, which the journal keeps a hash of.
+// Without a manifest, a value that the transaction added and that was deleted
+// afterwards cannot be told from one the transaction never reached, and is
+// written again. Transactions that change a single value need no journal, as
+// each value is written atomically.
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/crypto/blake2b"
+)
+
+// txJournalPrefix starts the filename of every transaction journal.
+const txJournalPrefix = ekvFilename + ".tx."
+
+// txJournalSlots is the number of journals that can exist at once, which
+// bounds the number of transactions that commit concurrently.
+const txJournalSlots = 16
+
+// txJournal is the contents of a .ekv.tx file.
+type txJournal struct {
+	// Sequence orders the journal after those of the transactions that
+	// committed before it.
+	Sequence uint64    `json:"sequence"`
+	Entries  []txEntry `json:"entries"`
+}
+
+// journalName returns the filename of the journal in the slot.
+func journalName(slot int) string {
+	return txJournalPrefix + strconv.Itoa(slot)
+}
+
+// journalSlots hands out the journal slots to committing transactions, along
+// with their sequence numbers.
+type journalSlots struct {
+	mux  sync.Mutex
+	cond *sync.Cond
+	free []int
+	// lost is the number of slots whose journal is kept for when the store
+	// is opened again
+	lost int
+	seq  uint64
+}
+
+// newJournalSlots returns every journal slot as free.
+func newJournalSlots() *journalSlots {
+	s := &journalSlots{free: make([]int, txJournalSlots)}
+	s.cond = sync.NewCond(&s.mux)
+	for i := range s.free {
+		s.free[i] = txJournalSlots - 1 - i
+	}
+	return s
+}
+
+// acquire waits for a free slot and returns it with the next sequence
+// number. It fails if no slot will be freed before the store is reopened.
+func (s *journalSlots) acquire() (int, uint64, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for len(s.free) == 0 {
+		if s.lost == txJournalSlots {
+			return 0, 0, errors.New("every transaction journal is kept " +
+				"for failed rollbacks; reopen the store to finish them")
+		}
+		s.cond.Wait()
+	}
+	slot := s.free[len(s.free)-1]
+	s.free = s.free[:len(s.free)-1]
+	s.seq++
+	return slot, s.seq, nil
+}
+
+// release frees the slot once its journal is no longer needed.
+func (s *journalSlots) release(slot int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.free = append(s.free, slot)
+	s.cond.Signal()
+}
+
+// lose keeps a slot out of use, as its journal still has to be finished when
+// the store is opened again.
+func (s *journalSlots) lose() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.lost++
+	s.cond.Broadcast()
+}
+
+// txEntry is a single write or delete of a transaction.
+type txEntry struct {
+	// Key is the key of the value, which is added to or removed from the
+	// index.
+	Key string `json:"key"`
+	// Name is the filename of the value.
+	Name string `json:"name"`
+	// Value is the ciphertext written to the files of the value, or nil if
+	// the value is deleted.
+	Value []byte `json:"value,omitempty"`
+	// Version is the version of the written value, or the one its deletion
+	// is recorded under, in stores with a manifest.
+	Version uint64 `json:"version,omitempty"`
+	// Size is the size of the ciphertext of a deleted value, which is
+	// overwritten by a decoy of that size in stores with decoys.
+	Size int `json:"size,omitempty"`
+	// Old is the ciphertext of the value before the transaction, or nil if
+	// there was none. It is written back if the transaction is rolled back.
+	Old []byte `json:"-"`
+	// OldSum is the hash of Old, or nil if there was no value, which tells
+	// a value that was not reached yet from one changed since.
+	OldSum []byte `json:"oldSum,omitempty"`
+}
+
+// ciphertextSum returns the hash of a ciphertext kept in a journal, or nil if
+// there is none.
+func ciphertextSum(ciphertext []byte) []byte {
+	if ciphertext == nil {
+		return nil
+	}
+	sum := blake2b.Sum256(ciphertext)
+	return sum[:]
+}
+
+// commitTransaction writes the journal of a transaction that changes more than
+// one value, applies it and removes it. It reports whether the transaction
+// added or removed a value, and the size of the last such value. If the
+// transaction cannot be applied, it is rolled back. The caller must hold the
+// write locks of the values.
+func (f *Filestore) commitTransaction(j *txJournal) (bool, int, error) {
+	if len(j.Entries) < 2 {
+		changed, size, undo, err := f.applyTransaction(j)
+		if err != nil {
+			return false, 0, rollbackError(err, undo())
+		}
+		return changed, size, nil
+	}
+
+	slot, seq, err := f.journals.acquire()
+	if err != nil {
+		return false, 0, err
+	}
+	j.Sequence = seq
+	name := journalName(slot)
+	if err = f.writeTransaction(name, j); err != nil {
+		f.journals.release(slot)
+		return false, 0, err
+	}
+
+	changed, size, undo, err := f.applyTransaction(j)
+	if err != nil {
+		if undoErr := undo(); undoErr != nil {
+			// The journal finishes the transaction once the store is opened
+			// again
+			f.journals.lose()
+			return false, 0, rollbackError(err, undoErr)
+		}
+		undoErr := deleteFiles(f.getPath(name), f.csprng, f.storage)
+		if undoErr != nil {
+			f.journals.lose()
+			return false, 0, errors.WithMessagef(err, "could not remove the "+
+				"journal of the rolled back transaction, which will be "+
+				"finished when the store is opened again: %v", undoErr)
+		}
+		f.journals.release(slot)
+		return false, 0, err
+	}
+
+	// A journal that cannot be removed is overwritten by the next one in its
+	// slot, as its transaction is complete
+	err = deleteFiles(f.getPath(name), f.csprng, f.storage)
+	f.journals.release(slot)
+	return changed, size, errors.WithStack(err)
+}
+
+// writeTransaction encrypts the journal and writes it to the file. Once it
+// returns, the transaction has committed.
+func (f *Filestore) writeTransaction(name string, j *txJournal) error {
+	contents, err := json.Marshal(j)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	encryptedContents, err := sealValue(f.header, f.keys.content, name,
+		contents, f.csprng)
+	zero(contents)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(write(f.getPath(name), encryptedContents,
+		f.storage))
+}
+
+// rollbackError returns the error that failed a transaction, noting that it
+// could not be rolled back if undoErr is set.
+func rollbackError(err, undoErr error) error {
+	if undoErr == nil {
+		return err
+	}
+	jww.ERROR.Printf("Could not roll back a failed transaction: %+v", undoErr)
+	return errors.WithMessagef(err, "could not roll back the transaction, "+
+		"which may be partially applied: %v", undoErr)
+}
+
+// applyTransaction makes the writes and deletes of the journal. Applying it
+// again has no further effect, so an interrupted transaction is finished by
+// applying its journal. It reports whether a value was added or removed, and
+// the size of the last such value. If it fails, undo rolls back the changes
+// it made, which needs the Old ciphertexts of the entries. The caller must
+// hold the write locks of the values.
+func (f *Filestore) applyTransaction(j *txJournal) (changed bool, size int,
+	undo func() error, err error) {
+	var written, deleted []string
+	for _, entry := range j.Entries {
+		if entry.Value != nil {
+			written = append(written, entry.Key)
+		} else {
+			deleted = append(deleted, entry.Key)
+		}
+	}
+
+	// Keys are in the index before their values are written
+	indexAdded, err := f.indexAdd(written...)
+	if err != nil {
+		return false, 0, func() error { return nil }, err
+	}
+
+	added := make([]bool, len(j.Entries))
+	undos := make([]func() error, len(j.Entries))
+	results := make([]error, len(j.Entries))
+	runBatch(len(j.Entries), func(i int) {
+		added[i], undos[i], results[i] = f.applyEntry(j.Entries[i])
+	})
+	undo = func() error { return f.rollbackTransaction(j, undos) }
+	for i, entry := range j.Entries {
+		if results[i] != nil {
+			return false, 0, undo, results[i]
+		}
+		if added[i] {
+			changed = true
+			size = entry.Size
+			if entry.Value != nil {
+				size = len(entry.Value)
+			}
+		}
+	}
+
+	if err = f.indexRemove(deleted...); err != nil {
+		return false, 0, undo, err
+	}
+	f.indexSettle(indexAdded...)
+	return changed, size, undo, nil
+}
+
+// rollbackTransaction undoes the entries of a transaction that failed and
+// removes the keys of the values it added from the index. The caller must
+// hold the write locks of the values.
+func (f *Filestore) rollbackTransaction(j *txJournal,
+	undos []func() error) error {
+	results := make([]error, len(undos))
+	runBatch(len(undos), func(i int) {
+		if undos[i] != nil {
+			results[i] = undos[i]()
+		}
+	})
+	for _, err := range results {
+		if err != nil {
+			return err
+		}
+	}
+
+	var added []string
+	for _, entry := range j.Entries {
+		if entry.Value != nil && entry.Old == nil {
+			added = append(added, entry.Key)
+		}
+	}
+	return f.indexRemove(added...)
+}
+
+// applyEntry makes a single write or delete of a transaction and reports
+// whether it added or removed a value. It returns a function that writes
+// back the Old ciphertext of the entry and restores the bookkeeping of the
+// value, or nil if nothing needs to be undone, even if the entry failed
+// partway. The caller must hold the write lock of the value.
+func (f *Filestore) applyEntry(entry txEntry) (bool, func() error, error) {
+	encryptedKey := f.getPath(entry.Name)
+	previous, known := f.manifest.lookup(entry.Name)
+	restore := func() error {
+		if entry.Old != nil {
+			if err := write(encryptedKey, entry.Old, f.storage); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		f.manifest.restore(entry.Name, previous, known)
+		return nil
+	}
+
+	if entry.Value != nil {
+		wasDecoy := f.isDecoy(entry.Name)
+		added, release := f.claimDecoy(entry.Name)
+		if err := write(encryptedKey, entry.Value, f.storage); err != nil {
+			release()
+			return false, nil, errors.WithStack(err)
+		}
+		f.manifest.commit(entry.Name, entry.Version)
+		if entry.Old != nil {
+			return added, restore, nil
+		}
+
+		// A new value is removed again, or turned back into a decoy
+		return added, func() error {
+			var err error
+			if wasDecoy {
+				err = f.overwriteDecoy(encryptedKey, len(entry.Value))
+			} else {
+				err = deleteFiles(encryptedKey, f.csprng, f.storage)
+			}
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			release()
+			return restore()
+		}, nil
+	}
+
+	if f.decoys == nil {
+		err := deleteFiles(encryptedKey, f.csprng, f.storage)
+		if err != nil {
+			return false, restore, errors.WithStack(err)
+		}
+		f.manifest.remove(entry.Name)
+		return true, restore, nil
+	}
+
+	// The value becomes a decoy instead of being removed, unless it already
+	// did before the transaction was interrupted
+	if f.isDecoy(entry.Name) || !f.hasValue(entry.Name) {
+		f.manifest.remove(entry.Name)
+		return false, restore, nil
+	}
+	if err := f.retireValue(entry.Name, entry.Size); err != nil {
+		return false, restore, err
+	}
+	f.manifest.remove(entry.Name)
+	return true, func() error {
+		if err := restore(); err != nil {
+			return err
+		}
+		f.decoys.claim(entry.Name)
+		return nil
+	}, nil
+}
+
+// replayTransactions finishes the transactions interrupted after writing
+// their journal, in the order they committed, and removes the journals. It is
+// called while the store is opened, once its manifest, index and decoys are
+// loaded.
+func (f *Filestore) replayTransactions() error {
+	var names []string
+	var journals []*txJournal
+	for slot := 0; slot < txJournalSlots; slot++ {
+		name := journalName(slot)
+		j, found, err := f.readTransaction(name)
+		if err != nil {
+			return err
+		} else if !found {
+			continue
+		}
+		names = append(names, name)
+		if j != nil {
+			journals = append(journals, j)
+			f.journals.seq = max(f.journals.seq, j.Sequence)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Slice(journals, func(a, b int) bool {
+		return journals[a].Sequence < journals[b].Sequence
+	})
+
+	changed, size := false, 0
+	for _, j := range journals {
+		jww.INFO.Printf("Finishing a transaction of %d values in %s",
+			len(j.Entries), f.basedir)
+		entries := j.Entries[:0]
+		for _, entry := range j.Entries {
+			if f.superseded(entry) {
+				jww.WARN.Printf("Skipping a value of a transaction in %s "+
+					"that was changed since", f.basedir)
+			} else {
+				entries = append(entries, entry)
+			}
+		}
+		j.Entries = entries
+		added, n, _, err := f.applyTransaction(j)
+		if err != nil {
+			return err
+		}
+		if added {
+			changed, size = true, n
+		}
+	}
+	for _, name := range names {
+		err := deleteFiles(f.getPath(name), f.csprng, f.storage)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if err := f.saveManifest(); err != nil {
+		return err
+	}
+	if changed {
+		return f.reconcileDecoys(size)
+	}
+	return nil
+}
+
+// superseded returns true if the value of a journal entry was changed after
+// the transaction was applied, so that replaying the entry would undo the
+// newer change.
+func (f *Filestore) superseded(entry txEntry) bool {
+	if f.manifest != nil {
+		current, ok := f.manifest.lookup(entry.Name)
+		return ok && current.Version > entry.Version
+	}
+
+	var current []byte
+	if !f.isDecoy(entry.Name) {
+		var err error
+		current, err = read(f.getPath(entry.Name), f.storage)
+		if err != nil && Exists(err) {
+			// Replaying the entry repairs a value that cannot be read
+			return false
+		}
+	}
+	if len(current) == 0 {
+		// The value is missing, which is what the entry leaves if it
+		// deletes it, and what it found if it adds it
+		return entry.Value != nil && entry.OldSum != nil
+	}
+	return !bytes.Equal(current, entry.Value) &&
+		!bytes.Equal(ciphertextSum(current), entry.OldSum)
+}
+
+// readTransaction reads and decrypts the journal of a transaction, and
+// reports whether there is one. It returns a nil journal if the journal was
+// not fully written, which means that the transaction never reached its
+// commit point.
+func (f *Filestore) readTransaction(name string) (*txJournal, bool, error) {
+	contents, err := read(f.getPath(name), f.storage)
+	if !Exists(err) {
+		return nil, false, nil
+	} else if err != nil && !errors.Is(err, ErrCorrupt) {
+		return nil, false, errors.WithStack(err)
+	} else if err != nil || len(contents) == 0 {
+		jww.WARN.Printf("Discarding the incomplete transaction journal %s "+
+			"in %s: %v", name, f.basedir, err)
+		return nil, true, nil
+	}
+	plaintext, err := openValue(f.header, f.keys.content, name, contents)
+	if err != nil {
+		return nil, false, errors.WithMessage(err,
+			"invalid transaction journal")
+	}
+	defer zero(plaintext)
+	j := &txJournal{}
+	if err = json.Unmarshal(plaintext, j); err != nil {
+		return nil, false, corrupt(errors.Wrap(err,
+			"invalid transaction journal"))
+	}
+	return j, true, nil
+}
@@ -0,0 +1,541 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2024 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package ekv
+
+import (
+	"crypto/rand"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/ekv/portable"
+)
+
+// interruptTransaction runs a transaction that writes b and c and deletes a,
+// and lets the storage fail once the journal and a single value are written,
+// as if the process died midway. As the storage keeps failing, the
+// transaction cannot be rolled back either.
+func interruptTransaction(t *testing.T, storage *faultyStorage, f *Filestore) {
+	t.Helper()
+	err := f.Transaction(func(files map[string]Operable, _ Extender) error {
+		storage.fail(2, 0)
+		files["a"].Delete()
+		files["b"].Set([]byte("new"))
+		files["c"].Set([]byte("new"))
+		return nil
+	}, "a", "b", "c")
+	storage.fail(-1, -1)
+	if err == nil {
+		t.Fatalf("Transaction was not interrupted")
+	}
+}
+
+// countJournals returns the number of transaction journals in the directory.
+func countJournals(t *testing.T, storage portable.Storage) int {
+	t.Helper()
+	names, err := portable.ReadDir(storage, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, name := range names {
+		if strings.HasPrefix(name, txJournalPrefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// TestFilestore_Transaction_Journal checks that a transaction interrupted
+// after its commit point is finished when the store is opened again.
+func TestFilestore_Transaction_Journal(t *testing.T) {
+	opts := testOptions()
+	opts.Index = true
+	opts.Manifest = true
+	storage := newFaultyStorage()
+	f := newTestStore(t, storage, opts, map[string]string{"a": "old",
+		"b": "old"})
+	interruptTransaction(t, storage, f)
+	if countJournals(t, storage) == 0 {
+		t.Fatalf("Interrupted transaction left no journal")
+	}
+
+	f, err := openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"b": "new", "c": "new"})
+	if _, err = f.GetBytes("a"); Exists(err) {
+		t.Errorf("Deleted value still exists: %+v", err)
+	}
+	checkKeys(t, f, "b", "c")
+	if n := countJournals(t, storage); n != 0 {
+		t.Errorf("%d journals left after reopening", n)
+	}
+
+	// Transactions go on from the replayed state
+	if err = f.SetBytes("c", []byte("newer")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"c": "newer"})
+}
+
+// TestFilestore_Transaction_Journal_Decoys finishes an interrupted
+// transaction in a store with decoys, which must stay in step with the
+// values.
+func TestFilestore_Transaction_Journal_Decoys(t *testing.T) {
+	opts := testOptions()
+	opts.Decoys = DecoyPolicy{Step: 4}
+	storage := newFaultyStorage()
+	f := newTestStore(t, storage, opts, map[string]string{"a": "old",
+		"b": "old"})
+	interruptTransaction(t, storage, f)
+
+	f, err := openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"b": "new", "c": "new"})
+	if _, err = f.GetBytes("a"); Exists(err) {
+		t.Errorf("Deleted value still exists: %+v", err)
+	}
+	if shortfall := f.decoys.shortfall(); shortfall != 0 {
+		t.Errorf("Decoys are short by %d", shortfall)
+	}
+}
+
+// TestFilestore_Transaction_Journal_NoDirReader checks that an interrupted
+// transaction is finished on storage that cannot list its files.
+func TestFilestore_Transaction_Journal_NoDirReader(t *testing.T) {
+	storage := newFaultyStorage()
+	unlisted := struct{ portable.Storage }{storage}
+	f := newTestStore(t, unlisted, testOptions(),
+		map[string]string{"a": "old", "b": "old"})
+	interruptTransaction(t, storage, f)
+	if countJournals(t, storage) == 0 {
+		t.Fatalf("Interrupted transaction left no journal")
+	}
+
+	f, err := openTestStore(unlisted, "dir", testPassword)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"b": "new", "c": "new"})
+	if _, err = f.GetBytes("a"); Exists(err) {
+		t.Errorf("Deleted value still exists: %+v", err)
+	}
+	if n := countJournals(t, storage); n != 0 {
+		t.Errorf("%d journals left after reopening", n)
+	}
+}
+
+// TestFilestore_Transaction_Journal_Order leaves the journals of two
+// transactions on the same value in the reverse order of their slots and
+// checks that they are replayed in the order they committed.
+func TestFilestore_Transaction_Journal_Order(t *testing.T) {
+	storage := portable.UseKeyValue(newMemoryKV())
+	f := newTestStore(t, storage, testOptions(), map[string]string{"a": "old"})
+	name := f.keys.name("a")
+	old, err := read(f.getPath(name), storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values [2][]byte
+	for i, v := range []string{"first", "second"} {
+		values[i], err = sealVersionedValue(f.header, f.keys.content, name, 0,
+			[]byte(v), rand.Reader)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	journals := map[int]*txJournal{
+		0: {Sequence: 2, Entries: []txEntry{{Key: "a", Name: name,
+			Value: values[1], OldSum: ciphertextSum(values[0])}}},
+		1: {Sequence: 1, Entries: []txEntry{{Key: "a", Name: name,
+			Value: values[0], OldSum: ciphertextSum(old)}}},
+	}
+	for slot, j := range journals {
+		if err = f.writeTransaction(journalName(slot), j); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	f, err = openTestStore(storage, "dir", testPassword)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"a": "second"})
+	if f.journals.seq != 2 {
+		t.Errorf("Sequence did not go on from the journals: %d",
+			f.journals.seq)
+	}
+}
+
+// TestFilestore_Transaction_Journal_Torn checks that a journal whose write
+// was interrupted is discarded, leaving the values untouched.
+func TestFilestore_Transaction_Journal_Torn(t *testing.T) {
+	storage := newFaultyStorage()
+	f := newTestStore(t, storage, testOptions(),
+		map[string]string{"a": "old"})
+	name := f.getPath(journalName(0)) + ".1"
+	file, err := storage.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.Write([]byte{0, 8, 0}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"a": "old"})
+	if n := countJournals(t, storage); n != 0 {
+		t.Errorf("%d journals left after reopening", n)
+	}
+}
+
+// TestFilestore_Transaction_Journal_Corrupt checks that a complete journal
+// that does not decrypt stops the store from opening, rather than being
+// dropped along with the transaction it finishes.
+func TestFilestore_Transaction_Journal_Corrupt(t *testing.T) {
+	storage := newFaultyStorage()
+	f := newTestStore(t, storage, testOptions(), nil)
+	name := f.getPath(journalName(0))
+	if err := write(name, []byte("not a journal"), storage); err != nil {
+		t.Fatal(err)
+	}
+	_, err := openTestStore(storage, "dir", "password")
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Unexpected error for a corrupt journal: %+v", err)
+	}
+}
+
+// testTransactionAbort checks that writes flushed by an operation that then
+// fails are not committed.
+func testTransactionAbort(t *testing.T, kv KeyValue) {
+	if err := kv.SetBytes("a", []byte("old")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	abort := errors.New("abort")
+	err := kv.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Set([]byte("new"))
+		files["b"].Set([]byte("new"))
+		if err := files["a"].Flush(); err != nil {
+			return err
+		}
+		return abort
+	}, "a", "b")
+	if err != abort {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	if data, err := kv.GetBytes("a"); err != nil || string(data) != "old" {
+		t.Errorf("Write of an aborted transaction landed: %q, %+v", data, err)
+	}
+	if ok, err := kv.Has("b"); err != nil || ok {
+		t.Errorf("Write of an aborted transaction landed: %t, %+v", ok, err)
+	}
+}
+
+// TestFilestore_Transaction_Abort checks that a Filestore commits none of the
+// writes of a failed transaction.
+func TestFilestore_Transaction_Abort(t *testing.T) {
+	f := newTestStore(t, nil, testOptions(), nil)
+	testTransactionAbort(t, f)
+}
+
+// TestMemstore_Transaction_Abort checks that a Memstore commits none of the
+// writes of a failed transaction.
+func TestMemstore_Transaction_Abort(t *testing.T) {
+	testTransactionAbort(t, MakeMemstore())
+}
+
+// flakyStorage wraps a Storage and fails the next Create of a file of the
+// path, once.
+type flakyStorage struct {
+	portable.Storage
+	mux  sync.Mutex
+	path string
+}
+
+func (s *flakyStorage) Create(name string) (portable.File, error) {
+	s.mux.Lock()
+	if s.path != "" && strings.HasPrefix(name, s.path) {
+		s.path = ""
+		s.mux.Unlock()
+		return nil, errors.New("injected create failure")
+	}
+	s.mux.Unlock()
+	return s.Storage.Create(name)
+}
+
+func (s *flakyStorage) ReadDir(name string) ([]string, error) {
+	return portable.ReadDir(s.Storage, name)
+}
+
+// failNext makes the next write of the value of the key fail.
+func (s *flakyStorage) failNext(f *Filestore, key string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.path = f.getPath(f.keys.name(key))
+}
+
+// testTransactionRollback fails the write of a value during a transaction and
+// checks that the rest of it is rolled back.
+func testTransactionRollback(t *testing.T, opts Options) {
+	storage := &flakyStorage{Storage: portable.UseKeyValue(newMemoryKV())}
+	f, err := NewGenericFilestoreWithOptions(storage, "dir", "password",
+		rand.Reader, opts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err = f.SetBytes(key, []byte("old")); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+
+	storage.failNext(f, "c")
+	err = f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Delete()
+		files["b"].Set([]byte("new"))
+		files["c"].Set([]byte("new"))
+		return nil
+	}, "a", "b", "c")
+	if err == nil || strings.Contains(err.Error(), "roll back") {
+		t.Fatalf("Unexpected error for a failed write: %+v", err)
+	}
+	check := func(f *Filestore) {
+		t.Helper()
+		checkValues(t, f, map[string]string{"a": "old", "b": "old"})
+		if ok, err := f.Has("c"); err != nil || ok {
+			t.Errorf("Write of a rolled back transaction landed: %t, %+v",
+				ok, err)
+		}
+		if opts.Index {
+			checkKeys(t, f, "a", "b")
+		}
+		if f.decoys != nil && f.decoys.shortfall() != 0 {
+			t.Errorf("Decoys are short by %d", f.decoys.shortfall())
+		}
+	}
+	check(f)
+	if n := countJournals(t, storage); n != 0 {
+		t.Errorf("%d journals left after rolling back", n)
+	}
+
+	// Rolled back values can be written again
+	if err = f.SetBytes("b", []byte("newer")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("b", []byte("old")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	f, err = openTestStore(storage, "dir", "password")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	check(f)
+}
+
+// TestFilestore_Transaction_Rollback rolls back transactions in stores with
+// and without an index, a manifest and decoys.
+func TestFilestore_Transaction_Rollback(t *testing.T) {
+	plain := testOptions()
+	indexed := testOptions()
+	indexed.Index = true
+	indexed.Manifest = true
+	decoys := testOptions()
+	decoys.Decoys = DecoyPolicy{Step: 4}
+	for name, opts := range map[string]Options{"plain": plain,
+		"indexed": indexed, "decoys": decoys} {
+		t.Run(name, func(t *testing.T) {
+			testTransactionRollback(t, opts)
+		})
+	}
+}
+
+// TestFilestore_Transaction_Close closes the store while the operation of a
+// transaction runs and uses the store, and checks that Close waits for the
+// transaction to commit rather than deadlocking with it.
+func TestFilestore_Transaction_Close(t *testing.T) {
+	storage := portable.UseKeyValue(newMemoryKV())
+	f := newTestStore(t, storage, testOptions(),
+		map[string]string{"a": "1", "b": "2"})
+
+	closed := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Transaction(func(files map[string]Operable,
+			ext Extender) error {
+			go func() {
+				f.Close()
+				close(closed)
+			}()
+			// Give Close time to wait for the store
+			time.Sleep(50 * time.Millisecond)
+
+			if data, err := f.GetBytes("b"); err != nil ||
+				string(data) != "2" {
+				return errors.Errorf("bad value for b: %q, %+v", data, err)
+			}
+			if _, err := ext.Extend([]string{"c"}); err != nil {
+				return err
+			}
+			files["a"].Set([]byte("new"))
+			return nil
+		}, "a")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Transaction deadlocked with Close")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close did not return after the transaction")
+	}
+
+	if _, err := f.GetBytes("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Store was not closed: %+v", err)
+	}
+	f, err := openTestStore(storage, "dir", testPassword)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"a": "new", "b": "2"})
+}
+
+// TestFilestore_Transaction_JournalFailure checks that a transaction whose
+// journal cannot be written returns the error and changes nothing.
+func TestFilestore_Transaction_JournalFailure(t *testing.T) {
+	storage := newFaultyStorage()
+	f := newTestStore(t, storage, testOptions(),
+		map[string]string{"a": "old"})
+	storage.fail(0, -1)
+	err := f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Set([]byte("new"))
+		files["b"].Set([]byte("new"))
+		return nil
+	}, "a", "b")
+	storage.fail(-1, -1)
+	if err == nil {
+		t.Fatalf("Transaction succeeded without its journal")
+	}
+	checkValues(t, f, map[string]string{"a": "old"})
+	if ok, err := f.Has("b"); err != nil || ok {
+		t.Errorf("Write of a failed transaction landed: %t, %+v", ok, err)
+	}
+}
+
+// stuckJournalStorage wraps a Storage and, while stuck, fails every attempt
+// to overwrite or remove a transaction journal, so that journals stay behind
+// once written.
+type stuckJournalStorage struct {
+	portable.Storage
+	stuck bool
+}
+
+// isStuck returns true if the file is a written journal that cannot be
+// removed.
+func (s *stuckJournalStorage) isStuck(name string) bool {
+	if !s.stuck || !strings.HasPrefix(path.Base(name), txJournalPrefix) {
+		return false
+	}
+	info, err := s.Storage.Stat(name)
+	return err == nil && info.Size() > 0
+}
+
+func (s *stuckJournalStorage) Create(name string) (portable.File, error) {
+	if s.isStuck(name) {
+		return nil, errors.New("injected journal removal failure")
+	}
+	return s.Storage.Create(name)
+}
+
+func (s *stuckJournalStorage) Remove(name string) error {
+	if s.isStuck(name) {
+		return errors.New("injected journal removal failure")
+	}
+	return s.Storage.Remove(name)
+}
+
+func (s *stuckJournalStorage) ReadDir(name string) ([]string, error) {
+	return portable.ReadDir(s.Storage, name)
+}
+
+// testJournalLeftBehind applies a transaction whose journal cannot be removed,
+// writes and deletes its values again and checks that reopening the store
+// does not replay the journal over the newer changes.
+func testJournalLeftBehind(t *testing.T, opts Options) {
+	storage := &stuckJournalStorage{
+		Storage: portable.UseKeyValue(newMemoryKV())}
+	f := newTestStore(t, storage, opts,
+		map[string]string{"a": "old", "b": "old", "c": "old"})
+
+	storage.stuck = true
+	err := f.Transaction(func(files map[string]Operable, _ Extender) error {
+		files["a"].Set([]byte("new"))
+		files["b"].Set([]byte("new"))
+		files["c"].Delete()
+		files["d"].Set([]byte("new"))
+		return nil
+	}, "a", "b", "c", "d")
+	if err == nil {
+		t.Fatalf("Journal removal did not fail")
+	}
+	storage.stuck = false
+	if n := countJournals(t, storage); n != 1 {
+		t.Fatalf("Expected the journal to be left behind, found %d", n)
+	}
+
+	if err = f.SetBytes("a", []byte("newer")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.SetBytes("c", []byte("newer")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err = f.Delete("b"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	f, err = openTestStore(storage, "dir", testPassword)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	checkValues(t, f, map[string]string{"a": "newer", "c": "newer",
+		"d": "new"})
+	if ok, err := f.Has("b"); err != nil || ok {
+		t.Errorf("Deleted value was written back: %t, %+v", ok, err)
+	}
+	if n := countJournals(t, storage); n != 0 {
+		t.Errorf("%d journals left after reopening", n)
+	}
+}
+
+// TestFilestore_Transaction_JournalLeftBehind runs testJournalLeftBehind on
+// stores with and without a manifest.
+func TestFilestore_Transaction_JournalLeftBehind(t *testing.T) {
+	manifest := testOptions()
+	manifest.Manifest = true
+	for name, opts := range map[string]Options{"plain": testOptions(),
+		"manifest": manifest} {
+		t.Run(name, func(t *testing.T) {
+			testJournalLeftBehind(t, opts)
+		})
+	}
+}